@@ -0,0 +1,78 @@
+package ucs
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL is a list of networks allowed to do something. A nil ACL allows
+// everyone.
+type ACL []*net.IPNet
+
+// Parse a list of networks (ex. "10.0.0.0/8,192.168.1.17"), separated by
+// commas, semicolons or whitespace. Single addresses are treated as networks
+// of their own. An empty string gives a nil ACL.
+func ParseACL(s string) (ACL, error) {
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' ' || r == '\t'
+	})
+	if len(fields) == 0 {
+		return nil, nil
+	}
+
+	acl := make(ACL, 0, len(fields))
+	for _, field := range fields {
+		if !strings.Contains(field, "/") {
+			ip := net.ParseIP(field)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address '%s'", field)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			acl = append(acl, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, network)
+	}
+	return acl, nil
+}
+
+// Check if the given address ("ip:port" or just "ip") is allowed
+func (a ACL) Allows(addr string) bool {
+	if a == nil {
+		return true
+	}
+
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range a {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a ACL) String() string {
+	networks := make([]string, len(a))
+	for i, network := range a {
+		networks[i] = network.String()
+	}
+	return strings.Join(networks, ",")
+}
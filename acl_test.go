@@ -0,0 +1,121 @@
+package ucs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/msiebuhr/ucs/cache"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL("10.0.0.0/8, 192.168.1.17;fd00::/8")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing ACL: %s", err)
+	}
+
+	tests := map[string]bool{
+		"10.1.2.3:5000":   true,
+		"10.1.2.3":        true,
+		"192.168.1.17:80": true,
+		"192.168.1.18:80": false,
+		"[fd00::1]:8126":  true,
+		"[fe80::1]:8126":  false,
+		"pipe":            false,
+		"11.0.0.1:1234":   false,
+	}
+	for addr, expected := range tests {
+		if acl.Allows(addr) != expected {
+			t.Errorf("Expected %s to be allowed=%t", addr, expected)
+		}
+	}
+
+	// Nothing configured allows everyone
+	acl, err = ParseACL("")
+	if err != nil || acl != nil {
+		t.Errorf("Expected empty string to give nil ACL, got %s, %s", acl, err)
+	}
+	if !acl.Allows("11.0.0.1:1234") {
+		t.Errorf("Expected nil ACL to allow everyone")
+	}
+
+	if _, err := ParseACL("10.0.0.0/33"); err == nil {
+		t.Errorf("Expected error parsing invalid network")
+	}
+	if _, err := ParseACL("not-an-ip"); err == nil {
+		t.Errorf("Expected error parsing invalid address")
+	}
+}
+
+func TestReadOnlyDiscardsUploads(t *testing.T) {
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) {
+		s.Cache = cache.NewMemory(1e6)
+		s.ReadOnly = true
+	})
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	data := []byte("Here is some very lovely test information for ya'")
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+		fmt.Fprintf(client, "pi%016x", len(data))
+		client.Write(data)
+		fmt.Fprintf(client, "te")
+		fmt.Fprintf(client, "gi%016s%016s", "dead", "beef")
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x-i%016s%016s", 0xfe, "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+}
+
+func TestReadACLDeniesGets(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	tx := c.PutTransaction("", []byte(fmt.Sprintf("%016s%016s", "dead", "beef")))
+	tx.Put(4, cache.KIND_INFO, bytes.NewReader([]byte("info")))
+	tx.Commit()
+
+	acl, _ := ParseACL("10.0.0.0/8")
+	s := NewServer(func(s *Server) {
+		s.Cache = c
+		s.ReadACL = acl
+	})
+	defer s.Stop()
+
+	tests := map[string]string{
+		"10.0.0.1:1234": fmt.Sprintf("%08x+i%016x%016s%016sinfo", 0xfe, 4, "dead", "beef"),
+		"11.0.0.1:1234": fmt.Sprintf("%08x-i%016s%016s", 0xfe, "dead", "beef"),
+	}
+
+	for addr, expected := range tests {
+		client, server := net.Pipe()
+		ctx := context.WithValue(context.Background(), "addr", addr)
+		go s.handleRequest(ctx, server)
+
+		go func() {
+			fmt.Fprintf(client, "%08x", 0xfe)
+			fmt.Fprintf(client, "gi%016s%016s", "dead", "beef")
+			client.Write([]byte("q"))
+		}()
+
+		out, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Errorf("Error reading response: %s", err)
+		}
+		if !bytes.Equal(out, []byte(expected)) {
+			t.Errorf("Expected reply to %s to be\n `%s`, got\n `%s`", addr, expected, string(out))
+		}
+	}
+}
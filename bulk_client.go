@@ -1,13 +1,11 @@
 package ucs
 
 import (
-	//"errors"
 	"fmt"
 	"io"
-	"strconv"
-	"strings"
 
 	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/protocol"
 )
 
 // BulkClient sends requests in bulk, like Unity does. That is, it sends
@@ -16,42 +14,46 @@ type BulkClient struct {
 	Conn     io.ReadWriteCloser
 	Callback func(K cache.Kind, uuidAndHash []byte, hit bool, data io.Reader)
 
-	getRequests []io.Reader
+	getRequests []protocol.Get
 	putRequests []io.WriterTo
+
+	dec *protocol.Decoder
 }
 
 func NewBulkClientConn(conn io.ReadWriteCloser) *BulkClient {
 	return &BulkClient{Conn: conn}
 }
 
-func (c BulkClient) NegotiateVersion(my uint32) (uint32, error) {
-	fmt.Fprintf(c.Conn, "%08x", my)
-	versionBytes := make([]byte, 8)
-	_, err := io.ReadFull(c.Conn, versionBytes)
-	if err != nil {
-		return 0, err
+// The decoder is kept around, as it may have read ahead
+func (c *BulkClient) decoder() *protocol.Decoder {
+	if c.dec == nil {
+		c.dec = protocol.NewDecoder(c.Conn)
 	}
+	return c.dec
+}
 
-	version, err := strconv.ParseUint(string(versionBytes), 16, 32)
-	return uint32(version), err
+func (c *BulkClient) NegotiateVersion(my uint32) (uint32, error) {
+	if err := protocol.NewEncoder(c.Conn).Encode(protocol.Version{Number: my}); err != nil {
+		return 0, err
+	}
+	version, err := c.decoder().DecodeVersion()
+	return version.Number, err
 }
 
 // Gracefully quit the current connection and close down
-func (c BulkClient) Quit() error {
-	_, err := fmt.Fprintf(c.Conn, "q")
-	return err
+func (c *BulkClient) Quit() error {
+	return protocol.NewEncoder(c.Conn).Encode(protocol.Quit{})
 }
 
 // Close the connection. Unpolite, I guess, but that's what Unity is
 // observed to do in the wild.
-func (c BulkClient) Close() error {
+func (c *BulkClient) Close() error {
 	return c.Conn.Close()
 }
 
 // Enqueue a get-request and wait for response to show up
 func (c *BulkClient) Get(K cache.Kind, uuidAndHash []byte) error {
-	command := fmt.Sprintf("g%c%s", K, uuidAndHash)
-	c.getRequests = append(c.getRequests, strings.NewReader(command))
+	c.getRequests = append(c.getRequests, protocol.Get{Kind: K, UuidAndHash: uuidAndHash})
 	return nil
 }
 
@@ -71,9 +73,9 @@ func (c *BulkClient) Execute() error {
 	}()
 
 	// We should send enqueued requests here
-	for _, cmd := range c.getRequests {
-		_, err := io.Copy(c.Conn, cmd)
-		if err != nil {
+	enc := protocol.NewEncoder(c.Conn)
+	for _, get := range c.getRequests {
+		if err := enc.Encode(get); err != nil {
 			return err
 		}
 	}
@@ -86,12 +88,10 @@ func (c *BulkClient) Execute() error {
 		}
 	}
 
-	// Read a response for each PUT-request we did
-	// TODO: Read only for PUTs
-	for i := 0; i < len(c.getRequests); i += 1 {
-		// Positive or negative response
-		typeAndHit := make([]byte, 2)
-		_, err := io.ReadFull(c.Conn, typeAndHit)
+	// Read a response for each GET-request we did
+	dec := c.decoder()
+	for range c.getRequests {
+		cmd, err := dec.Decode()
 		// New command, but is connection closed
 		if err == io.EOF {
 			return nil
@@ -100,44 +100,22 @@ func (c *BulkClient) Execute() error {
 			return err
 		}
 
-		// What to do now?
-		//if typeAndHit[1] != byte(g.K) {
-		//	return errors.New("Unexpected kind returned")
-		//}
-
-		uuidAndHash := make([]byte, 32)
-		var size uint64
-
-		if typeAndHit[0] == '+' {
-			sizeBytes := make([]byte, 16)
-			_, err := io.ReadFull(c.Conn, sizeBytes)
-			if err != nil {
-				return err
-			}
-			size, err = strconv.ParseUint(string(sizeBytes), 16, 64)
-			if err != nil {
-				return err
-			}
-		}
-		_, err = io.ReadFull(c.Conn, uuidAndHash)
-
-		hit := true
-		if typeAndHit[0] == '-' {
-			hit = false
-			size = 0
+		response, ok := cmd.(protocol.GetResponse)
+		if !ok {
+			return fmt.Errorf("Unexpected response %#v", cmd)
 		}
 
 		// Callback to let the client handle returned data
 		c.Callback(
-			cache.Kind(typeAndHit[1]),
-			uuidAndHash,
-			hit,
-			io.LimitReader(c.Conn, int64(size)),
+			response.Kind,
+			response.UuidAndHash,
+			response.Hit,
+			dec.Payload(),
 		)
 	}
 
 	// Clear queue?
-	c.getRequests = []io.Reader{}
+	c.getRequests = []protocol.Get{}
 
 	return nil
 }
@@ -2,12 +2,15 @@ package cache
 
 import (
 	"io"
+	"io/ioutil"
 )
 
 type NOPTransaction struct{}
 
+// Read and discard the data
 func (nt NOPTransaction) Put(size int64, k Kind, r io.Reader) error {
-	return nil
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
 }
 
 func (nt NOPTransaction) Commit() error { return nil }
@@ -6,7 +6,6 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
-	"os"
 	"testing"
 
 	"github.com/docker/go-units"
@@ -45,16 +44,13 @@ func benchmarkBackendSequentialReadBuf(b *testing.B, c Cacher, size int64) {
 
 func BenchmarkFSPositive(b *testing.B) {
 	c, err := NewFS(func(f *FS) {
-		f.Basepath = "./testdata"
+		f.Basepath = b.TempDir()
 		f.Quota = 1024 * 1024 * 1024
 	})
 	if err != nil {
 		b.Fatalf("Error creating FS: %s", err)
 	}
-
-	defer func() {
-		os.RemoveAll(c.Basepath)
-	}()
+	defer c.Close()
 
 	for _, size := range []int64{1024, 1024 * 128, 1024 * 1024, 1024 * 1024 * 128} {
 		b.Run(fmt.Sprintf("streaming,size=%s", units.BytesSize(float64(size))), func(b *testing.B) {
@@ -65,16 +61,13 @@ func BenchmarkFSPositive(b *testing.B) {
 
 func BenchmarkFSPositiveStream(b *testing.B) {
 	c, err := NewFS(func(f *FS) {
-		f.Basepath = "./testdata"
+		f.Basepath = b.TempDir()
 		f.Quota = 1024 * 10
 	})
 	if err != nil {
 		b.Fatalf("Error creating FS: %s", err)
 	}
-
-	defer func() {
-		os.RemoveAll(c.Basepath)
-	}()
+	defer c.Close()
 
 	key := make([]byte, 32)
 	rand.Read(key)
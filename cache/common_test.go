@@ -3,7 +3,6 @@ package cache
 import (
 	"bytes"
 	"math/rand"
-	"os"
 	"strings"
 	"testing"
 )
@@ -15,10 +14,12 @@ func TestAll(t *testing.T) {
 		"mem": NewMemory(1e6),
 	}
 
-	c, err := NewFS(func(f *FS) { f.Basepath = "./testdata"; f.Quota = 100 })
+	c, err := NewFS(func(f *FS) { f.Basepath = t.TempDir(); f.Quota = 100 })
 	if err != nil {
 		t.Fatalf("Error creating FS: %s", err)
 	}
+	defer c.Close()
+	c.WaitForScan()
 	caches["fs"] = c
 
 	for name, cache := range caches {
@@ -35,12 +36,12 @@ func TestAll(t *testing.T) {
 			t.Run("PutTransaction", func(t *testing.T) {
 				test_commit_transaction(t, cache)
 			})
+
+			t.Run("PutKindTwice", func(t *testing.T) {
+				test_put_kind_twice(t, cache)
+			})
 		})
 	}
-
-	defer func() {
-		os.RemoveAll(c.Basepath)
-	}()
 }
 
 func test_namespacing(t *testing.T, c Cacher) {
@@ -96,3 +97,23 @@ func test_commit_transaction(t *testing.T, c Cacher) {
 	// Positive lookup for `key`
 	testCacheHit(t, c, "tx", KIND_INFO, key, []byte("foobar"))
 }
+
+func test_put_kind_twice(t *testing.T, c Cacher) {
+	key := make([]byte, 32)
+	rand.Read(key)
+	usage := c.(interface{ Usage() int64 })
+	before := usage.Usage()
+
+	// The second put of a kind replaces the first
+	tx := c.PutTransaction("tx", key)
+	tx.Put(6, KIND_ASSET, strings.NewReader("foobar"))
+	tx.Put(3, KIND_ASSET, strings.NewReader("baz"))
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Unexpected error calling Commit(): %s", err)
+	}
+
+	testCacheHit(t, c, "tx", KIND_ASSET, key, []byte("baz"))
+	if used := usage.Usage() - before; used != 3 {
+		t.Errorf("Expected 3 more bytes used, got %d", used)
+	}
+}
@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/msiebuhr/ucs/protocol"
+)
+
+// A connection to another cache server that has completed the version
+// handshake.
+type serverConn struct {
+	net.Conn
+	w   *bufio.Writer
+	enc *protocol.Encoder
+	dec *protocol.Decoder
+}
+
+func dialServer(address string, timeout time.Duration) (*serverConn, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(conn)
+	c := &serverConn{
+		Conn: conn,
+		w:    w,
+		enc:  protocol.NewEncoder(w),
+		dec:  protocol.NewDecoder(conn),
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	c.enc.Encode(protocol.Version{Number: protocol.CurrentVersion})
+	if err := c.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	version, err := c.dec.DecodeVersion()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if version.Number != protocol.CurrentVersion {
+		conn.Close()
+		return nil, fmt.Errorf("Unsupported version %x", version.Number)
+	}
+
+	return c, nil
+}
+
+// Read the response to a get-request. The data of hits is read from
+// c.dec.Payload().
+func (c *serverConn) readGetResponse(uuidAndHash []byte) (Kind, int64, bool, error) {
+	cmd, err := c.dec.Decode()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	response, ok := cmd.(protocol.GetResponse)
+	if !ok {
+		return 0, 0, false, fmt.Errorf("Unexpected response %#v", cmd)
+	}
+	if string(response.UuidAndHash) != string(uuidAndHash) {
+		return response.Kind, 0, false, fmt.Errorf("Got response for %s, expected %s", PrettyUuidAndHash(response.UuidAndHash), PrettyUuidAndHash(uuidAndHash))
+	}
+
+	return response.Kind, response.Size, response.Hit, nil
+}
+
+// Politely quit, and wait for the server to hang up. As the server handles
+// commands in order, this means everything sent before has been processed.
+func (c *serverConn) quit() error {
+	defer c.Close()
+	c.enc.Encode(protocol.Quit{})
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	_, err := io.Copy(ioutil.Discard, c.Conn)
+	return err
+}
+
+// Reads from a connection, extending its deadline before each read, so large
+// payloads only time out if they stall
+type deadlineReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(b []byte) (int, error) {
+	d.conn.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(b)
+}
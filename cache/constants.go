@@ -2,21 +2,19 @@ package cache
 
 import (
 	"io"
+
+	"github.com/msiebuhr/ucs/protocol"
 )
 
 // Denotes which kind of data goes in the cache
-type Kind byte
+type Kind = protocol.Kind
 
 const (
-	KIND_ASSET    Kind = 'a'
-	KIND_INFO     Kind = 'i'
-	KIND_RESOURCE Kind = 'r'
+	KIND_ASSET    = protocol.KIND_ASSET
+	KIND_INFO     = protocol.KIND_INFO
+	KIND_RESOURCE = protocol.KIND_RESOURCE
 )
 
-func (k Kind) String() string {
-	return string(k)
-}
-
 type Transaction interface {
 	// Put something into the cache as part of the transaction
 	Put(size int64, kind Kind, reader io.Reader) error
@@ -28,6 +26,20 @@ type Transaction interface {
 	Abort() error
 }
 
+// ClientSetter is implemented by transactions that want to know who is
+// uploading
+type ClientSetter interface {
+	// Tell the transaction who is uploading, ex. "10.0.0.2:51234"
+	SetClient(addr string)
+}
+
+// Tell a transaction who is uploading, if it wants to know
+func setClient(tx Transaction, addr string) {
+	if c, ok := tx.(ClientSetter); ok {
+		c.SetClient(addr)
+	}
+}
+
 // Cacher is the interface to be implemented by caches
 type Cacher interface {
 	// Start an upload transaction
@@ -37,3 +49,18 @@ type Cacher interface {
 	// combination. Returns the asset size, reader and error.
 	Get(string, Kind, []byte) (int64, io.ReadCloser, error)
 }
+
+// Peeker is implemented by backends that can read an entry without counting
+// it as used, ex. for sending it to mirrors
+type Peeker interface {
+	// Like Get, but leaves access times and eviction order alone
+	Peek(string, Kind, []byte) (int64, io.ReadCloser, error)
+}
+
+// Read an entry without counting it as used, if the cache supports it
+func peek(c Cacher, ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	if p, ok := c.(Peeker); ok {
+		return p.Peek(ns, kind, uuidAndHash)
+	}
+	return c.Get(ns, kind, uuidAndHash)
+}
@@ -0,0 +1,147 @@
+package cache
+
+import (
+	"io"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fallback_gets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_fallback_gets",
+		Help: "Gets through parent namespaces, by where they were answered from",
+	}, []string{"namespace", "type", "result"})
+	fallback_promoted_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_fallback_promoted_bytes",
+		Help: "Bytes copied from parent namespaces",
+	}, []string{"namespace", "parent"})
+)
+
+func init() {
+	prometheus.MustRegister(fallback_gets)
+	prometheus.MustRegister(fallback_promoted_bytes)
+}
+
+// Fallback answers misses in a namespace from parent namespaces, ex. the one
+// for the previous Unity version, so a new namespace doesn't start out cold.
+// Parents are tried in order. Uploads always go to the namespace itself.
+type Fallback struct {
+	Cacher
+
+	// Namespaces to look in, in order
+	Parents []string
+
+	// Copy entries found in a parent into the namespace, so they are kept
+	// when the parent is gone. All kinds of an entry are copied in one go.
+	Promote bool
+
+	// Promotions in progress, so concurrent gets for different kinds of an
+	// entry share one
+	lock     sync.Mutex
+	inflight map[string]chan bool
+}
+
+func NewFallback(c Cacher, parents []string, options ...func(*Fallback)) *Fallback {
+	f := &Fallback{
+		Cacher:   c,
+		Parents:  parents,
+		inflight: make(map[string]chan bool),
+	}
+	for _, option := range options {
+		option(f)
+	}
+	return f
+}
+
+func (f *Fallback) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	size, reader, err := f.Cacher.Get(ns, kind, uuidAndHash)
+	if err != nil || size > 0 {
+		if err == nil {
+			fallback_gets.WithLabelValues(ns, string(kind), "hit").Inc()
+		}
+		return size, reader, err
+	}
+	if reader != nil {
+		reader.Close()
+	}
+
+	for _, parent := range f.Parents {
+		if parent == ns {
+			continue
+		}
+		size, reader, err := f.Cacher.Get(parent, kind, uuidAndHash)
+		if err != nil || size == 0 {
+			if reader != nil {
+				reader.Close()
+			}
+			continue
+		}
+
+		fallback_gets.WithLabelValues(ns, string(kind), "parent_hit").Inc()
+		if !f.Promote {
+			return size, reader, nil
+		}
+		reader.Close()
+
+		f.sharedPromote(ns, parent, uuidAndHash)
+		return f.Cacher.Get(ns, kind, uuidAndHash)
+	}
+
+	fallback_gets.WithLabelValues(ns, string(kind), "miss").Inc()
+	return 0, nil, nil
+}
+
+// Promote an entry, or wait for a promotion of it already in progress
+func (f *Fallback) sharedPromote(ns, parent string, uuidAndHash []byte) {
+	key := ns + string(uuidAndHash)
+
+	f.lock.Lock()
+	done, ok := f.inflight[key]
+	if ok {
+		f.lock.Unlock()
+		<-done
+		return
+	}
+	done = make(chan bool)
+	f.inflight[key] = done
+	f.lock.Unlock()
+
+	f.promote(ns, parent, uuidAndHash)
+
+	f.lock.Lock()
+	delete(f.inflight, key)
+	f.lock.Unlock()
+	close(done)
+}
+
+// Copy all kinds of an entry from a parent namespace. Failures leave the entry
+// missing, so the next get tries again.
+func (f *Fallback) promote(ns, parent string, uuidAndHash []byte) {
+	tx := f.Cacher.PutTransaction(ns, uuidAndHash)
+	var copied int64
+	for _, kind := range []Kind{KIND_ASSET, KIND_INFO, KIND_RESOURCE} {
+		size, reader, err := f.Cacher.Get(parent, kind, uuidAndHash)
+		if err != nil || size == 0 {
+			if reader != nil {
+				reader.Close()
+			}
+			continue
+		}
+		err = tx.Put(size, kind, reader)
+		reader.Close()
+		if err != nil {
+			tx.Abort()
+			return
+		}
+		copied += size
+	}
+
+	if copied == 0 {
+		tx.Abort()
+		return
+	}
+	if err := tx.Commit(); err == nil {
+		fallback_promoted_bytes.WithLabelValues(ns, parent).Add(float64(copied))
+	}
+}
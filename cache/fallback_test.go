@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	for _, promote := range []bool{false, true} {
+		m := NewMemory(1e6)
+		f := NewFallback(m, []string{"2019.1", "2018.4"}, func(f *Fallback) {
+			f.Promote = promote
+		})
+
+		put := func(ns string, key []byte, data string) {
+			tx := m.PutTransaction(ns, key)
+			if err := tx.Put(int64(len(data)), KIND_ASSET, bytes.NewReader([]byte(data))); err != nil {
+				t.Fatalf("Unexpected error calling Put(): %s", err)
+			}
+			if err := tx.Put(int64(len(data)), KIND_INFO, bytes.NewReader([]byte(data))); err != nil {
+				t.Fatalf("Unexpected error calling Put(): %s", err)
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Unexpected error calling Commit(): %s", err)
+			}
+		}
+
+		own, inBoth, inOldest, missing := make([]byte, 32), make([]byte, 32), make([]byte, 32), make([]byte, 32)
+		own[0], inBoth[0], inOldest[0], missing[0] = 1, 2, 3, 4
+		put("2020.1", own, "own")
+		put("2019.1", inBoth, "2019.1")
+		put("2018.4", inBoth, "2018.4")
+		put("2018.4", inOldest, "2018.4")
+
+		// The namespace's own entries come first, then parents' in order
+		testCacheHit(t, f, "2020.1", KIND_ASSET, own, []byte("own"))
+		testCacheHit(t, f, "2020.1", KIND_ASSET, inBoth, []byte("2019.1"))
+		testCacheHit(t, f, "2020.1", KIND_ASSET, inOldest, []byte("2018.4"))
+		if found, _, _ := readFromCache(f, "2020.1", KIND_ASSET, missing); found {
+			t.Errorf("Expected miss for entry in no namespace")
+		}
+
+		// Promoting copies all kinds of the entry
+		found, _, _ := readFromCache(m, "2020.1", KIND_INFO, inOldest)
+		if found != promote {
+			t.Errorf("Expected found=%t for promoted entry with promote=%t, got %t", promote, promote, found)
+		}
+
+		// Uploads go to the namespace itself
+		tx := f.PutTransaction("2020.1", missing)
+		tx.Put(3, KIND_ASSET, bytes.NewReader([]byte("new")))
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected error calling Commit(): %s", err)
+		}
+		testCacheHit(t, m, "2020.1", KIND_ASSET, missing, []byte("new"))
+		if found, _, _ := readFromCache(m, "2019.1", KIND_ASSET, missing); found {
+			t.Errorf("Expected upload not to go to parent")
+		}
+	}
+}
@@ -2,9 +2,13 @@ package cache
 
 import (
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,22 +17,26 @@ import (
 )
 
 var (
-	fs_gc_duration = prometheus.NewSummary(prometheus.SummaryOpts{
+	fs_gc_duration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name: "ucs_fscache_gc_duration_seconds",
 		Help: "Time spent deleting data",
-	})
-	fs_gc_bytes = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"backend"})
+	fs_gc_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "ucs_fscache_gc_removed_bytes",
 		Help: "Bytes deleted by GC",
-	})
+	}, []string{"backend"})
 	fs_size = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ucs_fscache_size_bytes",
 		Help: "Size of cache in bytes",
-	}, []string{"namespace"})
-	fs_quota = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"backend", "namespace"})
+	fs_quota = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ucs_fscache_quota_bytes",
-		Help: "Size of quota in bytes",
-	})
+		Help: "Size of quota in bytes, overall (namespace=\"\") and per namespace",
+	}, []string{"backend", "namespace"})
+	fs_index_rebuilds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_fscache_index_rebuilds",
+		Help: "Times the index was missing or corrupt, and rebuilt from the cache directory",
+	}, []string{"backend"})
 )
 
 func init() {
@@ -36,19 +44,74 @@ func init() {
 	prometheus.MustRegister(fs_gc_bytes)
 	prometheus.MustRegister(fs_size)
 	prometheus.MustRegister(fs_quota)
+	prometheus.MustRegister(fs_index_rebuilds)
 }
 
 type FS struct {
+	// Guards Size, Quota, MismatchPolicy, usage and quotas. Files are only
+	// ever renamed into place or removed, so reading them needs no locking.
 	lock     sync.RWMutex
 	Basepath string
 	Size     int64
 	Quota    int64
 
+	// Tells backends apart in metrics
+	Name string
+
+	// Bytes used by and limits for each namespace
+	usage  map[string]int64
+	quotas map[string]NamespaceQuota
+
+	// When each namespace was last used
+	access accessTimes
+
+	// Every entry, by last access
+	index *fsIndex
+
+	// What to do about re-uploads with different content, and where to
+	// log them
+	MismatchPolicy MismatchPolicy
+	Log            *log.Logger
+
 	transactionCout uint64
+
+	// Only one GC runs at a time
+	gcLock sync.Mutex
+
+	// Entries are committed and removed by GC one at a time
+	keyLocks [fsKeyLocks]sync.Mutex
+
+	// Who uploaded recent entries, for reporting mismatches. Bounded by
+	// simply starting over when it gets too big.
+	uploadersLock sync.Mutex
+	uploaders     map[string]string
+
+	// Closed when the index is loaded, and when left over transactions'
+	// files have been swept up after that
+	scanned chan bool
+	swept   chan bool
 }
 
+// Max number of entries to remember uploaders for
+const fsMaxUploaders = 100000
+
+// Number of locks entries are spread over
+const fsKeyLocks = 256
+
+// Transactions' files not written to for this long are left over from
+// crashes, and removed when starting up
+const fsStaleTransactionAge = time.Hour
+
 func NewFS(options ...func(*FS)) (*FS, error) {
-	fs := &FS{Basepath: "./unity-cache"}
+	fs := &FS{
+		Basepath:  "./unity-cache",
+		Log:       log.New(ioutil.Discard, "", 0),
+		uploaders: make(map[string]string),
+		scanned:   make(chan bool),
+		swept:     make(chan bool),
+		usage:     make(map[string]int64),
+		quotas:    make(map[string]NamespaceQuota),
+	}
 	for _, f := range options {
 		f(fs)
 	}
@@ -59,101 +122,250 @@ func NewFS(options ...func(*FS)) (*FS, error) {
 		return fs, err
 	}
 	fs.Basepath = path
+	if err := os.MkdirAll(fs.Basepath, os.ModePerm); err != nil {
+		return fs, err
+	}
 
-	// Kick off an initial GC, so we can get proper sizing info
-	go fs.collectGarbageOnce()
+	fs_quota.WithLabelValues(fs.Name, "").Set(float64(fs.Quota))
+
+	// Load the index in the background, as it may have to be rebuilt
+	fs.index = newFSIndex(fs.Basepath)
+	go fs.loadIndex()
 
 	return fs, nil
 }
 
-func (fs *FS) collectGarbage() {
-	var lastSize int64 = -1
+// Wait for the index to be loaded, after which sizes are accurate and GC
+// runs
+func (fs *FS) WaitForScan() {
+	<-fs.scanned
+}
 
-	for {
-		fs.lock.Lock()
-		size := fs.Size
-		quota := fs.Quota
-		fs.lock.Unlock()
+// Stop writing the index, after waiting for it to be loaded. The FS must
+// not be used afterwards.
+func (fs *FS) Close() error {
+	err := fs.index.close()
+	<-fs.swept
+	return err
+}
 
-		if size <= quota {
-			return
+func (fs *FS) loadIndex() {
+	start := time.Now()
+	added, err := fs.index.load(fs.Basepath)
+	if err != nil {
+		fs_index_rebuilds.WithLabelValues(fs.Name).Inc()
+		fs.Log.Printf("Rebuilt index of %s in %s: %s", fs.Basepath, time.Now().Sub(start), err)
+	}
+
+	// Commits and removals since starting have been counted already
+	for ns, s := range added {
+		fs.addUsage(ns, s.size)
+		fs.access.touch(fs.Name, ns, s.lastAccess)
+	}
+	close(fs.scanned)
+
+	fs.sweepTransactions()
+	close(fs.swept)
+	fs.collectGarbage()
+}
+
+// Remove files of transactions that were never committed or aborted, ex.
+// because of a crash
+func (fs *FS) sweepTransactions() {
+	namespaces, err := ioutil.ReadDir(fs.Basepath)
+	if err != nil {
+		return
+	}
+	before := time.Now().Add(-fsStaleTransactionAge)
+	for _, dir := range namespaces {
+		if !dir.IsDir() {
+			continue
 		}
-		// Did we make any progress?
-		if lastSize == size {
-			return
+		for i := 0; i < 256; i += 1 {
+			dirname := filepath.Join(fs.Basepath, dir.Name(), fmt.Sprintf("%02x", i))
+			files, err := ioutil.ReadDir(dirname)
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				if strings.Contains(file.Name(), ".tx-") && file.ModTime().Before(before) {
+					os.Remove(filepath.Join(dirname, file.Name()))
+				}
+			}
 		}
-
-		fs.collectGarbageOnce()
 	}
 }
 
-// Remove old files (as measured by the most recent ATIME of any entry sharing
-// the same UUID/hash)
-// Also re-calculates the total size of cache directory, now we're at scanning
-// everything anyway...
-func (fs *FS) collectGarbageOnce() {
-	// Report quota up front
-	fs_quota.Set(float64(fs.Quota))
+// Current size of the cache in bytes
+func (fs *FS) Usage() int64 {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.Size
+}
 
-	start := time.Now()
+// Limit a namespace's share of the cache; see NamespaceQuota
+func (fs *FS) SetNamespaceQuota(ns string, quota NamespaceQuota) {
+	fs.lock.Lock()
+	fs.quotas[ns] = quota
+	fs.lock.Unlock()
+
+	if quota.Max > 0 {
+		fs_quota.WithLabelValues(fs.Name, ns).Set(float64(quota.Max))
+	} else {
+		fs_quota.DeleteLabelValues(fs.Name, ns)
+	}
+}
 
+// Change the overall quota, evicting what no longer fits
+func (fs *FS) SetQuota(quota int64) {
 	fs.lock.Lock()
+	fs.Quota = quota
+	fs.lock.Unlock()
 
-	defer fs_gc_duration.Observe(time.Now().Sub(start).Seconds())
+	fs_quota.WithLabelValues(fs.Name, "").Set(float64(quota))
+	go fs.collectGarbage()
+}
+
+// Change what's done about re-uploads with different content
+func (fs *FS) SetMismatchPolicy(policy MismatchPolicy) {
+	fs.lock.Lock()
 	defer fs.lock.Unlock()
+	fs.MismatchPolicy = policy
+}
 
-	totalSize, old, err := findApproximateOldFiles(fs.Basepath)
+func (fs *FS) mismatchPolicy() MismatchPolicy {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return fs.MismatchPolicy
+}
 
-	if err != nil {
-		fmt.Printf("Error running GC: %#v\n", err)
-		return
+func (fs *FS) overQuota() bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return overQuota(fs.Quota, fs.Size, fs.quotas, fs.usage)
+}
+
+func (fs *FS) evictable(ns string, size int64) bool {
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	return evictable(ns, size, fs.Quota, fs.Size, fs.quotas, fs.usage)
+}
+
+// Account for bytes added to (or removed from) a namespace
+func (fs *FS) addUsage(ns string, size int64) {
+	fs.lock.Lock()
+	fs.Size += size
+	fs.usage[ns] += size
+	fs.lock.Unlock()
+	fs_size.WithLabelValues(fs.Name, ns).Add(float64(size))
+}
+
+// Namespaces stored, with their size and last access; see Retirer
+func (fs *FS) Namespaces() []NamespaceUsage {
+	fs.lock.RLock()
+	sizes := make(map[string]int64, len(fs.usage))
+	for ns, size := range fs.usage {
+		sizes[ns] = size
 	}
+	fs.lock.RUnlock()
 
-	fs.Size = totalSize
+	return namespaceUsage(sizes, &fs.access)
+}
 
-	// Ideally, we should delete the very oldest stuff first (and both info and
-	// asset/resource), and then re-scan that directory.
-	// But I'm lazy right now - let's just delete the oldst thing we found in
-	// all folders and see how far that get's us.
-	for i := 0; i < len(old) && fs.Size > fs.Quota; i += 1 {
-		if len(old[i].uuidAndHash) == 0 {
-			continue
+// Remove a namespace's directory, or move it into archive as
+// <namespace>-<time>; see Retirer
+func (fs *FS) RetireNamespace(ns, archive string) error {
+	// Keep GC from scanning the directory while it goes
+	fs.gcLock.Lock()
+	defer fs.gcLock.Unlock()
+
+	dir := fs.namespaceDir(ns)
+	var err error
+	if archive != "" {
+		err = os.MkdirAll(archive, os.ModePerm)
+		if err == nil {
+			to := fmt.Sprintf("%s-%s", filepath.Base(dir), time.Now().Format("20060102-150405"))
+			err = os.Rename(dir, filepath.Join(archive, to))
 		}
+	} else {
+		err = os.RemoveAll(dir)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 
-		successfulDeletes := 0
-		for _, kind := range []Kind{KIND_ASSET, KIND_INFO, KIND_RESOURCE} {
-			path := fs.generateFilename(old[i].ns, kind, old[i].uuidAndHash)
+	fs.index.removeNamespace(ns)
+	fs.lock.Lock()
+	fs.Size -= fs.usage[ns]
+	delete(fs.usage, ns)
+	fs.lock.Unlock()
+	fs_size.DeleteLabelValues(fs.Name, ns)
+	fs.access.forget(fs.Name, ns)
 
-			err := os.Remove(path)
-			if err != nil {
-				successfulDeletes += 1
-			}
-		}
+	return nil
+}
 
-		// Accounting is approximate, as findApproximateOldFiles() doesn't
-		// guarantee that it finds all kinds of a resource in one go (yet we
-		// delete them in one go).
-		//
-		// Next loop of the GC should fix the overall stats, tho.
-		if successfulDeletes > 0 {
-			size := float64(old[i].size)
-			fs_gc_bytes.Add(size)
-			fs_size.WithLabelValues(old[i].ns).Sub(size)
-			fs.Size -= old[i].size
-		}
+// Evict the least recently used entries until the cache is within its
+// quotas. Waits for the index to be loaded, as it can't tell what to evict
+// before.
+func (fs *FS) collectGarbage() {
+	fs.WaitForScan()
+
+	// Deleting is done without holding fs.lock, so gets and commits aren't
+	// held up by it
+	fs.gcLock.Lock()
+	defer fs.gcLock.Unlock()
+
+	if !fs.overQuota() {
+		return
+	}
+	start := time.Now()
+	defer func() { fs_gc_duration.WithLabelValues(fs.Name).Observe(time.Now().Sub(start).Seconds()) }()
 
-		// Bail if we get below the quota
-		if fs.Size <= fs.Quota {
+	// Namespaces over their own quota, or above their minimum while the
+	// cache is over quota, are evicted from.
+	for fs.overQuota() {
+		e, lastAccess := fs.index.oldest(fs.evictable)
+		if e == nil {
 			return
 		}
+		fs.evict(e, lastAccess)
 	}
 }
 
-func (fs *FS) generateDir(ns string, uuidAndHash []byte) string {
+// Remove an entry picked for eviction, unless it has been committed or
+// read since
+func (fs *FS) evict(e *fsIndexEntry, lastAccess time.Time) {
+	lock := fs.keyLock(e.ns, e.uuidAndHash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if !fs.index.evict(e, lastAccess) {
+		return
+	}
+	for kind := range e.sizes {
+		os.Remove(fs.generateFilename(e.ns, kind, e.uuidAndHash))
+	}
+	fs_gc_bytes.WithLabelValues(fs.Name).Add(float64(e.size))
+	fs.addUsage(e.ns, -e.size)
+}
+
+// The lock guarding an entry's files against being removed and replaced at
+// the same time
+func (fs *FS) keyLock(ns string, uuidAndHash []byte) *sync.Mutex {
+	return &fs.keyLocks[crc32.ChecksumIEEE([]byte(fsIndexKey(ns, uuidAndHash)))%fsKeyLocks]
+}
+
+// Where a namespace is stored
+func (fs *FS) namespaceDir(ns string) string {
 	if ns == "" {
 		ns = "__default"
 	}
-	return filepath.Join(fs.Basepath, ns, fmt.Sprintf("%02x", uuidAndHash[:1]))
+	return filepath.Join(fs.Basepath, ns)
+}
+
+func (fs *FS) generateDir(ns string, uuidAndHash []byte) string {
+	return filepath.Join(fs.namespaceDir(ns), fmt.Sprintf("%02x", uuidAndHash[:1]))
 }
 
 func (fs *FS) generateFilename(ns string, kind Kind, uuidAndHash []byte) string {
@@ -176,12 +388,19 @@ func (fs *FS) generateFilename(ns string, kind Kind, uuidAndHash []byte) string
 }
 
 func (fs *FS) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
-	path := fs.generateFilename(ns, kind, uuidAndHash)
+	now := time.Now()
+	fs.access.touch(fs.Name, ns, now)
 
-	fs.lock.RLock()
-	defer fs.lock.RUnlock()
+	size, f, err := fs.Peek(ns, kind, uuidAndHash)
+	if f != nil {
+		fs.index.touch(ns, uuidAndHash, now)
+	}
+	return size, f, err
+}
 
-	f, err := os.Open(path)
+// Read an entry without counting it as used; see Peeker
+func (fs *FS) Peek(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	f, err := os.Open(fs.generateFilename(ns, kind, uuidAndHash))
 	if err != nil && os.IsNotExist(err) {
 		return 0, nil, nil
 	} else if err != nil {
@@ -190,9 +409,9 @@ func (fs *FS) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadClose
 
 	stat, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return 0, nil, err
 	}
-
 	return stat.Size(), f, nil
 }
 
@@ -204,6 +423,7 @@ func (fs *FS) PutTransaction(ns string, uuidAndHash []byte) Transaction {
 		nsSuffix:    fmt.Sprintf(".tx-%010d", count),
 		uuidAndHash: uuidAndHash,
 		kinds:       []Kind{},
+		sizes:       make(map[Kind]int64),
 	}
 }
 
@@ -211,15 +431,23 @@ type FSTx struct {
 	fs          *FS
 	ns          string
 	nsSuffix    string
+	client      string
 	uuidAndHash []byte
 
 	// Track what kinds have been uploaded
 	kinds []Kind
-	size  int64
+	sizes map[Kind]int64
+}
+
+func (t *FSTx) SetClient(addr string) {
+	t.client = addr
 }
 
 func (t *FSTx) Put(size int64, kind Kind, r io.Reader) error {
-	t.kinds = append(t.kinds, kind)
+	// Putting a kind again replaces the earlier upload of it
+	if !t.has(kind) {
+		t.kinds = append(t.kinds, kind)
+	}
 	// Make sure leading directory exists!
 	leadingPath := t.fs.generateDir(t.ns, t.uuidAndHash)
 	os.MkdirAll(leadingPath, os.ModePerm)
@@ -231,13 +459,123 @@ func (t *FSTx) Put(size int64, kind Kind, r io.Reader) error {
 		return err
 	}
 	defer f.Close()
-	t.size += size
+	t.sizes[kind] = size
 
-	_, err = io.Copy(f, r)
+	_, err = io.CopyN(f, r, size)
 	return err
 }
 
+func (t *FSTx) has(kind Kind) bool {
+	for _, k := range t.kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (fs *FS) swapUploader(ns string, uuidAndHash []byte, client string) string {
+	fs.uploadersLock.Lock()
+	defer fs.uploadersLock.Unlock()
+
+	key := ns + string(uuidAndHash)
+	previous := fs.uploaders[key]
+	if len(fs.uploaders) >= fsMaxUploaders {
+		fs.uploaders = make(map[string]string)
+	}
+	fs.uploaders[key] = client
+	return previous
+}
+
+// Compare uploaded files with what is already stored, returning true if
+// anything differs
+func (t *FSTx) mismatches(policy MismatchPolicy) (bool, error) {
+	storedClient := t.fs.swapUploader(t.ns, t.uuidAndHash, t.client)
+	mismatch := false
+
+	for _, k := range t.kinds {
+		to := t.fs.generateFilename(t.ns, k, t.uuidAndHash)
+		stored, err := os.Open(to)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		uploaded, err := os.Open(to + t.nsSuffix)
+		if err != nil {
+			stored.Close()
+			return false, err
+		}
+
+		same, err := sameContent(stored, uploaded)
+		stored.Close()
+		uploaded.Close()
+		if err != nil {
+			return false, err
+		}
+		if !same {
+			mismatch = true
+			reportMismatch(t.fs.Log, t.ns, k, t.uuidAndHash, storedClient, t.client, policy)
+		}
+	}
+
+	if mismatch && policy == MISMATCH_KEEP_FIRST {
+		// Keep remembering the original uploader
+		t.fs.swapUploader(t.ns, t.uuidAndHash, storedClient)
+	}
+
+	return mismatch, nil
+}
+
+// Remove the stored entry, as done when rejecting mismatching re-uploads
+func (t *FSTx) removeStored() {
+	for _, k := range []Kind{KIND_ASSET, KIND_INFO, KIND_RESOURCE} {
+		os.Remove(t.fs.generateFilename(t.ns, k, t.uuidAndHash))
+	}
+
+	t.fs.addUsage(t.ns, -t.fs.index.remove(t.ns, t.uuidAndHash))
+}
+
 func (t *FSTx) Commit() error {
+	if err := t.commit(); err != nil {
+		return err
+	}
+
+	// Until the index is loaded, loading it collects garbage
+	select {
+	case <-t.fs.scanned:
+		t.fs.collectGarbage()
+	default:
+	}
+
+	return nil
+}
+
+// Compare with and move the uploaded files into place. Holds the entry's
+// lock throughout, so concurrent commits of it and GC are done one by one.
+func (t *FSTx) commit() error {
+	lock := t.fs.keyLock(t.ns, t.uuidAndHash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	policy := t.fs.mismatchPolicy()
+	mismatch, err := t.mismatches(policy)
+	if err != nil {
+		t.Abort()
+		return err
+	}
+	if mismatch {
+		switch policy {
+		case MISMATCH_KEEP_FIRST:
+			return t.Abort()
+		case MISMATCH_REJECT:
+			t.Abort()
+			t.removeStored()
+			return ErrMismatch
+		}
+	}
+
 	for _, k := range t.kinds {
 		from := t.fs.generateFilename(t.ns, k, t.uuidAndHash) + t.nsSuffix
 		to := t.fs.generateFilename(t.ns, k, t.uuidAndHash)
@@ -248,13 +586,9 @@ func (t *FSTx) Commit() error {
 		}
 	}
 
-	t.fs.lock.Lock()
-	t.fs.Size += t.size
-	t.fs.lock.Unlock()
-	t.fs.collectGarbage()
-
-	fs_size.WithLabelValues(t.ns).Add(float64(t.size))
-
+	now := time.Now()
+	t.fs.addUsage(t.ns, t.fs.index.put(t.ns, t.uuidAndHash, t.sizes, now))
+	t.fs.access.touch(t.fs.Name, t.ns, now)
 	return nil
 }
 
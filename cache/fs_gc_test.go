@@ -2,20 +2,16 @@ package cache
 
 import (
 	"bytes"
-	//"reflect"
-	//"time"
 	"math/rand"
-	"os"
 	"testing"
 )
 
-func TestFSFindApproximateOldFiles(t *testing.T) {
-	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = "./testdata/gc-test/" })
+func TestFSScanEntries(t *testing.T) {
+	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = t.TempDir() })
 	if err != nil {
 		t.Fatalf("Error creating FS: %s", err)
 	}
-	os.RemoveAll(f.Basepath) // Make sure we start empty
-	defer func() { os.RemoveAll(f.Basepath) }()
+	defer f.Close()
 
 	// Insert three keys, uuid.asset, uuid.info and uuid.resource
 	key := make([]byte, 32)
@@ -31,33 +27,28 @@ func TestFSFindApproximateOldFiles(t *testing.T) {
 	}
 	tx.Commit()
 
-	// Do a single scan and confirm the numbers are right
-	size, entries, err := findApproximateOldFiles(f.Basepath)
+	// Leftovers of a transaction aren't entries
+	tx = f.PutTransaction("list-old-files", make([]byte, 32))
+	tx.Put(1, KIND_ASSET, bytes.NewReader([]byte{1}))
 
+	// Do a single scan and confirm the numbers are right
+	entries, err := scanFSEntries(f.Basepath)
 	if err != nil {
-		t.Errorf("Unexpected error calling findApproximateOldFiles(): %s", err)
-	}
-
-	if size != 3 {
-		t.Errorf("Expected cache size to be 3, got %d", size)
+		t.Errorf("Unexpected error calling scanFSEntries(): %s", err)
 	}
 
 	if len(entries) != 1 {
 		t.Fatalf("Expected one entry, got %d", len(entries))
 	}
 
-	expected := fsCacheEntry{
-		ns:          "list-old-files",
-		uuidAndHash: key,
-		size:        3,
-		//time: time.Now(), // TODO: Grab from FS?
+	e, ok := entries[fsIndexKey("list-old-files", key)]
+	if !ok {
+		t.Fatalf("Expected entry for the key, got %+v", entries)
 	}
-
-	if entries[0].ns != expected.ns {
-		t.Errorf("Expected entry ns to be %s, got %s", expected.ns, entries[0].ns)
+	if e.size != 3 || len(e.sizes) != 3 {
+		t.Errorf("Expected entry to have three kinds of 3 bytes in all, got %+v", e)
 	}
-
-	if !bytes.Equal(entries[0].uuidAndHash, expected.uuidAndHash) {
-		t.Errorf("Expected entry UUID+Hash to be\n\t%s\ngot\n\t%s", expected.uuidAndHash, entries[0].uuidAndHash)
+	if e.lastAccess.IsZero() {
+		t.Errorf("Expected entry to have a last access time")
 	}
 }
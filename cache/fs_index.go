@@ -0,0 +1,706 @@
+package cache
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the index file in the FS cache's directory. Namespace names can't
+// start with a dot, so no namespace directory is named like it.
+const fsIndexFilename = ".index"
+
+// First line of index files, changed whenever the format is
+const fsIndexHeader = "ucs-fs-index 1"
+
+// Index records are lines of tab-separated fields: what happened, the
+// namespace (quoted) and usually the uuid/hash (hex), ending with a CRC-32 of
+// the rest of the line.
+const (
+	// An entry committed, with its kinds and sizes (ex. "a:1234,i:56") and
+	// time in nanoseconds
+	fsIndexPut = "+"
+
+	// An entry read, with the time
+	fsIndexAccess = "@"
+
+	// An entry deleted
+	fsIndexDelete = "-"
+
+	// A namespace deleted; just the namespace
+	fsIndexDeleteNamespace = "!"
+)
+
+// The index is rewritten from scratch once it has this many more records
+// than entries
+const fsIndexSlack = 10000
+
+// Records of reads are flushed to the journal at least this often. Other
+// records are flushed right away.
+const fsIndexFlushInterval = time.Second
+
+// An entry in the FS cache: all kinds stored for a uuid/hash
+type fsIndexEntry struct {
+	ns          string
+	uuidAndHash []byte
+	sizes       map[Kind]int64
+	size        int64
+	lastAccess  time.Time
+
+	// Place in its namespace's LRU list
+	elem *list.Element
+}
+
+// fsIndex keeps track of every entry in an FS cache, in order of last access,
+// and persists them to a journal in the cache directory. That way starting
+// up doesn't need a scan of the whole cache, sizes are exact and the least
+// recently used entries can be evicted first.
+//
+// The journal is appended to on every change, and rewritten in the
+// background when it grows too long. A missing or corrupt journal is rebuilt
+// from the directory tree.
+type fsIndex struct {
+	lock    sync.Mutex
+	path    string
+	entries map[string]*fsIndexEntry
+
+	// Entries of each namespace, least recently used first
+	lrus map[string]*list.List
+
+	// Until loaded, changes are only kept in memory, and removals are
+	// remembered so the journal or scan being loaded doesn't bring entries
+	// back
+	loaded            bool
+	removedKeys       map[string]bool
+	removedNamespaces map[string]bool
+
+	// Once closed, the journal is no longer written to
+	closed  bool
+	journal *os.File
+	buffer  *bufio.Writer
+	flushed time.Time
+	records int
+
+	// While the journal is being rewritten, records written are also kept
+	// to be appended to the new one
+	compacting  bool
+	pending     []string
+	compactions sync.WaitGroup
+}
+
+func newFSIndex(basepath string) *fsIndex {
+	return &fsIndex{
+		path:              filepath.Join(basepath, fsIndexFilename),
+		entries:           make(map[string]*fsIndexEntry),
+		lrus:              make(map[string]*list.List),
+		removedKeys:       make(map[string]bool),
+		removedNamespaces: make(map[string]bool),
+	}
+}
+
+// The uuid/hash is of fixed length, so no separator is needed
+func fsIndexKey(ns string, uuidAndHash []byte) string {
+	return ns + string(uuidAndHash)
+}
+
+// Record kinds of an entry as committed, returning by how many bytes the
+// entry grew
+func (ix *fsIndex) put(ns string, uuidAndHash []byte, sizes map[Kind]int64, t time.Time) int64 {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	key := fsIndexKey(ns, uuidAndHash)
+	e, ok := ix.entries[key]
+	if !ok {
+		e = &fsIndexEntry{
+			ns:          ns,
+			uuidAndHash: append([]byte{}, uuidAndHash...),
+			sizes:       make(map[Kind]int64, len(sizes)),
+		}
+		ix.push(e)
+		ix.entries[key] = e
+	}
+
+	before := e.size
+	for kind, size := range sizes {
+		e.size += size - e.sizes[kind]
+		e.sizes[kind] = size
+	}
+	ix.accessed(e, t)
+	ix.write(fsIndexPut, strconv.Quote(ns), hex.EncodeToString(uuidAndHash), formatKindSizes(e.sizes), strconv.FormatInt(t.UnixNano(), 10))
+	ix.flush()
+
+	return e.size - before
+}
+
+// Add an entry to the back of its namespace's LRU list. Must be called with
+// the lock held.
+func (ix *fsIndex) push(e *fsIndexEntry) {
+	lru, ok := ix.lrus[e.ns]
+	if !ok {
+		lru = list.New()
+		ix.lrus[e.ns] = lru
+	}
+	e.elem = lru.PushBack(e)
+}
+
+// Record an entry as read
+func (ix *fsIndex) touch(ns string, uuidAndHash []byte, t time.Time) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	e, ok := ix.entries[fsIndexKey(ns, uuidAndHash)]
+	if !ok {
+		return
+	}
+	ix.accessed(e, t)
+	ix.write(fsIndexAccess, strconv.Quote(ns), hex.EncodeToString(uuidAndHash), strconv.FormatInt(t.UnixNano(), 10))
+}
+
+// Must be called with the lock held
+func (ix *fsIndex) accessed(e *fsIndexEntry, t time.Time) {
+	if t.After(e.lastAccess) {
+		e.lastAccess = t
+	}
+	ix.lrus[e.ns].MoveToBack(e.elem)
+}
+
+// Forget an entry, returning its size
+func (ix *fsIndex) remove(ns string, uuidAndHash []byte) int64 {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	key := fsIndexKey(ns, uuidAndHash)
+	if !ix.loaded {
+		ix.removedKeys[key] = true
+	}
+	e, ok := ix.entries[key]
+	if !ok {
+		return 0
+	}
+	ix.drop(key, e)
+	ix.write(fsIndexDelete, strconv.Quote(ns), hex.EncodeToString(uuidAndHash))
+	ix.flush()
+	return e.size
+}
+
+// Must be called with the lock held
+func (ix *fsIndex) drop(key string, e *fsIndexEntry) {
+	lru := ix.lrus[e.ns]
+	lru.Remove(e.elem)
+	if lru.Len() == 0 {
+		delete(ix.lrus, e.ns)
+	}
+	delete(ix.entries, key)
+}
+
+// Forget all entries of a namespace
+func (ix *fsIndex) removeNamespace(ns string) {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	if !ix.loaded {
+		ix.removedNamespaces[ns] = true
+	}
+	if lru, ok := ix.lrus[ns]; ok {
+		for elem := lru.Front(); elem != nil; elem = elem.Next() {
+			e := elem.Value.(*fsIndexEntry)
+			delete(ix.entries, fsIndexKey(e.ns, e.uuidAndHash))
+		}
+		delete(ix.lrus, ns)
+	}
+	ix.write(fsIndexDeleteNamespace, strconv.Quote(ns))
+	ix.flush()
+}
+
+// The least recently used entry that may be evicted and when it was last
+// used, or nil if none may. Only each namespace's least recently used entry
+// is considered, so namespaces kept by their minimum are skipped as a whole.
+func (ix *fsIndex) oldest(evictable func(ns string, size int64) bool) (*fsIndexEntry, time.Time) {
+	type candidate struct {
+		e          *fsIndexEntry
+		size       int64
+		lastAccess time.Time
+	}
+	ix.lock.Lock()
+	candidates := make([]candidate, 0, len(ix.lrus))
+	for _, lru := range ix.lrus {
+		e := lru.Front().Value.(*fsIndexEntry)
+		candidates = append(candidates, candidate{e, e.size, e.lastAccess})
+	}
+	ix.lock.Unlock()
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastAccess.Before(candidates[j].lastAccess) })
+	for _, c := range candidates {
+		if evictable(c.e.ns, c.size) {
+			return c.e, c.lastAccess
+		}
+	}
+	return nil, time.Time{}
+}
+
+// Forget an entry picked by oldest(), unless it has been used or removed
+// since. Returns whether it was forgotten.
+func (ix *fsIndex) evict(e *fsIndexEntry, lastAccess time.Time) bool {
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	key := fsIndexKey(e.ns, e.uuidAndHash)
+	if ix.entries[key] != e || !e.lastAccess.Equal(lastAccess) {
+		return false
+	}
+	ix.drop(key, e)
+	ix.write(fsIndexDelete, strconv.Quote(e.ns), hex.EncodeToString(e.uuidAndHash))
+	ix.flush()
+	return true
+}
+
+// Append a record to the journal's buffer, flushing it if it's been a while.
+// Must be called with the lock held.
+func (ix *fsIndex) write(fields ...string) {
+	record := fsIndexRecord(fields...)
+	if ix.compacting {
+		ix.pending = append(ix.pending, record)
+	}
+	if ix.buffer == nil {
+		return
+	}
+	if _, err := ix.buffer.WriteString(record); err != nil {
+		ix.fail(err)
+		return
+	}
+	if time.Now().Sub(ix.flushed) > fsIndexFlushInterval {
+		ix.flush()
+	}
+
+	ix.records += 1
+	if ix.records > len(ix.entries)+fsIndexSlack && !ix.compacting && !ix.closed {
+		records := ix.startCompaction()
+		ix.compactions.Add(1)
+		go func() {
+			defer ix.compactions.Done()
+			if err := ix.compact(records); err != nil {
+				ix.lock.Lock()
+				ix.fail(err)
+				ix.lock.Unlock()
+			}
+		}()
+	}
+}
+
+// Write out the journal's buffer. Must be called with the lock held.
+func (ix *fsIndex) flush() {
+	if ix.buffer == nil {
+		return
+	}
+	if err := ix.buffer.Flush(); err != nil {
+		ix.fail(err)
+		return
+	}
+	ix.flushed = time.Now()
+}
+
+// Give up on the journal until restarted, removing it so it's rebuilt then,
+// rather than trusted. Must be called with the lock held.
+func (ix *fsIndex) fail(err error) {
+	fmt.Printf("Error writing FS index, it will be rebuilt on restart: %s\n", err)
+	if ix.journal != nil {
+		ix.journal.Close()
+		ix.journal = nil
+		ix.buffer = nil
+	}
+	os.Remove(ix.path)
+}
+
+// Start rewriting the journal, returning records of the current entries to
+// pass to compact(). Must be called with the lock held.
+func (ix *fsIndex) startCompaction() []string {
+	ix.compacting = true
+	ix.pending = nil
+
+	records := make([]string, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		records = append(records, fsIndexRecord(fsIndexPut, strconv.Quote(e.ns), hex.EncodeToString(e.uuidAndHash), formatKindSizes(e.sizes), strconv.FormatInt(e.lastAccess.UnixNano(), 10)))
+	}
+	return records
+}
+
+// Write a new journal of the given records without holding the lock, then
+// add what was written meanwhile and replace the journal with it
+func (ix *fsIndex) compact(records []string) error {
+	tmp := ix.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		ix.lock.Lock()
+		ix.compacting = false
+		ix.pending = nil
+		ix.lock.Unlock()
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	w.WriteString(fsIndexHeader + "\n")
+	for _, record := range records {
+		w.WriteString(record)
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+
+	pending := ix.pending
+	ix.compacting = false
+	ix.pending = nil
+	if ix.closed {
+		f.Close()
+		os.Remove(tmp)
+		return nil
+	}
+
+	if err == nil {
+		for _, record := range pending {
+			w.WriteString(record)
+		}
+		err = w.Flush()
+	}
+	if err == nil {
+		err = os.Rename(tmp, ix.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if ix.journal != nil {
+		ix.journal.Close()
+	}
+	ix.journal = f
+	ix.buffer = w
+	ix.flushed = time.Now()
+	ix.records = len(pending)
+	return nil
+}
+
+// Stop journaling, leaving the journal as it is
+func (ix *fsIndex) close() error {
+	ix.lock.Lock()
+	ix.closed = true
+	ix.lock.Unlock()
+	ix.compactions.Wait()
+
+	ix.lock.Lock()
+	defer ix.lock.Unlock()
+	if ix.journal == nil {
+		return nil
+	}
+	err := ix.buffer.Flush()
+	if closeErr := ix.journal.Close(); err == nil {
+		err = closeErr
+	}
+	ix.journal = nil
+	ix.buffer = nil
+	return err
+}
+
+// Read the journal, or scan the cache directory if it's missing or corrupt,
+// and start journaling. Changes made meanwhile are kept. Returns the size
+// and last access of what was found in each namespace, on top of those
+// changes, and why the index was rebuilt, if it was.
+func (ix *fsIndex) load(basepath string) (added map[string]fsNamespaceStats, rebuilt error) {
+	found, err := readFSIndex(ix.path)
+	if err != nil {
+		rebuilt = err
+		found, err = scanFSEntries(basepath)
+		if err != nil {
+			fmt.Printf("Error scanning FS cache: %s\n", err)
+		}
+	}
+
+	ix.lock.Lock()
+
+	added = map[string]fsNamespaceStats{}
+	for key, e := range found {
+		if ix.removedKeys[key] || ix.removedNamespaces[e.ns] {
+			continue
+		}
+		stats := added[e.ns]
+		if e.lastAccess.After(stats.lastAccess) {
+			stats.lastAccess = e.lastAccess
+		}
+
+		current, ok := ix.entries[key]
+		if !ok {
+			ix.entries[key] = e
+			stats.size += e.size
+			added[e.ns] = stats
+			continue
+		}
+
+		// Kinds committed meanwhile replace those found, the rest are kept
+		for kind, size := range e.sizes {
+			if _, ok := current.sizes[kind]; !ok {
+				current.sizes[kind] = size
+				current.size += size
+				stats.size += size
+			}
+		}
+		if e.lastAccess.After(current.lastAccess) {
+			current.lastAccess = e.lastAccess
+		}
+		added[e.ns] = stats
+	}
+	ix.loaded = true
+	ix.removedKeys = nil
+	ix.removedNamespaces = nil
+
+	// Order everything by last access
+	all := make([]*fsIndexEntry, 0, len(ix.entries))
+	for _, e := range ix.entries {
+		all = append(all, e)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].lastAccess.Before(all[j].lastAccess) })
+	ix.lrus = make(map[string]*list.List)
+	for _, e := range all {
+		ix.push(e)
+	}
+
+	records := ix.startCompaction()
+	ix.lock.Unlock()
+	if err := ix.compact(records); err != nil {
+		ix.lock.Lock()
+		ix.fail(err)
+		ix.lock.Unlock()
+	}
+	return added, rebuilt
+}
+
+func fsIndexRecord(fields ...string) string {
+	line := strings.Join(fields, "\t")
+	return fmt.Sprintf("%s\t%08x\n", line, crc32.ChecksumIEEE([]byte(line)))
+}
+
+func formatKindSizes(sizes map[Kind]int64) string {
+	parts := make([]string, 0, len(sizes))
+	for _, kind := range []Kind{KIND_ASSET, KIND_INFO, KIND_RESOURCE} {
+		if size, ok := sizes[kind]; ok {
+			parts = append(parts, fmt.Sprintf("%c:%d", kind, size))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func parseKindSizes(s string) (map[Kind]int64, int64, error) {
+	sizes := map[Kind]int64{}
+	var total int64
+	for _, part := range strings.Split(s, ",") {
+		if len(part) < 3 || part[1] != ':' {
+			return nil, 0, fmt.Errorf("Invalid kind and size '%s'", part)
+		}
+		size, err := strconv.ParseInt(part[2:], 10, 64)
+		if err != nil {
+			return nil, 0, err
+		}
+		sizes[Kind(part[0])] = size
+		total += size
+	}
+	return sizes, total, nil
+}
+
+// Read the entries in an index file. Any damage is an error, except for a
+// last line cut short by a crash while appending it.
+func readFSIndex(path string) (map[string]*fsIndexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header, err := r.ReadString('\n')
+	if err != nil || header != fsIndexHeader+"\n" {
+		return nil, fmt.Errorf("%s: Not an index, or of another version", path)
+	}
+
+	entries := map[string]*fsIndexEntry{}
+	for lineNo := 2; ; lineNo++ {
+		line, err := r.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := applyFSIndexRecord(entries, strings.TrimSuffix(line, "\n")); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+}
+
+func applyFSIndexRecord(entries map[string]*fsIndexEntry, line string) error {
+	i := strings.LastIndexByte(line, '\t')
+	if i < 0 {
+		return fmt.Errorf("No checksum")
+	}
+	if fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(line[:i]))) != line[i+1:] {
+		return fmt.Errorf("Checksum mismatch")
+	}
+
+	fields := strings.Split(line[:i], "\t")
+	if len(fields) < 2 {
+		return fmt.Errorf("Too few fields")
+	}
+	ns, err := strconv.Unquote(fields[1])
+	if err != nil {
+		return err
+	}
+
+	op := fields[0]
+	if op == fsIndexDeleteNamespace {
+		for key, e := range entries {
+			if e.ns == ns {
+				delete(entries, key)
+			}
+		}
+		return nil
+	}
+
+	if len(fields) < 3 {
+		return fmt.Errorf("Too few fields")
+	}
+	uuidAndHash, err := hex.DecodeString(fields[2])
+	if err != nil || len(uuidAndHash) != 32 {
+		return fmt.Errorf("Invalid uuid/hash '%s'", fields[2])
+	}
+	key := fsIndexKey(ns, uuidAndHash)
+
+	switch {
+	case op == fsIndexPut && len(fields) == 5:
+		sizes, total, err := parseKindSizes(fields[3])
+		if err != nil {
+			return err
+		}
+		t, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return err
+		}
+		entries[key] = &fsIndexEntry{
+			ns:          ns,
+			uuidAndHash: uuidAndHash,
+			sizes:       sizes,
+			size:        total,
+			lastAccess:  time.Unix(0, t),
+		}
+	case op == fsIndexAccess && len(fields) == 4:
+		t, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return err
+		}
+		if e, ok := entries[key]; ok {
+			e.lastAccess = time.Unix(0, t)
+		}
+	case op == fsIndexDelete && len(fields) == 3:
+		delete(entries, key)
+	default:
+		return fmt.Errorf("Invalid record '%s'", op)
+	}
+	return nil
+}
+
+// Find all entries in the cache directory, as the index would have them
+func scanFSEntries(basepath string) (map[string]*fsIndexEntry, error) {
+	entries := map[string]*fsIndexEntry{}
+
+	namespaces, err := ioutil.ReadDir(basepath)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return entries, err
+	}
+
+	// Namespaces are scanned in parallel, each into their own map
+	found := make([]map[string]*fsIndexEntry, len(namespaces))
+	allDone := sync.WaitGroup{}
+	for i, dir := range namespaces {
+		if !dir.IsDir() {
+			continue
+		}
+		allDone.Add(1)
+		go func(i int, dirname string) {
+			defer allDone.Done()
+			found[i] = scanFSNamespace(filepath.Join(basepath, dirname), dirNamespace(dirname))
+		}(i, dir.Name())
+	}
+	allDone.Wait()
+
+	for _, nsEntries := range found {
+		for key, e := range nsEntries {
+			entries[key] = e
+		}
+	}
+	return entries, nil
+}
+
+func scanFSNamespace(dirname, ns string) map[string]*fsIndexEntry {
+	entries := map[string]*fsIndexEntry{}
+
+	// There be 256 folders
+	for i := 0; i < 256; i += 1 {
+		files, err := ioutil.ReadDir(filepath.Join(dirname, fmt.Sprintf("%02x", i)))
+		if err != nil {
+			continue
+		}
+
+		for _, file := range files {
+			kind, ok := filenameKind(file.Name())
+			if file.IsDir() || !ok {
+				continue
+			}
+			uuidAndHash, err := parseFilename(file.Name())
+			if err != nil {
+				continue
+			}
+
+			key := fsIndexKey(ns, uuidAndHash)
+			e, ok := entries[key]
+			if !ok {
+				e = &fsIndexEntry{ns: ns, uuidAndHash: uuidAndHash, sizes: map[Kind]int64{}}
+				entries[key] = e
+			}
+			e.sizes[kind] = file.Size()
+			e.size += file.Size()
+			if t := fileinfo_atime(file); t.After(e.lastAccess) {
+				e.lastAccess = t
+			}
+		}
+	}
+	return entries
+}
+
+// The kind stored in a file named by FS.generateFilename(). Transactions'
+// temporary files aren't entries.
+func filenameKind(filename string) (Kind, bool) {
+	switch filepath.Ext(filename) {
+	case ".bin":
+		return KIND_ASSET, true
+	case ".info":
+		return KIND_INFO, true
+	case ".resource":
+		return KIND_RESOURCE, true
+	}
+	return 0, false
+}
@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFSIndex(t *testing.T) {
+	basepath := t.TempDir()
+
+	open := func() *FS {
+		f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = basepath })
+		if err != nil {
+			t.Fatalf("Error creating FS: %s", err)
+		}
+		f.WaitForScan()
+		return f
+	}
+	keys := make([][]byte, 4)
+	for i := range keys {
+		keys[i] = make([]byte, 32)
+		keys[i][0] = byte(i)
+	}
+
+	f := open()
+	for i, key := range keys {
+		tx := f.PutTransaction("ns", key)
+		tx.Put(10, KIND_ASSET, bytes.NewReader(make([]byte, 10)))
+		tx.Put(5, KIND_INFO, bytes.NewReader(make([]byte, 5)))
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected error calling Commit() on %d: %s", i, err)
+		}
+	}
+
+	// Re-uploading some kinds doesn't count the entry twice
+	tx := f.PutTransaction("ns", keys[3])
+	tx.Put(5, KIND_INFO, bytes.NewReader(make([]byte, 5)))
+	tx.Commit()
+	if f.Usage() != 60 {
+		t.Errorf("Expected 60 bytes used, got %d", f.Usage())
+	}
+
+	// Reading the oldest entry keeps it from being evicted first
+	testCacheHit(t, f, "ns", KIND_ASSET, keys[0], make([]byte, 10))
+
+	// The index is read back as it was left
+	f.Close()
+	f = open()
+	if f.Usage() != 60 {
+		t.Errorf("Expected 60 bytes used after reopening, got %d", f.Usage())
+	}
+
+	f.lock.Lock()
+	f.Quota = 45
+	f.lock.Unlock()
+	f.collectGarbage()
+	if f.Usage() != 45 {
+		t.Errorf("Expected 45 bytes used after GC, got %d", f.Usage())
+	}
+	if found, _, _ := readFromCache(f, "ns", KIND_ASSET, keys[1]); found {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	testCacheHit(t, f, "ns", KIND_ASSET, keys[0], make([]byte, 10))
+
+	// Corrupt indexes are rebuilt from the files
+	path := filepath.Join(basepath, fsIndexFilename)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading index: %s", err)
+	}
+	data[len(fsIndexHeader)+3] ^= 1
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("Unexpected error writing index: %s", err)
+	}
+	if _, err := readFSIndex(path); err == nil {
+		t.Errorf("Expected error reading corrupt index")
+	}
+
+	f.Close()
+	f = open()
+	defer f.Close()
+	if f.Usage() != 45 {
+		t.Errorf("Expected 45 bytes used after rebuilding, got %d", f.Usage())
+	}
+	if _, err := readFSIndex(path); err != nil {
+		t.Errorf("Expected rebuilt index to be written, got %s", err)
+	}
+}
+
+func TestFSEvictRecommitted(t *testing.T) {
+	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = t.TempDir() })
+	if err != nil {
+		t.Fatalf("Error creating FS: %s", err)
+	}
+	defer f.Close()
+	f.WaitForScan()
+
+	key := make([]byte, 32)
+	put := func(data string) {
+		tx := f.PutTransaction("ns", key)
+		tx.Put(int64(len(data)), KIND_ASSET, bytes.NewReader([]byte(data)))
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected error calling Commit(): %s", err)
+		}
+	}
+
+	// An entry committed again after GC picked it is left alone
+	put("old")
+	e, lastAccess := f.index.oldest(func(string, int64) bool { return true })
+	time.Sleep(time.Millisecond)
+	put("new")
+	f.evict(e, lastAccess)
+	testCacheHit(t, f, "ns", KIND_ASSET, key, []byte("new"))
+	if f.Usage() != 3 {
+		t.Errorf("Expected 3 bytes used, got %d", f.Usage())
+	}
+}
+
+func TestFSIndexLoadMerges(t *testing.T) {
+	basepath := t.TempDir()
+	key := make([]byte, 32)
+	before := time.Now().Add(-time.Hour)
+
+	ix := newFSIndex(basepath)
+	ix.load(basepath)
+	ix.put("ns", key, map[Kind]int64{KIND_ASSET: 10, KIND_INFO: 5}, before)
+	ix.close()
+
+	// Re-uploading some kinds before loading keeps the others
+	ix = newFSIndex(basepath)
+	ix.put("ns", key, map[Kind]int64{KIND_INFO: 6}, time.Now())
+	added, err := ix.load(basepath)
+	if err != nil {
+		t.Fatalf("Unexpected error loading index: %s", err)
+	}
+	defer ix.close()
+
+	// Only what wasn't counted when committing is added
+	if added["ns"].size != 10 {
+		t.Errorf("Expected 10 bytes to be added, got %d", added["ns"].size)
+	}
+
+	e := ix.entries[fsIndexKey("ns", key)]
+	if e.size != 16 || e.sizes[KIND_ASSET] != 10 || e.sizes[KIND_INFO] != 6 {
+		t.Errorf("Expected asset of 10 and info of 6 bytes, got %v", e.sizes)
+	}
+	if !e.lastAccess.After(before) {
+		t.Errorf("Expected last access after %s, got %s", before, e.lastAccess)
+	}
+}
+
+func TestFSIndexTornRecord(t *testing.T) {
+	key := make([]byte, 32)
+	ix := newFSIndex(t.TempDir())
+	path := ix.path
+	ix.loaded = true
+	if err := ix.compact(ix.startCompaction()); err != nil {
+		t.Fatalf("Unexpected error writing index: %s", err)
+	}
+	ix.put("ns", key, map[Kind]int64{KIND_ASSET: 3}, time.Now())
+	ix.journal.WriteString("-\t\"ns\"\t00")
+	ix.journal.Close()
+
+	// A crash while appending leaves the last record unfinished
+	entries, err := readFSIndex(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading index: %s", err)
+	}
+	if e, ok := entries[fsIndexKey("ns", key)]; !ok || e.size != 3 {
+		t.Errorf("Expected entry of 3 bytes, got %+v", entries)
+	}
+}
+
+func TestFSIndexCompactKeepsConcurrentWrites(t *testing.T) {
+	ix := newFSIndex(t.TempDir())
+	ix.loaded = true
+	if err := ix.compact(ix.startCompaction()); err != nil {
+		t.Fatalf("Unexpected error writing index: %s", err)
+	}
+	defer ix.close()
+
+	keys := [][]byte{make([]byte, 32), make([]byte, 32)}
+	keys[1][0] = 1
+	ix.put("ns", keys[0], map[Kind]int64{KIND_ASSET: 3}, time.Now())
+
+	// Records written while the new journal is being written end up in it
+	ix.lock.Lock()
+	records := ix.startCompaction()
+	ix.lock.Unlock()
+	ix.put("ns", keys[1], map[Kind]int64{KIND_ASSET: 4}, time.Now())
+	if err := ix.compact(records); err != nil {
+		t.Fatalf("Unexpected error compacting index: %s", err)
+	}
+
+	entries, err := readFSIndex(ix.path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading index: %s", err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %+v", entries)
+	}
+}
+
+func TestFSSweepsTransactions(t *testing.T) {
+	basepath := t.TempDir()
+	dir := filepath.Join(basepath, "ns", "00")
+	os.MkdirAll(dir, os.ModePerm)
+	stale := filepath.Join(dir, "stale.bin.tx-0000000001")
+	fresh := filepath.Join(dir, "fresh.bin.tx-0000000002")
+	ioutil.WriteFile(stale, []byte("stale"), 0644)
+	ioutil.WriteFile(fresh, []byte("fresh"), 0644)
+	old := time.Now().Add(-2 * fsStaleTransactionAge)
+	os.Chtimes(stale, old, old)
+
+	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = basepath })
+	if err != nil {
+		t.Fatalf("Error creating FS: %s", err)
+	}
+	f.Close()
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("Expected stale transaction file to be removed, got %v", err)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Errorf("Expected recent transaction file to be kept, got %v", err)
+	}
+}
@@ -4,15 +4,17 @@ import (
 	"bytes"
 	"io/ioutil"
 	"math/rand"
-	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestFSGenerateFilename(t *testing.T) {
-	fs, err := NewFS()
+	fs, err := NewFS(func(f *FS) { f.Basepath = filepath.Join(t.TempDir(), "unity-cache") })
 	if err != nil {
 		t.Fatalf("Could not create FS: %s", err)
 	}
+	defer fs.Close()
 	key := make([]byte, 32)
 	for i := range key {
 		key[i] = byte(i % 256)
@@ -41,14 +43,11 @@ func TestFSGenerateFilename(t *testing.T) {
 }
 
 func TestFSReader(t *testing.T) {
-	c, err := NewFS(func(f *FS) { f.Basepath = "./testdata/test-fs-reader/"; f.Quota = 100 })
+	c, err := NewFS(func(f *FS) { f.Basepath = t.TempDir(); f.Quota = 100 })
 	if err != nil {
 		t.Fatalf("Error creating FS: %s", err)
 	}
-
-	defer func() {
-		os.RemoveAll(c.Basepath)
-	}()
+	defer c.Close()
 
 	key := make([]byte, 32)
 	rand.Read(key)
@@ -97,14 +96,11 @@ func TestFSReader(t *testing.T) {
 }
 
 func TestFSQuota(t *testing.T) {
-	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = "./testdata/fs-quota/" })
+	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = t.TempDir() })
 	if err != nil {
 		t.Fatalf("Error creating FS: %s", err)
 	}
-	os.RemoveAll(f.Basepath)
-	defer func() {
-		os.RemoveAll(f.Basepath)
-	}()
+	defer f.Close()
 
 	// Insert 100 two-byte keys and check the size never gets above 100 bytes.
 	for i := 0; i < 100; i++ {
@@ -146,3 +142,98 @@ func TestFSQuota(t *testing.T) {
 		t.Errorf("Expected to get %d-byte key back, got %db", len(data), size)
 	}
 }
+
+func TestFSNamespaceQuotas(t *testing.T) {
+	f, err := NewFS(func(f *FS) { f.Quota = 100; f.Basepath = t.TempDir() })
+	if err != nil {
+		t.Fatalf("Error creating FS: %s", err)
+	}
+	defer f.Close()
+	f.WaitForScan()
+	f.SetNamespaceQuota("quiet", NamespaceQuota{Min: 30})
+	f.SetNamespaceQuota("capped", NamespaceQuota{Max: 20})
+
+	put := func(ns string, count int) {
+		for i := 0; i < count; i++ {
+			key := make([]byte, 32)
+			rand.Read(key)
+
+			tx := f.PutTransaction(ns, key)
+			if err := tx.Put(2, KIND_INFO, bytes.NewReader([]byte{byte(i), byte(i)})); err != nil {
+				t.Fatalf("Unexpected error calling Put(): %s", err)
+			}
+			tx.Commit()
+		}
+	}
+
+	// The quiet namespace's entries are the oldest, but kept by its minimum
+	put("quiet", 15)
+	put("busy", 100)
+	put("capped", 30)
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.Size > f.Quota {
+		t.Errorf("Expected cache size to be at most %d, got %d", f.Quota, f.Size)
+	}
+	if f.usage["quiet"] != 30 {
+		t.Errorf("Expected quiet namespace to keep 30 bytes, has %d", f.usage["quiet"])
+	}
+	if f.usage["capped"] > 20 {
+		t.Errorf("Expected capped namespace to have at most 20 bytes, has %d", f.usage["capped"])
+	}
+}
+
+func TestFSRetireNamespace(t *testing.T) {
+	f, err := NewFS(func(f *FS) { f.Quota = 1000; f.Basepath = t.TempDir() })
+	if err != nil {
+		t.Fatalf("Error creating FS: %s", err)
+	}
+	defer f.Close()
+	archive := t.TempDir()
+	f.WaitForScan()
+
+	before := time.Now().Add(-time.Second)
+	key := make([]byte, 32)
+	for _, ns := range []string{"old", "older", "current"} {
+		tx := f.PutTransaction(ns, key)
+		if err := tx.Put(4, KIND_ASSET, bytes.NewReader([]byte("data"))); err != nil {
+			t.Fatalf("Unexpected error calling Put(): %s", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected error calling Commit(): %s", err)
+		}
+	}
+
+	usage := f.Namespaces()
+	if len(usage) != 3 {
+		t.Fatalf("Expected 3 namespaces, got %+v", usage)
+	}
+	for _, u := range usage {
+		if u.Size != 4 || u.LastAccess.Before(before) {
+			t.Errorf("Expected %s to have 4 bytes and be used just now, got %+v", u.Namespace, u)
+		}
+	}
+
+	if err := f.RetireNamespace("old", ""); err != nil {
+		t.Fatalf("Unexpected error retiring namespace: %s", err)
+	}
+	if err := f.RetireNamespace("older", archive); err != nil {
+		t.Fatalf("Unexpected error archiving namespace: %s", err)
+	}
+
+	if found, _, _ := readFromCache(f, "old", KIND_ASSET, key); found {
+		t.Errorf("Expected retired namespace to be gone")
+	}
+	if found, _, _ := readFromCache(f, "older", KIND_ASSET, key); found {
+		t.Errorf("Expected archived namespace to be gone")
+	}
+	testCacheHit(t, f, "current", KIND_ASSET, key, []byte("data"))
+	if f.Usage() != 4 {
+		t.Errorf("Expected 4 bytes left, got %d", f.Usage())
+	}
+	archived, _ := filepath.Glob(filepath.Join(archive, "older-*", "00", "*.bin"))
+	if len(archived) != 1 {
+		t.Errorf("Expected archived entry, found %v", archived)
+	}
+}
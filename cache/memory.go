@@ -2,8 +2,10 @@ package cache
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"log"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -12,22 +14,22 @@ import (
 )
 
 var (
-	memory_gc_duration = prometheus.NewSummary(prometheus.SummaryOpts{
+	memory_gc_duration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
 		Name: "ucs_memorycache_gc_duration_seconds",
 		Help: "Time spent deleting data",
-	})
-	memory_gc_bytes = prometheus.NewCounter(prometheus.CounterOpts{
+	}, []string{"backend"})
+	memory_gc_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "ucs_memorycache_gc_removed_bytes",
 		Help: "Bytes deleted by GC",
-	})
+	}, []string{"backend"})
 	memory_size = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ucs_memorycache_size_bytes",
 		Help: "Size of cache in bytes",
-	}, []string{"namespace"})
-	memory_quota = prometheus.NewGauge(prometheus.GaugeOpts{
+	}, []string{"backend", "namespace"})
+	memory_quota = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "ucs_memorycache_quota_bytes",
-		Help: "Size of quota in bytes",
-	})
+		Help: "Size of quota in bytes, overall (namespace=\"\") and per namespace",
+	}, []string{"backend", "namespace"})
 )
 
 func init() {
@@ -40,6 +42,7 @@ func init() {
 type memoryEntry struct {
 	data       map[Kind][]byte
 	ns         string
+	client     string
 	generation uint64
 	size       int64
 }
@@ -81,48 +84,167 @@ type Memory struct {
 	lock sync.RWMutex
 	data map[string]memoryEntry
 
+	// What to do about re-uploads with different content, and where to
+	// log them
+	MismatchPolicy MismatchPolicy
+	Log            *log.Logger
+
+	// Tells backends apart in metrics
+	Name string
+
 	// Track current size, quota
 	size  int64
 	quota int64
 
+	// Bytes used by and limits for each namespace
+	usage  map[string]int64
+	quotas map[string]NamespaceQuota
+
+	// When each namespace was last used
+	access accessTimes
+
 	// Monotonically increasing counter to track age of objects
 	generation uint64
 }
 
-func NewMemory(quota int64) *Memory {
-	memory_quota.Set(float64(quota))
-	return &Memory{quota: quota, data: make(map[string]memoryEntry)}
+func NewMemory(quota int64, options ...func(*Memory)) *Memory {
+	m := &Memory{
+		quota:  quota,
+		data:   make(map[string]memoryEntry),
+		Log:    log.New(ioutil.Discard, "", 0),
+		usage:  make(map[string]int64),
+		quotas: make(map[string]NamespaceQuota),
+	}
+	for _, f := range options {
+		f(m)
+	}
+	memory_quota.WithLabelValues(m.Name, "").Set(float64(quota))
+	return m
 }
 
-func (m *Memory) collectGarbage(spaceToMake int64) {
+// Current size of the cache in bytes
+func (m *Memory) Usage() int64 {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return m.size
+}
+
+// Change the overall quota, evicting what no longer fits
+func (m *Memory) SetQuota(quota int64) {
+	m.lock.Lock()
+	m.quota = quota
+	m.collectGarbage("", 0)
+	m.lock.Unlock()
+
+	memory_quota.WithLabelValues(m.Name, "").Set(float64(quota))
+}
+
+// Change what's done about re-uploads with different content
+func (m *Memory) SetMismatchPolicy(policy MismatchPolicy) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.MismatchPolicy = policy
+}
+
+// Limit a namespace's share of the cache; see NamespaceQuota
+func (m *Memory) SetNamespaceQuota(ns string, quota NamespaceQuota) {
+	m.lock.Lock()
+	m.quotas[ns] = quota
+	m.lock.Unlock()
+
+	if quota.Max > 0 {
+		memory_quota.WithLabelValues(m.Name, ns).Set(float64(quota.Max))
+	} else {
+		memory_quota.DeleteLabelValues(m.Name, ns)
+	}
+}
+
+// Namespaces stored, with their size and last access; see Retirer
+func (m *Memory) Namespaces() []NamespaceUsage {
+	m.lock.RLock()
+	sizes := make(map[string]int64, len(m.usage))
+	for ns, size := range m.usage {
+		if size > 0 {
+			sizes[ns] = size
+		}
+	}
+	m.lock.RUnlock()
+
+	return namespaceUsage(sizes, &m.access)
+}
+
+// Drop all of a namespace's entries. There's nowhere to archive them to.
+func (m *Memory) RetireNamespace(ns, archive string) error {
+	if archive != "" {
+		return fmt.Errorf("Memory backend can't archive namespace '%s'", ns)
+	}
+
+	m.lock.Lock()
+	for key, entry := range m.data {
+		if entry.ns == ns {
+			m.addUsage(ns, -entry.size)
+			delete(m.data, key)
+		}
+	}
+	delete(m.usage, ns)
+	m.lock.Unlock()
+	memory_size.DeleteLabelValues(m.Name, ns)
+	m.access.forget(m.Name, ns)
+
+	return nil
+}
+
+// Account for bytes added to (or removed from) a namespace. Must be called
+// with the lock held.
+func (m *Memory) addUsage(ns string, size int64) {
+	m.size += size
+	m.usage[ns] += size
+	memory_size.WithLabelValues(m.Name, ns).Add(float64(size))
+}
+
+// Make room for spaceToMake bytes in a namespace. Must be called with the
+// lock held.
+func (m *Memory) collectGarbage(ns string, spaceToMake int64) {
 	start := time.Now()
-	//m.lock.Lock()
-	//defer m.lock.Unlock()
 
-	defer memory_gc_duration.Observe(time.Now().Sub(start).Seconds())
-	// TODO: Make sure we don't get stuck in infinite loops
+	defer func() { memory_gc_duration.WithLabelValues(m.Name).Observe(time.Now().Sub(start).Seconds()) }()
 
-	// Walk all keys and delete the oldest data until we have room...
-	for spaceToMake+m.size > m.quota {
+	// Count the new entry while deciding what to evict
+	m.size += spaceToMake
+	m.usage[ns] += spaceToMake
+	defer func() {
+		m.size -= spaceToMake
+		m.usage[ns] -= spaceToMake
+	}()
+
+	// Walk all keys and delete the oldest data that may be evicted until we
+	// have room...
+	for overQuota(m.quota, m.size, m.quotas, m.usage) {
 		oldestGeneration := m.generation + 1
 		oldestKey := ""
 
 		for key, data := range m.data {
-			if data.generation < oldestGeneration {
+			if data.generation < oldestGeneration && evictable(data.ns, data.size, m.quota, m.size, m.quotas, m.usage) {
 				oldestGeneration = data.generation
 				oldestKey = key
 			}
 		}
+		if oldestGeneration > m.generation {
+			// Everything left is kept by namespace minimums
+			return
+		}
 
 		// Decrement size and remove key
-		m.size -= m.data[oldestKey].size
-		memory_gc_bytes.Add(float64(m.data[oldestKey].size))
-		memory_size.WithLabelValues(m.data[oldestKey].ns).Add(-1 * float64(m.data[oldestKey].size))
+		old := m.data[oldestKey]
+		memory_gc_bytes.WithLabelValues(m.Name).Add(float64(old.size))
+		m.addUsage(old.ns, -old.size)
 		delete(m.data, oldestKey)
 	}
 }
 
 func (c *Memory) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	c.access.touch(c.Name, ns, time.Now())
+
 	c.lock.RLock()
 	defer c.lock.RUnlock()
 
@@ -141,6 +263,19 @@ func (c *Memory) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCl
 	return 0, nil, nil
 }
 
+// Read an entry without counting it as used; see Peeker
+func (c *Memory) Peek(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if line, ok := c.data[ns+string(uuidAndHash)]; ok {
+		if data, ok := line.data[kind]; ok {
+			return int64(len(data)), ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return 0, nil, nil
+}
+
 func (m *Memory) PutTransaction(ns string, uuidAndHash []byte) Transaction {
 	generation := atomic.AddUint64(&m.generation, 1)
 	return &MemoryTx{
@@ -154,18 +289,29 @@ func (m *Memory) PutTransaction(ns string, uuidAndHash []byte) Transaction {
 type MemoryTx struct {
 	mem         *Memory
 	ns          string
+	client      string
 	uuidAndHash []byte
 	entry       memoryEntry
 }
 
+func (t *MemoryTx) SetClient(addr string) {
+	t.client = addr
+}
+
 func (t *MemoryTx) Put(size int64, kind Kind, r io.Reader) error {
-	data := make([]byte, size)
-	_, err := io.ReadFull(r, data)
+	// Grow the buffer as data arrives, rather than trusting the client's
+	// size up front
+	buf := bytes.Buffer{}
+	n, err := buf.ReadFrom(io.LimitReader(r, size))
 	if err != nil {
 		return err
 	}
-	t.entry.data[kind] = data
-	t.entry.size += size
+	if n != size {
+		return io.ErrUnexpectedEOF
+	}
+	// Putting a kind again replaces the earlier upload of it
+	t.entry.size += size - int64(len(t.entry.data[kind]))
+	t.entry.data[kind] = buf.Bytes()
 	return nil
 }
 
@@ -173,11 +319,36 @@ func (t *MemoryTx) Commit() error {
 	t.mem.lock.Lock()
 	defer t.mem.lock.Unlock()
 
-	t.mem.collectGarbage(t.entry.size)
-	memory_size.WithLabelValues(t.ns).Add(float64(t.entry.size))
+	key := t.ns + string(t.uuidAndHash)
+	t.entry.client = t.client
+
+	if old, ok := t.mem.data[key]; ok {
+		mismatch := false
+		for kind, data := range t.entry.data {
+			if stored, ok := old.data[kind]; ok && !bytes.Equal(stored, data) {
+				mismatch = true
+				reportMismatch(t.mem.Log, t.ns, kind, t.uuidAndHash, old.client, t.client, t.mem.MismatchPolicy)
+			}
+		}
+
+		if mismatch && t.mem.MismatchPolicy == MISMATCH_KEEP_FIRST {
+			return nil
+		}
+
+		// Take the old entry out of the accounting; it's replaced or rejected
+		t.mem.addUsage(t.ns, -old.size)
+		delete(t.mem.data, key)
+
+		if mismatch && t.mem.MismatchPolicy == MISMATCH_REJECT {
+			return ErrMismatch
+		}
+	}
+
+	t.mem.collectGarbage(t.ns, t.entry.size)
 
-	t.mem.data[t.ns+string(t.uuidAndHash)] = t.entry
-	t.mem.size += t.entry.size
+	t.mem.data[key] = t.entry
+	t.mem.addUsage(t.ns, t.entry.size)
+	t.mem.access.touch(t.mem.Name, t.ns, time.Now())
 
 	return nil
 }
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"testing"
@@ -84,3 +85,110 @@ func TestMemoryquota(t *testing.T) {
 		t.Errorf("Expected cache length to be 1, has %d", len(c.data))
 	}
 }
+
+func TestMemorySetQuota(t *testing.T) {
+	c := NewMemory(100)
+	for i := 0; i < 10; i++ {
+		key := make([]byte, 32)
+		key[0] = byte(i)
+		tx := c.PutTransaction("mem", key)
+		tx.Put(10, KIND_INFO, bytes.NewReader(make([]byte, 10)))
+		tx.Commit()
+	}
+
+	// Lowering the quota evicts what no longer fits right away
+	c.SetQuota(50)
+	if c.Usage() != 50 {
+		t.Errorf("Expected 50 bytes used, got %d", c.Usage())
+	}
+}
+
+func TestMemoryPutShortRead(t *testing.T) {
+	c := NewMemory(1e6)
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	// Claims to be huge, but only sends a little
+	tx := c.PutTransaction("mem", key)
+	err := tx.Put(1<<50, KIND_ASSET, bytes.NewReader([]byte("short")))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected %s, got %v", io.ErrUnexpectedEOF, err)
+	}
+	tx.Abort()
+}
+
+func TestMemoryNamespaceQuotas(t *testing.T) {
+	c := NewMemory(100)
+	c.SetNamespaceQuota("quiet", NamespaceQuota{Min: 30})
+	c.SetNamespaceQuota("capped", NamespaceQuota{Max: 20})
+
+	put := func(ns string, count int) {
+		for i := 0; i < count; i++ {
+			key := make([]byte, 32)
+			rand.Read(key)
+
+			tx := c.PutTransaction(ns, key)
+			if err := tx.Put(10, KIND_INFO, bytes.NewReader(make([]byte, 10))); err != nil {
+				t.Fatalf("Unexpected error calling Put(): %s", err)
+			}
+			tx.Commit()
+		}
+	}
+
+	// The quiet namespace's entries are the oldest, but kept by its minimum
+	put("quiet", 3)
+	put("busy", 20)
+	put("capped", 5)
+
+	if c.size > 100 {
+		t.Errorf("Expected cache size to be at most 100, got %d", c.size)
+	}
+	if c.usage["quiet"] != 30 {
+		t.Errorf("Expected quiet namespace to keep 30 bytes, has %d", c.usage["quiet"])
+	}
+	if c.usage["capped"] != 20 {
+		t.Errorf("Expected capped namespace to have 20 bytes, has %d", c.usage["capped"])
+	}
+	if c.usage["busy"] != 50 {
+		t.Errorf("Expected busy namespace to have the remaining 50 bytes, has %d", c.usage["busy"])
+	}
+
+	// Entries kept by minimums can push the cache over quota, but nothing
+	// else is evicted to get below it
+	c.SetNamespaceQuota("busy", NamespaceQuota{Min: 100})
+	put("busy", 1)
+	if c.usage["quiet"] != 30 || c.usage["busy"] < 50 {
+		t.Errorf("Expected minimums to be kept, got %v", c.usage)
+	}
+}
+
+func TestMemoryRetireNamespace(t *testing.T) {
+	m := NewMemory(1000)
+	key := make([]byte, 32)
+	for _, ns := range []string{"old", "current"} {
+		tx := m.PutTransaction(ns, key)
+		tx.Put(4, KIND_ASSET, bytes.NewReader([]byte("data")))
+		tx.Commit()
+	}
+
+	if err := m.RetireNamespace("old", "/tmp/archive"); err == nil {
+		t.Errorf("Expected error archiving from memory")
+	}
+	if err := m.RetireNamespace("old", ""); err != nil {
+		t.Fatalf("Unexpected error retiring namespace: %s", err)
+	}
+
+	if found, _, _ := readFromCache(m, "old", KIND_ASSET, key); found {
+		t.Errorf("Expected retired namespace to be gone")
+	}
+	testCacheHit(t, m, "current", KIND_ASSET, key, []byte("data"))
+	if m.Usage() != 4 {
+		t.Errorf("Expected 4 bytes left, got %d", m.Usage())
+	}
+
+	// Reading a namespace counts as using it
+	usage := m.Namespaces()
+	if len(usage) != 2 || usage[1].Namespace != "old" || usage[1].Size != 0 || usage[1].LastAccess.IsZero() {
+		t.Errorf("Expected old namespace to be empty but used, got %+v", usage)
+	}
+}
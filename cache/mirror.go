@@ -0,0 +1,491 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/msiebuhr/ucs/protocol"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mirror_queue_depth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ucs_mirror_queue_depth",
+		Help: "Transactions waiting to be sent to a mirror",
+	}, []string{"namespace", "mirror"})
+	mirror_spool_depth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ucs_mirror_spool_depth",
+		Help: "Transactions spooled on disk for a mirror",
+	}, []string{"namespace", "mirror"})
+	mirror_transactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_mirror_transactions",
+		Help: "Transactions handled by mirrors, by outcome",
+	}, []string{"namespace", "mirror", "result"})
+)
+
+func init() {
+	prometheus.MustRegister(mirror_queue_depth)
+	prometheus.MustRegister(mirror_spool_depth)
+	prometheus.MustRegister(mirror_transactions)
+}
+
+// Mirror replays committed transactions to other cache servers in the
+// background. Transactions are queued per mirror, so a slow or unavailable
+// mirror never holds up the client or the other mirrors.
+//
+// Entries are read back from Backend when they're sent, so entries that have
+// been garbage collected in the meantime are skipped. If SpoolDir is set,
+// transactions that cannot be queued or sent are written to disk and retried
+// later.
+type Mirror struct {
+	Cacher
+
+	// Where entries are read back from, without counting as used (see
+	// Peeker). Defaults to the wrapped cache; set it to the backend if that
+	// is wrapped in ex. Upstream or Fallback.
+	Backend Cacher
+
+	// Namespace, used for metrics and spool directories
+	Namespace string
+
+	// Transactions to keep in memory per mirror before spooling/dropping
+	QueueSize int
+
+	// Attempts to send a transaction before spooling/dropping it
+	Retries int
+
+	// Timeout for each connection to a mirror
+	Timeout time.Duration
+
+	// Longest wait between retries
+	MaxBackoff time.Duration
+
+	// Where to keep transactions that couldn't be sent. Empty disables
+	// spooling.
+	SpoolDir string
+
+	targets []*mirrorTarget
+	closer  chan bool
+	done    sync.WaitGroup
+}
+
+// Wrap a cache, mirroring all transactions to the given addresses
+func NewMirror(local Cacher, addresses []string, options ...func(*Mirror)) *Mirror {
+	m := &Mirror{
+		Cacher:     local,
+		QueueSize:  1000,
+		Retries:    5,
+		Timeout:    time.Minute,
+		MaxBackoff: time.Minute,
+		closer:     make(chan bool),
+	}
+	for _, f := range options {
+		f(m)
+	}
+	if m.Backend == nil {
+		m.Backend = local
+	}
+
+	for _, address := range addresses {
+		t := &mirrorTarget{
+			mirror:     m,
+			address:    address,
+			queue:      make(chan mirrorJob, m.QueueSize),
+			overflowed: make(chan bool, 1),
+			backoff:    time.Second,
+		}
+		if m.SpoolDir != "" {
+			t.spoolDir = filepath.Join(m.SpoolDir, strings.Replace(address, ":", "_", -1))
+			os.MkdirAll(t.spoolDir, os.ModePerm)
+
+			m.done.Add(1)
+			go t.runSpooler()
+		}
+		m.targets = append(m.targets, t)
+
+		m.done.Add(1)
+		go t.run()
+	}
+
+	return m
+}
+
+// Stop sending to mirrors. Queued transactions are spooled if possible.
+func (m *Mirror) Close() {
+	close(m.closer)
+	m.done.Wait()
+}
+
+func (m *Mirror) PutTransaction(ns string, uuidAndHash []byte) Transaction {
+	return &mirrorTx{
+		Transaction: m.Cacher.PutTransaction(ns, uuidAndHash),
+		mirror:      m,
+		ns:          ns,
+		uuidAndHash: uuidAndHash,
+	}
+}
+
+type mirrorTx struct {
+	Transaction
+	mirror      *Mirror
+	ns          string
+	uuidAndHash []byte
+	kinds       []Kind
+}
+
+func (t *mirrorTx) SetClient(addr string) {
+	setClient(t.Transaction, addr)
+}
+
+func (t *mirrorTx) Put(size int64, kind Kind, r io.Reader) error {
+	t.kinds = append(t.kinds, kind)
+	return t.Transaction.Put(size, kind, r)
+}
+
+func (t *mirrorTx) Commit() error {
+	if err := t.Transaction.Commit(); err != nil {
+		return err
+	}
+
+	job := mirrorJob{ns: t.ns, uuidAndHash: t.uuidAndHash, kinds: t.kinds}
+	for _, target := range t.mirror.targets {
+		target.enqueue(job)
+	}
+	return nil
+}
+
+type mirrorJob struct {
+	ns          string
+	uuidAndHash []byte
+	kinds       []Kind
+}
+
+type mirrorTarget struct {
+	mirror   *Mirror
+	address  string
+	queue    chan mirrorJob
+	spoolDir string
+
+	// Jobs that didn't fit in the queue, waiting to be spooled
+	lock       sync.Mutex
+	overflow   []mirrorJob
+	overflowed chan bool
+
+	// Connection kept open while there's more to send
+	conn *serverConn
+
+	// Current wait before retrying, doubled on every failure
+	backoff time.Duration
+
+	spoolCount uint64
+}
+
+func (t *mirrorTarget) result(result string) {
+	mirror_transactions.WithLabelValues(t.mirror.Namespace, t.address, result).Inc()
+}
+
+// Queue up a job without blocking. If the queue is full, the job is handed to
+// the spooler, or dropped if there's no spool.
+func (t *mirrorTarget) enqueue(job mirrorJob) {
+	select {
+	case t.queue <- job:
+		mirror_queue_depth.WithLabelValues(t.mirror.Namespace, t.address).Set(float64(len(t.queue)))
+		return
+	default:
+	}
+
+	if t.spoolDir == "" {
+		t.result("dropped")
+		return
+	}
+	t.lock.Lock()
+	t.overflow = append(t.overflow, job)
+	t.lock.Unlock()
+	select {
+	case t.overflowed <- true:
+	default:
+	}
+}
+
+// Spool jobs that didn't fit in the queue, away from the clients committing
+// them
+func (t *mirrorTarget) runSpooler() {
+	defer t.mirror.done.Done()
+
+	for {
+		select {
+		case <-t.mirror.closer:
+			t.spoolOverflow()
+			return
+		case <-t.overflowed:
+			t.spoolOverflow()
+		}
+	}
+}
+
+func (t *mirrorTarget) spoolOverflow() {
+	for {
+		t.lock.Lock()
+		jobs := t.overflow
+		t.overflow = nil
+		t.lock.Unlock()
+
+		if len(jobs) == 0 {
+			return
+		}
+		for _, job := range jobs {
+			t.spoolOrDrop(job)
+		}
+	}
+}
+
+func (t *mirrorTarget) spoolOrDrop(job mirrorJob) {
+	if t.spoolDir == "" {
+		t.result("dropped")
+		return
+	}
+	written, err := t.spool(job)
+	if err != nil {
+		t.result("dropped")
+	} else if !written {
+		t.result("evicted")
+	} else {
+		t.result("spooled")
+	}
+}
+
+func (t *mirrorTarget) run() {
+	defer t.mirror.done.Done()
+
+	retrySpool := time.NewTicker(30 * time.Second)
+	defer retrySpool.Stop()
+
+	for {
+		select {
+		case <-t.mirror.closer:
+			// Don't lose what's queued up
+			for {
+				select {
+				case job := <-t.queue:
+					t.spoolOrDrop(job)
+				default:
+					mirror_queue_depth.WithLabelValues(t.mirror.Namespace, t.address).Set(0)
+					t.hangUp()
+					return
+				}
+			}
+		case job := <-t.queue:
+			mirror_queue_depth.WithLabelValues(t.mirror.Namespace, t.address).Set(float64(len(t.queue)))
+			if t.sendWithRetries(job) {
+				t.replaySpool()
+			}
+			if len(t.queue) == 0 {
+				t.hangUp()
+			}
+		case <-retrySpool.C:
+			t.replaySpool()
+			t.hangUp()
+		}
+	}
+}
+
+// Wait for the current backoff, returning false if we're closing down
+func (t *mirrorTarget) wait() bool {
+	timer := time.NewTimer(t.backoff)
+	defer timer.Stop()
+
+	t.backoff *= 2
+	if t.backoff > t.mirror.MaxBackoff {
+		t.backoff = t.mirror.MaxBackoff
+	}
+
+	select {
+	case <-t.mirror.closer:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (t *mirrorTarget) sendWithRetries(job mirrorJob) bool {
+	for attempt := 0; attempt < t.mirror.Retries; attempt += 1 {
+		if attempt > 0 {
+			t.result("retried")
+			if !t.wait() {
+				break
+			}
+		}
+
+		written := false
+		err := t.send(func(w io.Writer) (err error) {
+			written, err = t.writeJob(w, job)
+			return err
+		})
+		if err == nil {
+			t.backoff = time.Second
+			if written {
+				t.result("sent")
+			} else {
+				t.result("evicted")
+			}
+			return true
+		}
+	}
+
+	t.spoolOrDrop(job)
+	return false
+}
+
+// Send whatever the given function writes to the mirror, connecting first if
+// there's no connection open
+func (t *mirrorTarget) send(write func(io.Writer) error) error {
+	if t.conn == nil {
+		conn, err := dialServer(t.address, t.mirror.Timeout)
+		if err != nil {
+			return err
+		}
+		t.conn = conn
+	}
+	t.conn.SetDeadline(time.Now().Add(t.mirror.Timeout))
+
+	err := write(t.conn.w)
+	if err == nil {
+		err = t.conn.w.Flush()
+	}
+	if err != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	return err
+}
+
+// Hang up once the mirror has handled everything sent, rather than leaving
+// the connection for the mirror to time out
+func (t *mirrorTarget) hangUp() {
+	if t.conn == nil {
+		return
+	}
+	t.conn.SetDeadline(time.Now().Add(t.mirror.Timeout))
+	t.conn.quit()
+	t.conn = nil
+}
+
+// Write a transaction for the job, reading data back from the cache. Returns
+// false if nothing was left to send.
+func (t *mirrorTarget) writeJob(w io.Writer, job mirrorJob) (bool, error) {
+	type put struct {
+		kind   Kind
+		size   int64
+		reader io.ReadCloser
+	}
+	puts := []put{}
+	defer func() {
+		for _, p := range puts {
+			p.reader.Close()
+		}
+	}()
+
+	for _, kind := range job.kinds {
+		size, reader, err := peek(t.mirror.Backend, job.ns, kind, job.uuidAndHash)
+		if err != nil {
+			return false, err
+		}
+		if size == 0 {
+			if reader != nil {
+				reader.Close()
+			}
+			continue
+		}
+		puts = append(puts, put{kind, size, reader})
+	}
+
+	// Evicted before we got to it
+	if len(puts) == 0 {
+		return false, nil
+	}
+
+	enc := protocol.NewEncoder(w)
+	if err := enc.Encode(protocol.TxStart{UuidAndHash: job.uuidAndHash}); err != nil {
+		return false, err
+	}
+	for _, p := range puts {
+		if err := enc.Encode(protocol.Put{Kind: p.kind, Size: p.size}); err != nil {
+			return false, err
+		}
+		if _, err := io.CopyN(w, p.reader, p.size); err != nil {
+			return false, err
+		}
+	}
+	return true, enc.Encode(protocol.TxEnd{})
+}
+
+// Write the job as a replayable transaction in the spool directory. Returns
+// false if the entry was no longer cached.
+func (t *mirrorTarget) spool(job mirrorJob) (bool, error) {
+	count := atomic.AddUint64(&t.spoolCount, 1)
+	name := filepath.Join(t.spoolDir, fmt.Sprintf("%020d-%010d.tx", time.Now().UnixNano(), count))
+
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return false, err
+	}
+	written, err := t.writeJob(f, job)
+	f.Close()
+	if err != nil || !written {
+		os.Remove(name + ".tmp")
+		return false, err
+	}
+
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return false, err
+	}
+	mirror_spool_depth.WithLabelValues(t.mirror.Namespace, t.address).Inc()
+	return true, nil
+}
+
+// Send spooled transactions, oldest first, until one fails
+func (t *mirrorTarget) replaySpool() {
+	if t.spoolDir == "" {
+		return
+	}
+
+	names, err := filepath.Glob(filepath.Join(t.spoolDir, "*.tx"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	mirror_spool_depth.WithLabelValues(t.mirror.Namespace, t.address).Set(float64(len(names)))
+
+	for _, name := range names {
+		select {
+		case <-t.mirror.closer:
+			return
+		default:
+		}
+
+		err := t.send(func(w io.Writer) error {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+		if err != nil {
+			return
+		}
+
+		os.Remove(name)
+		t.result("sent")
+		mirror_spool_depth.WithLabelValues(t.mirror.Namespace, t.address).Dec()
+	}
+}
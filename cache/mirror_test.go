@@ -0,0 +1,231 @@
+package cache
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Minimal cache server recording the transactions it receives
+type fakeMirror struct {
+	listener net.Listener
+
+	lock    sync.Mutex
+	entries map[string]map[Kind][]byte
+}
+
+func newFakeMirror(t *testing.T, address string) *fakeMirror {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	m := &fakeMirror{listener: listener, entries: map[string]map[Kind][]byte{}}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.handle(conn)
+		}
+	}()
+	return m
+}
+
+func (m *fakeMirror) handle(conn net.Conn) {
+	defer conn.Close()
+	version := make([]byte, 8)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return
+	}
+	conn.Write(version)
+
+	var key string
+	for {
+		cmd := make([]byte, 1)
+		if _, err := io.ReadFull(conn, cmd); err != nil || cmd[0] == 'q' {
+			return
+		}
+		cmd = append(cmd, 0)
+		if _, err := io.ReadFull(conn, cmd[1:]); err != nil {
+			return
+		}
+
+		switch string(cmd[0]) {
+		case "t":
+			if cmd[1] == 's' {
+				uuidAndHash := make([]byte, 32)
+				io.ReadFull(conn, uuidAndHash)
+				key = string(uuidAndHash)
+			}
+		case "p":
+			sizeBytes := make([]byte, 16)
+			io.ReadFull(conn, sizeBytes)
+			size, _ := strconv.ParseUint(string(sizeBytes), 16, 64)
+			data := make([]byte, size)
+			io.ReadFull(conn, data)
+
+			m.lock.Lock()
+			if _, ok := m.entries[key]; !ok {
+				m.entries[key] = map[Kind][]byte{}
+			}
+			m.entries[key][Kind(cmd[1])] = data
+			m.lock.Unlock()
+		}
+	}
+}
+
+// Wait a bit for an entry to show up
+func (m *fakeMirror) get(uuidAndHash []byte, kind Kind) []byte {
+	for i := 0; i < 100; i += 1 {
+		m.lock.Lock()
+		data, ok := m.entries[string(uuidAndHash)][kind]
+		m.lock.Unlock()
+		if ok {
+			return data
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestMirrorSendsCommits(t *testing.T) {
+	fake := newFakeMirror(t, "127.0.0.1:0")
+	defer fake.listener.Close()
+
+	m := NewMirror(NewMemory(1e6), []string{fake.listener.Addr().String()})
+	defer m.Close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tx := m.PutTransaction("mirror", key)
+	tx.Put(4, KIND_INFO, bytes.NewReader([]byte("info")))
+	tx.Put(5, KIND_ASSET, bytes.NewReader([]byte("asset")))
+	tx.Commit()
+
+	// Still available locally
+	testCacheHit(t, m, "mirror", KIND_INFO, key, []byte("info"))
+
+	if data := fake.get(key, KIND_INFO); !bytes.Equal(data, []byte("info")) {
+		t.Errorf("Expected mirror to receive info 'info', got '%s'", data)
+	}
+	if data := fake.get(key, KIND_ASSET); !bytes.Equal(data, []byte("asset")) {
+		t.Errorf("Expected mirror to receive asset 'asset', got '%s'", data)
+	}
+}
+
+func TestMirrorSpoolsWhenDown(t *testing.T) {
+	// Grab a free address and leave nothing listening on it
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	spoolDir := t.TempDir()
+
+	local := NewMemory(1e6)
+	m := NewMirror(local, []string{address}, func(m *Mirror) {
+		m.Retries = 1
+		m.SpoolDir = spoolDir
+	})
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tx := m.PutTransaction("mirror", key)
+	tx.Put(4, KIND_INFO, bytes.NewReader([]byte("info")))
+	tx.Commit()
+
+	// Committing never waits for the mirror
+	start := time.Now()
+	m.Close()
+	if time.Now().Sub(start) > 5*time.Second {
+		t.Errorf("Closing mirror took too long")
+	}
+
+	spooled, _ := filepath.Glob(filepath.Join(m.targets[0].spoolDir, "*.tx"))
+	if len(spooled) != 1 {
+		t.Fatalf("Expected one spooled transaction, got %d", len(spooled))
+	}
+
+	// Bring the mirror back and replay the spool
+	fake := newFakeMirror(t, address)
+	defer fake.listener.Close()
+
+	m = NewMirror(local, []string{address}, func(m *Mirror) { m.SpoolDir = spoolDir })
+	defer m.Close()
+	m.targets[0].replaySpool()
+
+	if data := fake.get(key, KIND_INFO); !bytes.Equal(data, []byte("info")) {
+		t.Errorf("Expected mirror to receive spooled info 'info', got '%s'", data)
+	}
+	spooled, _ = filepath.Glob(filepath.Join(m.targets[0].spoolDir, "*.tx"))
+	if len(spooled) != 0 {
+		t.Errorf("Expected spool to be empty after replay, has %d", len(spooled))
+	}
+}
+
+func TestMirrorReadsWithoutTouching(t *testing.T) {
+	fake := newFakeMirror(t, "127.0.0.1:0")
+	defer fake.listener.Close()
+
+	local := NewMemory(1e6)
+	m := NewMirror(local, []string{fake.listener.Addr().String()})
+	defer m.Close()
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	tx := m.PutTransaction("mirror", key)
+	tx.Put(4, KIND_INFO, bytes.NewReader([]byte("info")))
+	tx.Commit()
+	committed := local.Namespaces()[0].LastAccess
+
+	if data := fake.get(key, KIND_INFO); !bytes.Equal(data, []byte("info")) {
+		t.Fatalf("Expected mirror to receive info 'info', got '%s'", data)
+	}
+	if lastAccess := local.Namespaces()[0].LastAccess; !lastAccess.Equal(committed) {
+		t.Errorf("Expected sending to mirror to leave last access at %s, got %s", committed, lastAccess)
+	}
+}
+
+func TestMirrorSpoolsOverflow(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	// Keep the sender stuck retrying, so the queue overflows
+	m := NewMirror(NewMemory(1e6), []string{address}, func(m *Mirror) {
+		m.QueueSize = 1
+		m.Retries = 100
+		m.MaxBackoff = time.Hour
+		m.SpoolDir = t.TempDir()
+	})
+
+	for i := 0; i < 5; i += 1 {
+		key := make([]byte, 32)
+		rand.Read(key)
+		tx := m.PutTransaction("mirror", key)
+		tx.Put(4, KIND_INFO, bytes.NewReader([]byte("info")))
+		tx.Commit()
+	}
+	m.Close()
+
+	spooled, _ := filepath.Glob(filepath.Join(m.targets[0].spoolDir, "*.tx"))
+	if len(spooled) != 5 {
+		t.Errorf("Expected all 5 transactions to be spooled, got %d", len(spooled))
+	}
+}
@@ -5,5 +5,5 @@ import (
 )
 
 func PrettyUuidAndHash(d []byte) string {
-	return fmt.Sprintf("%x/%x", d[:16], d[17:])
+	return fmt.Sprintf("%x/%x", d[:16], d[16:])
 }
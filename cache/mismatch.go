@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reupload_mismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_cache_reupload_mismatches",
+		Help: "Re-uploads of existing entries with different content",
+	}, []string{"namespace", "type"})
+)
+
+func init() {
+	prometheus.MustRegister(reupload_mismatches)
+}
+
+// What to do when an entry is re-uploaded with different content
+type MismatchPolicy int
+
+const (
+	// Replace the stored entry with the new upload
+	MISMATCH_KEEP_LAST MismatchPolicy = iota
+	// Keep the stored entry and discard the new upload
+	MISMATCH_KEEP_FIRST
+	// Discard the new upload and remove the stored entry, as neither can be
+	// trusted. The commit fails with ErrMismatch.
+	MISMATCH_REJECT
+)
+
+var ErrMismatch = errors.New("Re-upload differs from stored entry")
+
+func (p MismatchPolicy) String() string {
+	switch p {
+	case MISMATCH_KEEP_FIRST:
+		return "keep-first"
+	case MISMATCH_REJECT:
+		return "reject"
+	default:
+		return "keep-last"
+	}
+}
+
+func ParseMismatchPolicy(s string) (MismatchPolicy, error) {
+	for _, p := range []MismatchPolicy{MISMATCH_KEEP_LAST, MISMATCH_KEEP_FIRST, MISMATCH_REJECT} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return MISMATCH_KEEP_LAST, fmt.Errorf("Unknown mismatch policy '%s'", s)
+}
+
+// Compare two readers, returning true if they have identical content
+func sameContent(a, b io.Reader) (bool, error) {
+	ra, rb := bufio.NewReader(a), bufio.NewReader(b)
+	bufA, bufB := make([]byte, 32*1024), make([]byte, 32*1024)
+
+	for {
+		na, errA := io.ReadFull(ra, bufA)
+		nb, errB := io.ReadFull(rb, bufB)
+		if !bytes.Equal(bufA[:na], bufB[:nb]) {
+			return false, nil
+		}
+
+		doneA := errA == io.EOF || errA == io.ErrUnexpectedEOF
+		doneB := errB == io.EOF || errB == io.ErrUnexpectedEOF
+		if errA != nil && !doneA {
+			return false, errA
+		}
+		if errB != nil && !doneB {
+			return false, errB
+		}
+		if doneA || doneB {
+			return doneA == doneB, nil
+		}
+	}
+}
+
+// Count and log a mismatching re-upload
+func reportMismatch(l *log.Logger, ns string, kind Kind, uuidAndHash []byte, storedClient, client string, policy MismatchPolicy) {
+	reupload_mismatches.WithLabelValues(ns, string(kind)).Inc()
+
+	if storedClient == "" {
+		storedClient = "unknown"
+	}
+	l.Printf(
+		"Re-upload mismatch namespace=%s kind=%c guid=%x hash=%x stored_client=%s client=%s policy=%s",
+		ns, kind, uuidAndHash[:16], uuidAndHash[16:], storedClient, client, policy,
+	)
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSameContent(t *testing.T) {
+	long := strings.Repeat("x", 100*1024)
+
+	tests := []struct {
+		a, b     string
+		expected bool
+	}{
+		{"", "", true},
+		{"foo", "foo", true},
+		{"foo", "bar", false},
+		{"foo", "foobar", false},
+		{long, long, true},
+		{long, long + "x", false},
+		{long + "a", long + "b", false},
+	}
+
+	for _, test := range tests {
+		same, err := sameContent(strings.NewReader(test.a), strings.NewReader(test.b))
+		if err != nil {
+			t.Errorf("Unexpected error comparing: %s", err)
+		}
+		if same != test.expected {
+			t.Errorf("Expected sameContent(%d bytes, %d bytes) to be %t", len(test.a), len(test.b), test.expected)
+		}
+	}
+}
+
+func TestParseMismatchPolicy(t *testing.T) {
+	for _, p := range []MismatchPolicy{MISMATCH_KEEP_LAST, MISMATCH_KEEP_FIRST, MISMATCH_REJECT} {
+		parsed, err := ParseMismatchPolicy(p.String())
+		if err != nil || parsed != p {
+			t.Errorf("Expected %s to parse back, got %s, %s", p, parsed, err)
+		}
+	}
+
+	if _, err := ParseMismatchPolicy("keep-everything"); err == nil {
+		t.Errorf("Expected error parsing unknown policy")
+	}
+}
+
+func TestMismatchPolicies(t *testing.T) {
+	tests := []struct {
+		policy   MismatchPolicy
+		expected []byte
+		err      error
+	}{
+		{MISMATCH_KEEP_LAST, []byte("second"), nil},
+		{MISMATCH_KEEP_FIRST, []byte("first"), nil},
+		{MISMATCH_REJECT, nil, ErrMismatch},
+	}
+
+	for _, test := range tests {
+		policy := test.policy
+		fs, err := NewFS(func(f *FS) {
+			f.Basepath = t.TempDir()
+			f.Quota = 1e6
+			f.MismatchPolicy = policy
+		})
+		if err != nil {
+			t.Fatalf("Error creating FS: %s", err)
+		}
+		defer fs.Close()
+		backends := map[string]Cacher{
+			"mem": NewMemory(1e6, func(m *Memory) { m.MismatchPolicy = policy }),
+			"fs":  fs,
+		}
+
+		for name, c := range backends {
+			t.Run(policy.String()+"/"+name, func(t *testing.T) {
+				key := make([]byte, 32)
+				rand.Read(key)
+
+				if err := putFrom(c, "10.0.0.1:1234", "mm", key, "first"); err != nil {
+					t.Fatalf("Unexpected error uploading: %s", err)
+				}
+
+				// Identical re-uploads are always fine
+				if err := putFrom(c, "10.0.0.2:1234", "mm", key, "first"); err != nil {
+					t.Errorf("Unexpected error re-uploading identical content: %s", err)
+				}
+
+				err := putFrom(c, "10.0.0.3:1234", "mm", key, "second")
+				if err != test.err {
+					t.Errorf("Expected commit error %v, got %v", test.err, err)
+				}
+
+				hit, data, _ := readFromCache(c, "mm", KIND_ASSET, key)
+				if test.expected == nil && hit {
+					t.Errorf("Expected entry to be removed, got '%s'", data)
+				}
+				if test.expected != nil && !bytes.Equal(data, test.expected) {
+					t.Errorf("Expected '%s' to be stored, got '%s'", test.expected, data)
+				}
+			})
+		}
+	}
+}
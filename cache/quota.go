@@ -0,0 +1,43 @@
+package cache
+
+// Limits for a namespace within a cache's overall quota. Without them, all
+// namespaces are garbage-collected as one, oldest entries first.
+type NamespaceQuota struct {
+	// Most bytes the namespace may use, 0 for no limit of its own
+	Max int64
+
+	// Bytes the namespace keeps when other namespaces need room, so a quiet
+	// namespace isn't evicted by a busy one. Minimums should add up to less
+	// than the overall quota, or it can't be kept.
+	Min int64
+}
+
+// Whether a cache using total bytes, of which usage by namespace, needs to
+// evict anything
+func overQuota(quota, total int64, quotas map[string]NamespaceQuota, usage map[string]int64) bool {
+	if total > quota {
+		return true
+	}
+	for ns, q := range quotas {
+		if q.Max > 0 && usage[ns] > q.Max {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether an entry of size bytes may be evicted from a namespace: Namespaces
+// over their own quota are evicted from first, and others only while the
+// cache is over quota, and not below their minimum.
+func evictable(ns string, size, quota, total int64, quotas map[string]NamespaceQuota, usage map[string]int64) bool {
+	q := quotas[ns]
+	if q.Max > 0 && usage[ns] > q.Max {
+		return true
+	}
+	for other, otherQuota := range quotas {
+		if otherQuota.Max > 0 && usage[other] > otherQuota.Max {
+			return false
+		}
+	}
+	return total > quota && usage[ns]-size >= q.Min
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reliability_commits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_reliability_commits",
+		Help: "Transactions seen in high-reliability mode, by whether they were stored",
+	}, []string{"namespace", "result"})
+	reliability_pending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ucs_reliability_pending_entries",
+		Help: "Entries waiting for enough identical uploads",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(reliability_commits)
+	prometheus.MustRegister(reliability_pending)
+}
+
+// HighReliability only stores entries once enough different clients have
+// uploaded byte-identical content for them. Until then, the uploads are
+// discarded and gets report a miss. This keeps a single client with a
+// non-deterministic importer from poisoning the cache.
+//
+// Clients are told apart by IP address, so repeated uploads from the same
+// machine only count once.
+type HighReliability struct {
+	Cacher
+
+	// Identical uploads needed before an entry is stored
+	Threshold int
+
+	// How long to remember uploads of entries that haven't reached the
+	// threshold
+	Window time.Duration
+
+	lock      sync.Mutex
+	pending   map[string]*reliabilityVotes
+	lastPrune time.Time
+}
+
+type reliabilityVotes struct {
+	// Clients having uploaded each digest
+	clients  map[string]map[string]bool
+	lastSeen time.Time
+}
+
+func NewHighReliability(c Cacher, threshold int, options ...func(*HighReliability)) *HighReliability {
+	r := &HighReliability{
+		Cacher:    c,
+		Threshold: threshold,
+		Window:    24 * time.Hour,
+		pending:   make(map[string]*reliabilityVotes),
+	}
+	for _, f := range options {
+		f(r)
+	}
+	return r
+}
+
+func (r *HighReliability) PutTransaction(ns string, uuidAndHash []byte) Transaction {
+	return &reliabilityTx{
+		Transaction: r.Cacher.PutTransaction(ns, uuidAndHash),
+		r:           r,
+		ns:          ns,
+		uuidAndHash: uuidAndHash,
+		digests:     make(map[Kind]hash.Hash),
+	}
+}
+
+// Record an upload, returning true if the threshold has been reached
+func (r *HighReliability) vote(key, digest, client string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	r.prune(now)
+
+	votes, ok := r.pending[key]
+	if !ok {
+		votes = &reliabilityVotes{clients: make(map[string]map[string]bool)}
+		r.pending[key] = votes
+	}
+	if _, ok := votes.clients[digest]; !ok {
+		votes.clients[digest] = make(map[string]bool)
+	}
+	votes.clients[digest][client] = true
+	votes.lastSeen = now
+
+	if len(votes.clients[digest]) < r.Threshold {
+		reliability_pending.Set(float64(len(r.pending)))
+		return false
+	}
+
+	delete(r.pending, key)
+	reliability_pending.Set(float64(len(r.pending)))
+	return true
+}
+
+// Forget entries that haven't been uploaded within the window. Runs at most
+// once a minute, as it walks everything pending.
+func (r *HighReliability) prune(now time.Time) {
+	if now.Sub(r.lastPrune) < time.Minute {
+		return
+	}
+	r.lastPrune = now
+
+	for key, votes := range r.pending {
+		if now.Sub(votes.lastSeen) > r.Window {
+			delete(r.pending, key)
+		}
+	}
+}
+
+type reliabilityTx struct {
+	Transaction
+	r           *HighReliability
+	ns          string
+	client      string
+	uuidAndHash []byte
+	digests     map[Kind]hash.Hash
+}
+
+func (t *reliabilityTx) SetClient(addr string) {
+	t.client = addr
+	setClient(t.Transaction, addr)
+}
+
+func (t *reliabilityTx) Put(size int64, kind Kind, r io.Reader) error {
+	h := sha256.New()
+	t.digests[kind] = h
+	return t.Transaction.Put(size, kind, io.TeeReader(r, h))
+}
+
+// Commit if enough clients have uploaded the same content, and abort
+// otherwise.
+func (t *reliabilityTx) Commit() error {
+	kinds := make([]string, 0, len(t.digests))
+	for kind := range t.digests {
+		kinds = append(kinds, string(kind))
+	}
+	sort.Strings(kinds)
+
+	digest := sha256.New()
+	for _, kind := range kinds {
+		digest.Write([]byte(kind))
+		digest.Write(t.digests[Kind(kind[0])].Sum(nil))
+	}
+
+	client := t.client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	if !t.r.vote(t.ns+string(t.uuidAndHash), string(digest.Sum(nil)), client) {
+		reliability_commits.WithLabelValues(t.ns, "pending").Inc()
+		return t.Transaction.Abort()
+	}
+
+	reliability_commits.WithLabelValues(t.ns, "stored").Inc()
+	return t.Transaction.Commit()
+}
@@ -0,0 +1,72 @@
+package cache
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func putFrom(c Cacher, client string, ns string, key []byte, data string) error {
+	tx := c.PutTransaction(ns, key)
+	tx.(ClientSetter).SetClient(client)
+	if err := tx.Put(int64(len(data)), KIND_ASSET, strings.NewReader(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func TestHighReliability(t *testing.T) {
+	fs, err := NewFS(func(f *FS) { f.Basepath = t.TempDir(); f.Quota = 1e6 })
+	if err != nil {
+		t.Fatalf("Error creating FS: %s", err)
+	}
+	defer fs.Close()
+
+	backends := map[string]Cacher{
+		"mem": NewMemory(1e6),
+		"fs":  fs,
+	}
+
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			c := NewHighReliability(backend, 2)
+
+			key := make([]byte, 32)
+			rand.Read(key)
+
+			// First upload isn't served
+			if err := putFrom(c, "10.0.0.1:1234", "hr", key, "asset"); err != nil {
+				t.Fatalf("Unexpected error uploading: %s", err)
+			}
+			if hit, _, _ := readFromCache(c, "hr", KIND_ASSET, key); hit {
+				t.Errorf("Expected miss after a single upload")
+			}
+
+			// Same client again doesn't count
+			if err := putFrom(c, "10.0.0.1:4321", "hr", key, "asset"); err != nil {
+				t.Fatalf("Unexpected error uploading: %s", err)
+			}
+			if hit, _, _ := readFromCache(c, "hr", KIND_ASSET, key); hit {
+				t.Errorf("Expected miss after uploads from the same client")
+			}
+
+			// Different content from another client doesn't count
+			if err := putFrom(c, "10.0.0.2:1234", "hr", key, "other"); err != nil {
+				t.Fatalf("Unexpected error uploading: %s", err)
+			}
+			if hit, _, _ := readFromCache(c, "hr", KIND_ASSET, key); hit {
+				t.Errorf("Expected miss after differing uploads")
+			}
+
+			// Identical content from another client gets it stored
+			if err := putFrom(c, "10.0.0.3:1234", "hr", key, "asset"); err != nil {
+				t.Fatalf("Unexpected error uploading: %s", err)
+			}
+			testCacheHit(t, c, "hr", KIND_ASSET, key, []byte("asset"))
+
+			if len(c.pending) != 0 {
+				t.Errorf("Expected no pending entries once stored, got %d", len(c.pending))
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	namespace_last_access = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ucs_cache_namespace_last_access_seconds",
+		Help: "When each namespace was last read from or uploaded to, as a Unix timestamp",
+	}, []string{"backend", "namespace"})
+)
+
+func init() {
+	prometheus.MustRegister(namespace_last_access)
+}
+
+// How much a namespace stores in a backend, and when it was last used
+type NamespaceUsage struct {
+	Namespace  string
+	Size       int64
+	LastAccess time.Time
+}
+
+// Retirer is implemented by backends that can remove namespaces no longer in
+// use as a whole.
+type Retirer interface {
+	// Namespaces with anything stored or used, by name
+	Namespaces() []NamespaceUsage
+
+	// Remove all of a namespace, or move it to an archive directory if
+	// given
+	RetireNamespace(ns, archive string) error
+}
+
+// When namespaces in a backend were last used. The zero value is ready to
+// use.
+type accessTimes struct {
+	lock  sync.Mutex
+	times map[string]time.Time
+}
+
+// Note a namespace as used at t, unless it has been used since
+func (a *accessTimes) touch(backend, ns string, t time.Time) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.times == nil {
+		a.times = make(map[string]time.Time)
+	}
+	previous := a.times[ns]
+	if !t.After(previous) {
+		return
+	}
+	a.times[ns] = t
+
+	// Spare the metric most updates on busy namespaces
+	if t.Unix() != previous.Unix() {
+		namespace_last_access.WithLabelValues(backend, ns).Set(float64(t.Unix()))
+	}
+}
+
+func (a *accessTimes) get(ns string) time.Time {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.times[ns]
+}
+
+func (a *accessTimes) forget(backend, ns string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.times, ns)
+	namespace_last_access.DeleteLabelValues(backend, ns)
+}
+
+// Combine sizes and access times of namespaces, including ones only one of
+// them knows of
+func namespaceUsage(sizes map[string]int64, a *accessTimes) []NamespaceUsage {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	namespaces := map[string]bool{}
+	for ns := range sizes {
+		namespaces[ns] = true
+	}
+	for ns := range a.times {
+		namespaces[ns] = true
+	}
+
+	usage := make([]NamespaceUsage, 0, len(namespaces))
+	for ns := range namespaces {
+		usage = append(usage, NamespaceUsage{
+			Namespace:  ns,
+			Size:       sizes[ns],
+			LastAccess: a.times[ns],
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Namespace < usage[j].Namespace })
+	return usage
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// Router sends each namespace to a backend of its own, ex. a small hot
+// namespace to Memory while others use FS, and everything else to a default
+// backend. Backends keep their own metrics and GC.
+type Router struct {
+	Default Cacher
+
+	lock     sync.RWMutex
+	backends map[string]Cacher
+}
+
+func NewRouter(fallback Cacher, options ...func(*Router)) *Router {
+	r := &Router{
+		Default:  fallback,
+		backends: make(map[string]Cacher),
+	}
+	for _, f := range options {
+		f(r)
+	}
+	return r
+}
+
+// Send a namespace to a backend, or back to the default one if nil. Can be
+// changed while in use; transactions already started are committed to the
+// backend they were started on.
+func (r *Router) Route(ns string, backend Cacher) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if backend == nil {
+		delete(r.backends, ns)
+		return
+	}
+	r.backends[ns] = backend
+}
+
+// The backend a namespace is stored in
+func (r *Router) Backend(ns string) Cacher {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	if backend, ok := r.backends[ns]; ok {
+		return backend
+	}
+	return r.Default
+}
+
+func (r *Router) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	return r.Backend(ns).Get(ns, kind, uuidAndHash)
+}
+
+// Read an entry from the backend a namespace is routed to without counting it
+// as used; see Peeker
+func (r *Router) Peek(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	return peek(r.Backend(ns), ns, kind, uuidAndHash)
+}
+
+func (r *Router) PutTransaction(ns string, uuidAndHash []byte) Transaction {
+	return r.Backend(ns).PutTransaction(ns, uuidAndHash)
+}
+
+// Limit a namespace's share of its backend, if the backend supports it
+func (r *Router) SetNamespaceQuota(ns string, quota NamespaceQuota) {
+	if backend, ok := r.Backend(ns).(interface {
+		SetNamespaceQuota(string, NamespaceQuota)
+	}); ok {
+		backend.SetNamespaceQuota(ns, quota)
+	}
+}
+
+// Namespaces of all backends, each from the backend it's routed to; see
+// Retirer
+func (r *Router) Namespaces() []NamespaceUsage {
+	r.lock.RLock()
+	backends := make(map[string]Cacher, len(r.backends))
+	for ns, backend := range r.backends {
+		backends[ns] = backend
+	}
+	r.lock.RUnlock()
+
+	usage := []NamespaceUsage{}
+	if retirer, ok := r.Default.(Retirer); ok {
+		for _, u := range retirer.Namespaces() {
+			if _, routed := backends[u.Namespace]; !routed {
+				usage = append(usage, u)
+			}
+		}
+	}
+	for ns, backend := range backends {
+		retirer, ok := backend.(Retirer)
+		if !ok {
+			continue
+		}
+		for _, u := range retirer.Namespaces() {
+			if u.Namespace == ns {
+				usage = append(usage, u)
+			}
+		}
+	}
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Namespace < usage[j].Namespace })
+	return usage
+}
+
+// Retire a namespace from the backend it's routed to; see Retirer
+func (r *Router) RetireNamespace(ns, archive string) error {
+	retirer, ok := r.Backend(ns).(Retirer)
+	if !ok {
+		return fmt.Errorf("Backend of namespace '%s' can't retire namespaces", ns)
+	}
+	return retirer.RetireNamespace(ns, archive)
+}
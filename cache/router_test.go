@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	cold := NewMemory(1e6)
+	hot := NewMemory(1e6)
+	r := NewRouter(cold)
+	r.Route("hot", hot)
+
+	key := make([]byte, 32)
+	for _, ns := range []string{"hot", "cold"} {
+		tx := r.PutTransaction(ns, key)
+		if err := tx.Put(2, KIND_INFO, bytes.NewReader([]byte(ns[:2]))); err != nil {
+			t.Fatalf("Unexpected error calling Put(): %s", err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Unexpected error calling Commit(): %s", err)
+		}
+	}
+
+	// Each namespace is only stored in its own backend
+	for _, tc := range []struct {
+		backend Cacher
+		ns      string
+		found   bool
+	}{
+		{r, "hot", true},
+		{r, "cold", true},
+		{hot, "hot", true},
+		{hot, "cold", false},
+		{cold, "hot", false},
+		{cold, "cold", true},
+	} {
+		found, data, err := readFromCache(tc.backend, tc.ns, KIND_INFO, key)
+		if err != nil {
+			t.Fatalf("Unexpected error getting %s: %s", tc.ns, err)
+		}
+		if found != tc.found {
+			t.Errorf("Expected found=%t for %s, got %t", tc.found, tc.ns, found)
+		}
+		if found && string(data) != tc.ns[:2] {
+			t.Errorf("Expected '%s' for %s, got '%s'", tc.ns[:2], tc.ns, data)
+		}
+	}
+
+	// Quotas go to the namespace's backend
+	r.SetNamespaceQuota("hot", NamespaceQuota{Max: 1})
+	if _, ok := hot.quotas["hot"]; !ok {
+		t.Errorf("Expected quota to be set on the hot backend")
+	}
+	if _, ok := cold.quotas["hot"]; ok {
+		t.Errorf("Expected quota not to be set on the default backend")
+	}
+
+	// Unrouted namespaces go back to the default backend
+	r.Route("hot", nil)
+	if r.Backend("hot") != Cacher(cold) {
+		t.Errorf("Expected hot to use the default backend after unrouting")
+	}
+}
@@ -0,0 +1,235 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/msiebuhr/ucs/protocol"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	upstream_gets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_upstream_gets",
+		Help: "Gets through the upstream cache, by where they were answered from",
+	}, []string{"namespace", "type", "result"})
+	upstream_bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_upstream_fetched_bytes",
+		Help: "Bytes fetched from upstream servers",
+	}, []string{"namespace", "type"})
+	upstream_duration = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "ucs_upstream_fetch_duration_seconds",
+		Help: "Time spent fetching entries from upstream servers",
+	}, []string{"namespace"})
+)
+
+func init() {
+	prometheus.MustRegister(upstream_gets)
+	prometheus.MustRegister(upstream_bytes)
+	prometheus.MustRegister(upstream_duration)
+}
+
+// Upstream is a read-through cache. Misses in the local cache are looked up
+// on another cache server, and entries found there are stored locally before
+// being returned.
+//
+// All kinds of an entry are fetched in one go, as Unity will ask for the
+// others right after and backends store entries as a whole.
+type Upstream struct {
+	Cacher
+
+	// Address of the upstream cache server, ex. "cache.example.com:8126"
+	Address string
+
+	// Timeout for connecting to and each round-trip with the upstream
+	Timeout time.Duration
+
+	// Entries larger than this are not fetched. Zero means no limit.
+	MaxSize int64
+
+	// Idle connections to the upstream
+	conns chan *serverConn
+
+	// Fetches in progress, so concurrent gets for different kinds of an
+	// entry share one
+	lock     sync.Mutex
+	inflight map[string]*upstreamFetch
+}
+
+type upstreamFetch struct {
+	done  chan bool
+	found map[Kind]bool
+	err   error
+}
+
+// Wrap a local cache with an upstream server
+func NewUpstream(local Cacher, address string, options ...func(*Upstream)) *Upstream {
+	u := &Upstream{
+		Cacher:   local,
+		Address:  address,
+		Timeout:  10 * time.Second,
+		conns:    make(chan *serverConn, 4),
+		inflight: make(map[string]*upstreamFetch),
+	}
+	for _, f := range options {
+		f(u)
+	}
+	return u
+}
+
+func (u *Upstream) Get(ns string, kind Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	size, reader, err := u.Cacher.Get(ns, kind, uuidAndHash)
+	if err != nil || size > 0 {
+		if err == nil {
+			upstream_gets.WithLabelValues(ns, string(kind), "local_hit").Inc()
+		}
+		return size, reader, err
+	}
+	if reader != nil {
+		reader.Close()
+	}
+
+	found, err := u.sharedFetch(ns, uuidAndHash)
+	if err != nil {
+		upstream_gets.WithLabelValues(ns, string(kind), "error").Inc()
+		return 0, nil, fmt.Errorf("Upstream %s: %w", u.Address, err)
+	}
+
+	if !found[kind] {
+		upstream_gets.WithLabelValues(ns, string(kind), "miss").Inc()
+		return 0, nil, nil
+	}
+
+	upstream_gets.WithLabelValues(ns, string(kind), "upstream_hit").Inc()
+	return u.Cacher.Get(ns, kind, uuidAndHash)
+}
+
+// Fetch an entry, or wait for a fetch of it already in progress
+func (u *Upstream) sharedFetch(ns string, uuidAndHash []byte) (map[Kind]bool, error) {
+	key := ns + string(uuidAndHash)
+
+	u.lock.Lock()
+	f, ok := u.inflight[key]
+	if ok {
+		u.lock.Unlock()
+		<-f.done
+		return f.found, f.err
+	}
+	f = &upstreamFetch{done: make(chan bool)}
+	u.inflight[key] = f
+	u.lock.Unlock()
+
+	start := time.Now()
+	f.found, f.err = u.fetch(ns, uuidAndHash)
+	upstream_duration.WithLabelValues(ns).Observe(time.Now().Sub(start).Seconds())
+
+	u.lock.Lock()
+	delete(u.inflight, key)
+	u.lock.Unlock()
+	close(f.done)
+
+	return f.found, f.err
+}
+
+// Fetch all kinds of an entry from upstream and store the ones found locally.
+// The upstream may have closed idle connections, so failures on one are
+// retried once on a new connection.
+func (u *Upstream) fetch(ns string, uuidAndHash []byte) (map[Kind]bool, error) {
+	conn, pooled, err := u.getConn()
+	if err != nil {
+		return nil, err
+	}
+
+	tx := u.Cacher.PutTransaction(ns, uuidAndHash)
+	found, err := u.fetchInto(tx, conn, ns, uuidAndHash)
+	if err != nil && pooled {
+		tx.Abort()
+		if conn, err = dialServer(u.Address, u.Timeout); err != nil {
+			return nil, err
+		}
+		tx = u.Cacher.PutTransaction(ns, uuidAndHash)
+		found, err = u.fetchInto(tx, conn, ns, uuidAndHash)
+	}
+	if err != nil {
+		tx.Abort()
+		return nil, err
+	}
+	u.putConn(conn)
+
+	if len(found) == 0 {
+		tx.Abort()
+		return found, nil
+	}
+
+	return found, tx.Commit()
+}
+
+// Get all kinds of an entry on a connection, putting the ones found in the
+// transaction. The connection is closed on errors.
+func (u *Upstream) fetchInto(tx Transaction, conn *serverConn, ns string, uuidAndHash []byte) (map[Kind]bool, error) {
+	kinds := []Kind{KIND_ASSET, KIND_INFO, KIND_RESOURCE}
+	found := make(map[Kind]bool)
+
+	conn.SetDeadline(time.Now().Add(u.Timeout))
+	for _, kind := range kinds {
+		conn.enc.Encode(protocol.Get{Kind: kind, UuidAndHash: uuidAndHash})
+	}
+	if err := conn.w.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	for range kinds {
+		conn.SetDeadline(time.Now().Add(u.Timeout))
+		kind, size, hit, err := conn.readGetResponse(uuidAndHash)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if !hit {
+			continue
+		}
+
+		body := &deadlineReader{r: conn.dec.Payload(), conn: conn, timeout: u.Timeout}
+
+		// Skip over things we don't want to keep around
+		if u.MaxSize > 0 && size > u.MaxSize {
+			if _, err := io.Copy(ioutil.Discard, body); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			continue
+		}
+
+		if err := tx.Put(size, kind, body); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		found[kind] = true
+		upstream_bytes.WithLabelValues(ns, string(kind)).Add(float64(size))
+	}
+	return found, nil
+}
+
+// An idle connection, or a new one. Returns whether the connection was idle.
+func (u *Upstream) getConn() (*serverConn, bool, error) {
+	select {
+	case conn := <-u.conns:
+		return conn, true, nil
+	default:
+	}
+	conn, err := dialServer(u.Address, u.Timeout)
+	return conn, false, err
+}
+
+func (u *Upstream) putConn(conn *serverConn) {
+	select {
+	case u.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Minimal cache server answering get-requests from a map of kind => data
+func fakeUpstream(t *testing.T, data map[Kind][]byte) (string, func()) {
+	var gets int64
+	return fakeUpstreamCounting(t, data, &gets)
+}
+
+// As fakeUpstream, counting the get-requests it answers
+func fakeUpstreamCounting(t *testing.T, data map[Kind][]byte, gets *int64) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				version := make([]byte, 8)
+				if _, err := io.ReadFull(conn, version); err != nil {
+					return
+				}
+				conn.Write(version)
+
+				for {
+					cmd := make([]byte, 2+32)
+					if _, err := io.ReadFull(conn, cmd); err != nil {
+						return
+					}
+					kind, uuidAndHash := Kind(cmd[1]), cmd[2:]
+					atomic.AddInt64(gets, 1)
+					if d, ok := data[kind]; ok {
+						fmt.Fprintf(conn, "+%c%016x%s%s", kind, len(d), uuidAndHash, d)
+					} else {
+						fmt.Fprintf(conn, "-%c%s", kind, uuidAndHash)
+					}
+				}
+			}(conn)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+func TestUpstreamReadThrough(t *testing.T) {
+	address, closer := fakeUpstream(t, map[Kind][]byte{
+		KIND_INFO:  []byte("info"),
+		KIND_ASSET: []byte("asset"),
+	})
+	defer closer()
+
+	local := NewMemory(1e6)
+	u := NewUpstream(local, address)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	// Fetched from upstream...
+	testCacheHit(t, u, "up", KIND_INFO, key, []byte("info"))
+
+	// ... and the other kinds stored locally along with it
+	testCacheHit(t, local, "up", KIND_ASSET, key, []byte("asset"))
+
+	// Misses upstream are misses locally
+	hit, _, err := readFromCache(u, "up", KIND_RESOURCE, key)
+	if err != nil || hit {
+		t.Errorf("Expected miss and no error, got hit=%t, err=%s", hit, err)
+	}
+}
+
+func TestUpstreamRetriesClosedConnection(t *testing.T) {
+	address, closer := fakeUpstream(t, map[Kind][]byte{KIND_INFO: []byte("info")})
+	defer closer()
+
+	u := NewUpstream(NewMemory(1e6), address)
+	key := make([]byte, 32)
+	rand.Read(key)
+	testCacheHit(t, u, "up", KIND_INFO, key, []byte("info"))
+
+	// Idle connections may be gone by the time they're used again
+	conn := <-u.conns
+	conn.Close()
+	u.conns <- conn
+
+	rand.Read(key)
+	testCacheHit(t, u, "up", KIND_INFO, key, []byte("info"))
+}
+
+func TestUpstreamMaxSize(t *testing.T) {
+	address, closer := fakeUpstream(t, map[Kind][]byte{
+		KIND_INFO:  []byte("info"),
+		KIND_ASSET: bytes.Repeat([]byte("x"), 100),
+	})
+	defer closer()
+
+	u := NewUpstream(NewMemory(1e6), address, func(u *Upstream) { u.MaxSize = 10 })
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	hit, _, err := readFromCache(u, "up", KIND_ASSET, key)
+	if err != nil || hit {
+		t.Errorf("Expected oversized entry to miss, got hit=%t, err=%s", hit, err)
+	}
+
+	// Connection is still usable after skipping the large entry
+	testCacheHit(t, u, "up", KIND_INFO, key, []byte("info"))
+}
+
+func TestUpstreamUnavailable(t *testing.T) {
+	u := NewUpstream(NewMemory(1e6), "127.0.0.1:1", func(u *Upstream) { u.Timeout = time.Second })
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	size, reader, err := u.Get("up", KIND_INFO, key)
+	if err == nil {
+		t.Errorf("Expected error when upstream is unavailable")
+	}
+	if size != 0 || reader != nil {
+		t.Errorf("Expected no data, got size=%d, reader=%+v", size, reader)
+	}
+}
+
+func TestUpstreamSharesConcurrentFetches(t *testing.T) {
+	var gets int64
+	address, closer := fakeUpstreamCounting(t, map[Kind][]byte{
+		KIND_INFO:  []byte("info"),
+		KIND_ASSET: []byte("asset"),
+	}, &gets)
+	defer closer()
+
+	u := NewUpstream(NewMemory(1e6), address)
+
+	key := make([]byte, 32)
+	rand.Read(key)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testCacheHit(t, u, "up", KIND_INFO, key, []byte("info"))
+		}()
+	}
+	wg.Wait()
+
+	// A fetch asks for all three kinds. Gets arriving after it finished
+	// are local hits, so there should only have been one, or rarely two
+	// if a get missed locally just before the first fetch finished.
+	if n := atomic.LoadInt64(&gets); n != 3 && n != 6 {
+		t.Errorf("Expected a single fetch of 3 kinds upstream, got %d gets", n)
+	}
+}
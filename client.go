@@ -1,9 +1,10 @@
 package ucs
 
 import (
-	"fmt"
 	"io"
 	"strings"
+
+	"github.com/msiebuhr/ucs/protocol"
 )
 
 // PUT Objects. A plain reader, but we need a size up-front.
@@ -36,44 +37,47 @@ type putRequest struct {
 }
 
 func (p putRequest) WriteTo(w io.Writer) (int64, error) {
-	var written int64 = 0
-	n, err := fmt.Fprintf(w, "ts%s", p.uuidAndHash)
-	written += int64(n)
-	if err != nil {
-		return written, err
-	}
+	cw := &countingWriter{w: w}
+	enc := protocol.NewEncoder(cw)
 
-	if p.info != nil {
-		fmt.Fprintf(w, "pi%016x", p.info.size)
-		n64, err := io.Copy(w, p.info.r)
-		written += n64
-		if err != nil {
-			return written, err
-		}
-		// TODO: Err handling
+	if err := enc.Encode(protocol.TxStart{UuidAndHash: p.uuidAndHash}); err != nil {
+		return cw.n, err
 	}
 
-	if p.asset != nil {
-		fmt.Fprintf(w, "pa%016x", p.asset.size)
-		n64, err := io.Copy(w, p.asset.r)
-		written += n64
-		if err != nil {
-			return written, err
-		}
-		// TODO: Err handling
+	puts := []struct {
+		kind   protocol.Kind
+		object *PutObject
+	}{
+		{protocol.KIND_INFO, p.info},
+		{protocol.KIND_ASSET, p.asset},
+		{protocol.KIND_RESOURCE, p.resource},
 	}
-
-	if p.resource != nil {
-		fmt.Fprintf(w, "pr%016x", p.resource.size)
-		n64, err := io.Copy(w, p.resource.r)
-		written += n64
-		if err != nil {
-			return written, err
+	for _, put := range puts {
+		if put.object == nil {
+			continue
+		}
+		if err := enc.Encode(protocol.Put{Kind: put.kind, Size: int64(put.object.size)}); err != nil {
+			return cw.n, err
+		}
+		// Sending less than promised would make the server read the
+		// following commands as data
+		if _, err := io.CopyN(cw, put.object.r, int64(put.object.size)); err != nil {
+			return cw.n, err
 		}
-		// TODO: Err handling
 	}
 
-	n, err = fmt.Fprintf(w, "te")
-	written += int64(n)
-	return written, err
+	err := enc.Encode(protocol.TxEnd{})
+	return cw.n, err
+}
+
+// Counts bytes written
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
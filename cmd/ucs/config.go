@@ -0,0 +1,468 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/msiebuhr/ucs"
+	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/config"
+	"github.com/msiebuhr/ucs/customflags"
+
+	"github.com/namsral/flag"
+)
+
+// What the configuration file sets that has no flags
+var (
+	fileConfig    *config.Config
+	fileListeners []listenerSpec
+)
+
+// Flags as given on the command line or as environment variables, before the
+// configuration file was applied, so it can be re-applied when reloading
+var (
+	explicitFlags   map[string]bool
+	givenNsFlags    map[*customflags.NamespaceValues]customflags.NamespaceValues
+	nsFlagsFromFile = []*customflags.NamespaceValues{
+		upstreams, mirrors, reliability, parents, promoteFromParents, readAllow, writeAllow, readOnly,
+		tlsCerts, tlsKeys, maxNsConns, nsQuotas, nsMinQuotas,
+		retireAfter, nsBytesPerSec, nsCommandsPerSec, clientBytesPerSec, clientCommandsPerSec,
+		uploadRates, clientUploadRates,
+	}
+)
+
+// Fill in flags from the configuration file. Flags given on the command line
+// or as environment variables take precedence; for per-namespace flags, that
+// is per namespace.
+func applyConfig(c *config.Config) error {
+	explicitFlags = map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicitFlags[f.Name] = true })
+	givenNsFlags = map[*customflags.NamespaceValues]customflags.NamespaceValues{}
+	for _, values := range nsFlagsFromFile {
+		given := customflags.NamespaceValues{}
+		for ns, value := range *values {
+			given[ns] = value
+		}
+		givenNsFlags[values] = given
+	}
+
+	var err error
+	set := func(name, value string) {
+		if value == "" || explicitFlags[name] || err != nil {
+			return
+		}
+		if setErr := flag.Set(name, value); setErr != nil {
+			err = fmt.Errorf("%s: %w", name, setErr)
+		}
+	}
+	setInt := func(name string, value int64) {
+		if value != 0 {
+			set(name, strconv.FormatInt(value, 10))
+		}
+	}
+
+	set("http-address", c.HTTP.Address)
+	if c.Log.Verbose {
+		set("verbose", "true")
+	}
+	set("cache-backend", c.Backend.Type)
+	set("cache-path", c.Backend.Path)
+	set("quota", c.Backend.Quota)
+	set("mismatch-policy", c.Backend.MismatchPolicy)
+	set("upstream-timeout", c.Upstream.Timeout)
+	set("upstream-max-size", c.Upstream.MaxSize)
+	set("mirror-spool-path", c.Mirror.SpoolPath)
+	set("retire-archive-path", c.Retirement.ArchivePath)
+
+	l := c.Limits
+	setInt("max-connections", int64(l.MaxConnections))
+	set("handshake-timeout", l.HandshakeTimeout)
+	set("idle-timeout", l.IdleTimeout)
+	set("max-session-time", l.MaxSessionTime)
+	set("shutdown-timeout", l.ShutdownTimeout)
+	set("upgrade-timeout", l.UpgradeTimeout)
+	setInt("get-window", int64(l.GetWindow))
+	set("put-yield", l.PutYield)
+	set("max-asset-size", l.MaxAssetSize)
+	set("max-info-size", l.MaxInfoSize)
+	set("max-resource-size", l.MaxResourceSize)
+	set("max-transaction-size", l.MaxTransactionSize)
+	set("max-bytes-per-second", l.MaxBytesPerSecond)
+	setInt("max-commands-per-second", l.MaxCommandsPerSecond)
+	if err != nil {
+		return err
+	}
+
+	applyNamespaceConfig(c)
+	return nil
+}
+
+// Fill in the per-namespace flags and listeners from the configuration file,
+// starting over from the flags as given. This is all a reload changes.
+func applyNamespaceConfig(c *config.Config) {
+	for values, given := range givenNsFlags {
+		for ns := range *values {
+			delete(*values, ns)
+		}
+		for ns, value := range given {
+			(*values)[ns] = value
+		}
+	}
+	setNs := func(values *customflags.NamespaceValues, ns, value string) {
+		if _, ok := (*values)[ns]; !ok {
+			(*values)[ns] = value
+		}
+	}
+
+	for _, client := range c.Limits.Clients {
+		if client.MaxBytesPerSecond != "" {
+			setNs(clientBytesPerSec, client.Network, client.MaxBytesPerSecond)
+		}
+		if client.MaxCommandsPerSecond != 0 {
+			setNs(clientCommandsPerSec, client.Network, strconv.FormatInt(client.MaxCommandsPerSecond, 10))
+		}
+		if client.UploadRate != "" {
+			setNs(clientUploadRates, client.Network, client.UploadRate)
+		}
+	}
+
+	// Namespace defaults go where flags put theirs
+	namespaces := map[string]config.Namespace{"": c.NamespaceDefaults}
+	for ns, settings := range c.Namespaces {
+		namespaces[ns] = settings
+	}
+	for ns, n := range namespaces {
+		if n.Upstream != "" {
+			setNs(upstreams, ns, n.Upstream)
+		}
+		if n.Mirrors != nil {
+			setNs(mirrors, ns, strings.Join(n.Mirrors, ";"))
+		}
+		if n.Reliability != nil {
+			setNs(reliability, ns, strconv.Itoa(*n.Reliability))
+		}
+		if n.Parents != nil {
+			setNs(parents, ns, strings.Join(n.Parents, ";"))
+		}
+		if n.RetireAfter != "" {
+			setNs(retireAfter, ns, n.RetireAfter)
+		}
+		if n.PromoteFromParents != nil {
+			setNs(promoteFromParents, ns, strconv.FormatBool(*n.PromoteFromParents))
+		}
+		if n.ReadAllow != nil {
+			setNs(readAllow, ns, strings.Join(n.ReadAllow, ";"))
+		}
+		if n.WriteAllow != nil {
+			setNs(writeAllow, ns, strings.Join(n.WriteAllow, ";"))
+		}
+		if n.ReadOnly != nil {
+			setNs(readOnly, ns, strconv.FormatBool(*n.ReadOnly))
+		}
+		if n.TLSCert != "" {
+			setNs(tlsCerts, ns, n.TLSCert)
+		}
+		if n.TLSKey != "" {
+			setNs(tlsKeys, ns, n.TLSKey)
+		}
+		if n.MaxConnections != nil {
+			setNs(maxNsConns, ns, strconv.Itoa(*n.MaxConnections))
+		}
+		if n.Quota != "" {
+			setNs(nsQuotas, ns, n.Quota)
+		}
+		if n.MinQuota != "" {
+			setNs(nsMinQuotas, ns, n.MinQuota)
+		}
+		if n.MaxBytesPerSecond != "" {
+			setNs(nsBytesPerSec, ns, n.MaxBytesPerSecond)
+		}
+		if n.MaxCommandsPerSecond != nil {
+			setNs(nsCommandsPerSec, ns, strconv.FormatInt(*n.MaxCommandsPerSecond, 10))
+		}
+		if n.UploadRate != "" {
+			setNs(uploadRates, ns, n.UploadRate)
+		}
+	}
+
+	// Listeners given as flags replace all of the file's
+	fileListeners = nil
+	if !explicitFlags["port"] && !explicitFlags["tls-port"] && !explicitFlags["unix-socket"] {
+		names := make([]string, 0, len(c.Namespaces))
+		for ns := range c.Namespaces {
+			names = append(names, ns)
+		}
+		sort.Strings(names)
+		for _, ns := range names {
+			for _, l := range c.Namespaces[ns].Listen {
+				fileListeners = append(fileListeners, specFor(ns, l))
+			}
+		}
+	}
+
+	fileConfig = c
+}
+
+// Trusted proxies for an address given with -port or -tls-port, which may be
+// given for the address or just its port
+func trustedProxiesFor(address string) string {
+	if proxies, ok := (*trustedProxies)[address]; ok {
+		return proxies
+	}
+	_, port, _ := net.SplitHostPort(address)
+	return trustedProxies.Get(port)
+}
+
+// Listeners given with -port, -tls-port and -unix-socket
+func flagListeners() []listenerSpec {
+	specs := []listenerSpec{}
+	for address, ns := range *ports {
+		specs = append(specs, listenerSpec{
+			namespace:      ns,
+			address:        address,
+			trustedProxies: trustedProxiesFor(address),
+		})
+	}
+	for address, ns := range *tlsPorts {
+		specs = append(specs, listenerSpec{
+			namespace:      ns,
+			address:        address,
+			tls:            true,
+			trustedProxies: trustedProxiesFor(address),
+		})
+	}
+	for ns, path := range *unixSockets {
+		if ns == "" {
+			ns = "default"
+		}
+		specs = append(specs, listenerSpec{namespace: ns, address: "unix:" + path})
+	}
+	return specs
+}
+
+// A namespace's own backend from the configuration file, with what it leaves
+// out taken from the shared backend's flags. Nil if it uses the shared one.
+func backendFor(ns string) *config.Backend {
+	var b config.Backend
+	if fileConfig != nil && fileConfig.Namespaces[ns].Backend != nil {
+		b = *fileConfig.Namespaces[ns].Backend
+	}
+
+	// Unlike other per-namespace flags, these have no default for all
+	// namespaces, as they'd all share it
+	typ, typeGiven := (*nsCacheBackends)[ns]
+	path, pathGiven := (*nsCachePaths)[ns]
+	if !typeGiven && !pathGiven && b == (config.Backend{}) {
+		return nil
+	}
+	if typeGiven {
+		b.Type = typ
+	}
+	if pathGiven {
+		b.Path = path
+	}
+	if b.Type == "" {
+		b.Type = cacheBackend
+	}
+	if b.Quota == "" {
+		b.Quota = quota.String()
+	}
+	if b.MismatchPolicy == "" {
+		b.MismatchPolicy = mismatchPolicy
+	}
+	return &b
+}
+
+// Settings for a namespace's server, parsed from the per-namespace flags
+type namespaceSettings struct {
+	readACL        ucs.ACL
+	writeACL       ucs.ACL
+	readOnly       bool
+	maxConnections int
+	reliability    int
+	parents        []string
+	promote        bool
+	retireAfter    time.Duration
+	quota          int64
+	minQuota       int64
+}
+
+func settingsFor(ns string) (namespaceSettings, error) {
+	var s namespaceSettings
+	var err error
+
+	if s.readACL, err = ucs.ParseACL(readAllow.Get(ns)); err != nil {
+		return s, fmt.Errorf("Invalid -read-allow: %w", err)
+	}
+	if s.writeACL, err = ucs.ParseACL(writeAllow.Get(ns)); err != nil {
+		return s, fmt.Errorf("Invalid -write-allow: %w", err)
+	}
+	if value := readOnly.Get(ns); value != "" {
+		if s.readOnly, err = strconv.ParseBool(value); err != nil {
+			return s, fmt.Errorf("Invalid -read-only: %w", err)
+		}
+	}
+	if value := maxNsConns.Get(ns); value != "" {
+		if s.maxConnections, err = strconv.Atoi(value); err != nil {
+			return s, fmt.Errorf("Invalid -max-namespace-connections: %w", err)
+		}
+	}
+	if value := reliability.Get(ns); value != "" {
+		if s.reliability, err = strconv.Atoi(value); err != nil {
+			return s, fmt.Errorf("Invalid -reliability: %w", err)
+		}
+	}
+	if value := parents.Get(ns); value != "" {
+		for _, parent := range strings.Split(value, ";") {
+			if parent == ns {
+				continue
+			}
+			if err := config.ValidNamespace(parent); err != nil {
+				return s, fmt.Errorf("Invalid -parents: %w", err)
+			}
+			s.parents = append(s.parents, parent)
+		}
+	}
+	if value := retireAfter.Get(ns); value != "" {
+		if s.retireAfter, err = time.ParseDuration(value); err != nil {
+			return s, fmt.Errorf("Invalid -retire-after: %w", err)
+		}
+	}
+	if value := promoteFromParents.Get(ns); value != "" {
+		if s.promote, err = strconv.ParseBool(value); err != nil {
+			return s, fmt.Errorf("Invalid -promote-from-parents: %w", err)
+		}
+	}
+
+	bytes := func(flagName string, values *customflags.NamespaceValues) (int64, error) {
+		size := customflags.NewSize(0)
+		if value := values.Get(ns); value != "" {
+			if err := size.Set(value); err != nil {
+				return 0, fmt.Errorf("Invalid -%s: %w", flagName, err)
+			}
+		}
+		return size.Int64(), nil
+	}
+	if s.quota, err = bytes("namespace-quota", nsQuotas); err != nil {
+		return s, err
+	}
+	if s.minQuota, err = bytes("namespace-min-quota", nsMinQuotas); err != nil {
+		return s, err
+	}
+
+	return s, nil
+}
+
+// Check the flags and configuration file, as far as can be done without
+// binding anything
+func checkSettings() error {
+	if _, err := cache.ParseMismatchPolicy(mismatchPolicy); err != nil {
+		return err
+	}
+	if cacheBackend != "fs" && cacheBackend != "memory" {
+		return fmt.Errorf("Unknown backend '%s'", cacheBackend)
+	}
+
+	limits, err := rateLimits()
+	if err != nil {
+		return err
+	}
+	if _, err := ucs.NewRateLimiter(limits); err != nil {
+		return fmt.Errorf("Invalid rate limits: %w", err)
+	}
+
+	// Every namespace mentioned, and the defaults
+	namespaces := map[string]bool{"": true}
+	tlsNamespaces := map[string]bool{}
+	for _, l := range append(flagListeners(), fileListeners...) {
+		if err := config.ValidNamespace(l.namespace); err != nil {
+			return err
+		}
+		namespaces[l.namespace] = true
+		if l.tls {
+			tlsNamespaces[l.namespace] = true
+		}
+		if _, err := ucs.ParseACL(l.trustedProxies); err != nil {
+			return fmt.Errorf("Namespace '%s': Invalid trusted proxies for %s: %w", l.namespace, l.address, err)
+		}
+	}
+	if fileConfig != nil {
+		for ns := range fileConfig.Namespaces {
+			namespaces[ns] = true
+		}
+	}
+	for _, values := range []*customflags.NamespaceValues{nsCacheBackends, nsCachePaths} {
+		for ns := range *values {
+			if ns == "" {
+				return fmt.Errorf("Own cache backends must be given per namespace, ex. name=memory")
+			}
+			namespaces[ns] = true
+		}
+	}
+
+	// FS backends can't share a path, as their GC would delete each
+	// other's files
+	paths := map[string]string{}
+	if cacheBackend == "fs" {
+		path, err := filepath.Abs(fsCacheBasepath)
+		if err != nil {
+			return err
+		}
+		paths[path] = "the shared backend"
+	}
+
+	// Minimums kept in the shared backend must fit in its quota
+	var reserved int64
+	for ns := range namespaces {
+		settings, err := settingsFor(ns)
+		if err != nil {
+			return fmt.Errorf("Namespace '%s': %w", ns, err)
+		}
+		if b := backendFor(ns); b != nil {
+			if _, err := cache.ParseMismatchPolicy(b.MismatchPolicy); err != nil {
+				return fmt.Errorf("Namespace '%s': %w", ns, err)
+			}
+			switch b.Type {
+			case "memory":
+			case "fs":
+				if b.Path == "" {
+					return fmt.Errorf("Namespace '%s': FS backend needs a path", ns)
+				}
+				path, err := filepath.Abs(b.Path)
+				if err != nil {
+					return fmt.Errorf("Namespace '%s': %w", ns, err)
+				}
+				if other, ok := paths[path]; ok {
+					return fmt.Errorf("Namespace '%s': Cache path %s is already used by %s", ns, b.Path, other)
+				}
+				paths[path] = fmt.Sprintf("namespace '%s'", ns)
+			default:
+				return fmt.Errorf("Namespace '%s': Unknown backend '%s'", ns, b.Type)
+			}
+		} else if ns != "" {
+			reserved += settings.minQuota
+		}
+	}
+	if reserved > quota.Int64() {
+		return fmt.Errorf("Namespace minimum quotas add up to %s, more than the quota of %s", customflags.NewSize(reserved), quota)
+	}
+
+	reloaders := make(map[string]*ucs.CertReloader)
+	for ns := range tlsNamespaces {
+		if _, err := tlsConfigFor(ns, reloaders); err != nil {
+			return fmt.Errorf("Namespace '%s': %w", ns, err)
+		}
+	}
+	for _, value := range *trustedProxies {
+		if _, err := ucs.ParseACL(value); err != nil {
+			return fmt.Errorf("Invalid -trusted-proxies: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -11,74 +13,454 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/msiebuhr/ucs"
 	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/config"
 	"github.com/msiebuhr/ucs/customflags"
 	"github.com/msiebuhr/ucs/frontend"
+	"github.com/msiebuhr/ucs/systemd"
 
 	"github.com/namsral/flag"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	cacheBackend    string
-	fsCacheBasepath string
-	HTTPAddress     string
-	quota           = customflags.NewSize(1024 * 1024 * 1024)
-	verbose         bool
-	ports           = &customflags.Namespaces{}
+	configFile           string
+	checkConfig          bool
+	cacheBackend         string
+	fsCacheBasepath      string
+	HTTPAddress          string
+	quota                = customflags.NewSize(1024 * 1024 * 1024)
+	verbose              bool
+	ports                = &customflags.Namespaces{}
+	tlsPorts             = &customflags.Namespaces{}
+	tlsCerts             = &customflags.NamespaceValues{}
+	tlsKeys              = &customflags.NamespaceValues{}
+	upstreams            = &customflags.NamespaceValues{}
+	upstreamTimeout      time.Duration
+	upstreamMaxSize      = customflags.NewSize(0)
+	mirrors              = &customflags.NamespaceValues{}
+	mirrorSpoolPath      string
+	upgradeTimeout       time.Duration
+	maxConnections       int
+	maxNsConns           = &customflags.NamespaceValues{}
+	handshakeTimeout     time.Duration
+	idleTimeout          time.Duration
+	maxSessionTime       time.Duration
+	shutdownTimeout      time.Duration
+	maxAssetSize         = customflags.NewSize(0)
+	maxInfoSize          = customflags.NewSize(0)
+	maxResourceSize      = customflags.NewSize(0)
+	maxTxSize            = customflags.NewSize(0)
+	getWindow            int
+	putYield             time.Duration
+	nsCacheBackends      = &customflags.NamespaceValues{}
+	nsCachePaths         = &customflags.NamespaceValues{}
+	nsQuotas             = &customflags.NamespaceValues{}
+	nsMinQuotas          = &customflags.NamespaceValues{}
+	maxBytesPerSec       = customflags.NewSize(0)
+	maxCommandsPerSec    int64
+	nsBytesPerSec        = &customflags.NamespaceValues{}
+	nsCommandsPerSec     = &customflags.NamespaceValues{}
+	clientBytesPerSec    = &customflags.NamespaceValues{}
+	clientCommandsPerSec = &customflags.NamespaceValues{}
+	uploadRates          = &customflags.NamespaceValues{}
+	clientUploadRates    = &customflags.NamespaceValues{}
+	reliability          = &customflags.NamespaceValues{}
+	parents              = &customflags.NamespaceValues{}
+	promoteFromParents   = &customflags.NamespaceValues{}
+	retireAfter          = &customflags.NamespaceValues{}
+	retireArchivePath    string
+	mismatchPolicy       string
+	readAllow            = &customflags.NamespaceValues{}
+	writeAllow           = &customflags.NamespaceValues{}
+	readOnly             = &customflags.NamespaceValues{}
+	trustedProxies       = &customflags.NamespaceValues{}
+	unixSockets          = &customflags.NamespaceValues{}
 )
 
 func init() {
+	flag.StringVar(&configFile, "config-file", "", "JSON configuration file, overridden by flags and environment variables (see config/example.json)")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check the configuration and exit")
 	flag.StringVar(&cacheBackend, "cache-backend", "fs", "Cache backend (fs or memory)")
 	flag.StringVar(&fsCacheBasepath, "cache-path", "./unity-cache", "Where FS cache should store data")
+	flag.Var(nsCacheBackends, "namespace-cache-backend", "Cache backend of a namespace's own, instead of the shared one (ex: hot=memory)")
+	flag.Var(nsCachePaths, "namespace-cache-path", "Where a namespace's own FS cache should store data (ex: zombie-zebras=/mnt/zz/unity-cache)")
 	flag.StringVar(&HTTPAddress, "http-address", ":9126", "Address and port for HTTP metrics/admin interface")
 	flag.BoolVar(&verbose, "verbose", false, "Spew more info")
 	flag.Var(quota, "quota", "Storage quota (ex. 10GB, 1TB, ...)")
-	flag.Var(ports, "port", "Namespaces/ports to open (ex: zombie-zebras:5000) May be used multiple times")
+	flag.Var(nsQuotas, "namespace-quota", "Most storage each namespace may use, optionally per namespace (ex: 20GB or zombie-zebras=50GB)")
+	flag.Var(nsMinQuotas, "namespace-min-quota", "Storage kept for each namespace when others need room, optionally per namespace (ex: 5GB or zombie-zebras=10GB)")
+	flag.Var(ports, "port", "Namespaces/ports to open, optionally on an address (ex: zombie-zebras:5000 or zombie-zebras:[fd00::1]:5000) May be used multiple times")
+	flag.Var(tlsPorts, "tls-port", "Namespaces/ports to open with TLS, optionally on an address (ex: zombie-zebras:5443 or zombie-zebras:10.0.0.1:5443) May be used multiple times")
+	flag.Var(tlsCerts, "tls-cert", "TLS certificate file, optionally per namespace (ex: cert.pem or zombie-zebras=zz.pem)")
+	flag.Var(tlsKeys, "tls-key", "TLS key file, optionally per namespace (ex: key.pem or zombie-zebras=zz-key.pem)")
+	flag.Var(upstreams, "upstream", "Upstream cache server to read misses through, optionally per namespace (ex: central:8126 or zombie-zebras=central:5000)")
+	flag.DurationVar(&upstreamTimeout, "upstream-timeout", 10*time.Second, "Timeout for upstream cache requests")
+	flag.Var(upstreamMaxSize, "upstream-max-size", "Largest object to fetch from upstream (ex. 100MB, 0 for no limit)")
+	flag.Var(mirrors, "mirror", "Cache servers to mirror uploads to, separated by ';', optionally per namespace (ex: backup:8126 or zombie-zebras=a:5000;b:5000)")
+	flag.Var(reliability, "reliability", "Identical uploads from different clients needed before storing, optionally per namespace (ex: 2 or zombie-zebras=3)")
+	flag.Var(parents, "parents", "Namespaces to answer misses from, in order, separated by ';', per namespace (ex: unity-2020=unity-2019;unity-2018)")
+	flag.Var(promoteFromParents, "promote-from-parents", "Copy entries found in parent namespaces into the namespace, optionally per namespace (ex: true or unity-2020=true)")
+	flag.Var(retireAfter, "retire-after", "Retire namespaces unused for this long, optionally per namespace (ex: 2160h or zombie-zebras=0 to keep it)")
+	flag.StringVar(&retireArchivePath, "retire-archive-path", "", "Move retired namespaces here instead of deleting them")
+	flag.StringVar(&mismatchPolicy, "mismatch-policy", "keep-last", "What to do when an entry is re-uploaded with different content (keep-last, keep-first or reject)")
+	flag.Var(readAllow, "read-allow", "Networks allowed to get, separated by ';', optionally per namespace (ex: 10.0.0.0/8 or zombie-zebras=10.1.0.0/16;10.2.0.1)")
+	flag.Var(writeAllow, "write-allow", "Networks allowed to upload, separated by ';', optionally per namespace (ex: 10.0.0.0/8 or zombie-zebras=10.9.0.0/16)")
+	flag.Var(readOnly, "read-only", "Discard all uploads, optionally per namespace (ex: true or zombie-zebras=true)")
+	flag.Var(trustedProxies, "trusted-proxies", "Proxies sending PROXY protocol headers, separated by ';', optionally per port or address (ex: 10.0.0.5, 8127=10.0.0.5;10.0.0.6 or [fd00::1]:8127=fd00::5)")
+	flag.Var(unixSockets, "unix-socket", "Unix sockets to listen on, per namespace (ex: zombie-zebras=/run/ucs/zz.sock)")
+	flag.StringVar(&mirrorSpoolPath, "mirror-spool-path", "", "Where to spool uploads for unavailable mirrors (disabled if empty)")
+	flag.IntVar(&maxConnections, "max-connections", 0, "Connections allowed at once across all namespaces (0 for no limit)")
+	flag.Var(maxNsConns, "max-namespace-connections", "Connections allowed at once, optionally per namespace (ex: 100 or zombie-zebras=20)")
+	flag.DurationVar(&handshakeTimeout, "handshake-timeout", 30*time.Second, "Time allowed for a new connection's handshake")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 5*time.Minute, "Time allowed between commands before closing a connection")
+	flag.DurationVar(&maxSessionTime, "max-session-time", 0, "Ask connections to finish up after this long (0 for no limit)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", time.Minute, "Time allowed for connections to finish up when stopping, before they are closed")
+	flag.Var(maxAssetSize, "max-asset-size", "Largest asset upload to accept (ex. 1GB, 0 for no limit)")
+	flag.Var(maxInfoSize, "max-info-size", "Largest info upload to accept (ex. 1MB, 0 for no limit)")
+	flag.Var(maxResourceSize, "max-resource-size", "Largest resource upload to accept (ex. 1GB, 0 for no limit)")
+	flag.Var(maxTxSize, "max-transaction-size", "Largest upload to accept for all kinds of an entry together (ex. 2GB, 0 for no limit)")
+	flag.IntVar(&getWindow, "get-window", 8, "Get requests to look up at once per connection")
+	flag.DurationVar(&putYield, "put-yield", 50*time.Millisecond, "Longest each chunk of an upload waits for gets to be looked up in the cache (0 to not prioritize gets)")
+	flag.Var(maxBytesPerSec, "max-bytes-per-second", "Bytes per second each way across all connections (ex. 100MB, 0 for no limit)")
+	flag.Int64Var(&maxCommandsPerSec, "max-commands-per-second", 0, "Commands per second across all connections (0 for no limit)")
+	flag.Var(nsBytesPerSec, "max-namespace-bytes-per-second", "Bytes per second each way, optionally per namespace (ex: 50MB or zombie-zebras=10MB)")
+	flag.Var(nsCommandsPerSec, "max-namespace-commands-per-second", "Commands per second, optionally per namespace (ex: 5000 or zombie-zebras=1000)")
+	flag.Var(clientBytesPerSec, "max-client-bytes-per-second", "Bytes per second each way for each client, optionally per network (ex: 10MB or 10.1.0.0/16=5MB)")
+	flag.Var(clientCommandsPerSec, "max-client-commands-per-second", "Commands per second for each client, optionally per network (ex: 1000 or 10.1.0.0/16=100)")
+	flag.Var(uploadRates, "upload-rate", "Upload bytes per second, optionally per namespace (ex: 100MB or zombie-zebras=10MB)")
+	flag.Var(clientUploadRates, "client-upload-rate", "Upload bytes per second for each client, optionally per network (ex: 10MB or 10.1.0.0/16=5MB)")
+	flag.DurationVar(&upgradeTimeout, "upgrade-timeout", 10*time.Minute, "How long to wait for a new process to be ready when upgrading on SIGUSR2")
+}
+
+// Load certificates for a namespace, re-using reloaders for shared files
+func tlsConfigFor(ns string, reloaders map[string]*ucs.CertReloader) (*tls.Config, error) {
+	certFile, keyFile := tlsCerts.Get(ns), tlsKeys.Get(ns)
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("No TLS certificate/key given for namespace '%s'", ns)
+	}
+
+	key := certFile + "\x00" + keyFile
+	if r, ok := reloaders[key]; ok {
+		return r.TLSConfig(), nil
+	}
+
+	r, err := ucs.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	reloaders[key] = r
+	return r.TLSConfig(), nil
+}
+
+// Put together rate limits from the flags
+func rateLimits() (ucs.RateLimits, error) {
+	limits := ucs.RateLimits{
+		Global:     ucs.Rate{Bytes: maxBytesPerSec.Int64(), Commands: maxCommandsPerSec},
+		Namespaces: map[string]ucs.Rate{},
+	}
+
+	size := func(values *customflags.NamespaceValues, key string) (int64, error) {
+		size := customflags.NewSize(0)
+		if value := values.Get(key); value != "" {
+			if err := size.Set(value); err != nil {
+				return 0, err
+			}
+		}
+		return size.Int64(), nil
+	}
+	rate := func(bytes, commands, uploads *customflags.NamespaceValues, key string) (ucs.Rate, error) {
+		var r ucs.Rate
+		var err error
+		if r.Bytes, err = size(bytes, key); err != nil {
+			return r, err
+		}
+		if r.Uploads, err = size(uploads, key); err != nil {
+			return r, err
+		}
+		if value := commands.Get(key); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return r, err
+			}
+			r.Commands = n
+		}
+		return r, nil
+	}
+	// Every key given for either kind of limit
+	keys := func(values ...*customflags.NamespaceValues) []string {
+		seen := map[string]bool{}
+		result := []string{}
+		for _, v := range values {
+			for key := range *v {
+				if !seen[key] {
+					seen[key] = true
+					result = append(result, key)
+				}
+			}
+		}
+		sort.Strings(result)
+		return result
+	}
+
+	for _, ns := range keys(nsBytesPerSec, nsCommandsPerSec, uploadRates) {
+		r, err := rate(nsBytesPerSec, nsCommandsPerSec, uploadRates, ns)
+		if err != nil {
+			return limits, fmt.Errorf("Invalid namespace rate for '%s': %s", ns, err)
+		}
+		if ns == "" {
+			limits.Namespace = r
+		} else {
+			limits.Namespaces[ns] = r
+		}
+	}
+
+	for _, network := range keys(clientBytesPerSec, clientCommandsPerSec, clientUploadRates) {
+		r, err := rate(clientBytesPerSec, clientCommandsPerSec, clientUploadRates, network)
+		if err != nil {
+			return limits, fmt.Errorf("Invalid client rate for '%s': %s", network, err)
+		}
+		if network == "" {
+			limits.Clients = append(limits.Clients, ucs.ClientRate{Network: "0.0.0.0/0", Rate: r}, ucs.ClientRate{Network: "::/0", Rate: r})
+		} else {
+			limits.Clients = append(limits.Clients, ucs.ClientRate{Network: network, Rate: r})
+		}
+	}
+
+	return limits, nil
+}
+
+// A namespace's own backend and the settings it was made from
+type ownBackend struct {
+	settings config.Backend
+	backend
+}
+
+// Whether two backend settings use the same storage, so one can be changed
+// into the other in place
+func sameBackend(a, b config.Backend) bool {
+	return a.Type == b.Type && a.Path == b.Path
+}
+
+// Release a backend no longer used
+func closeBackend(name string, c cache.Cacher) {
+	if closer, ok := c.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Printf("Closing backend of %s: %s", name, err)
+		}
+	}
+}
+
+// Set up a cache backend, named for metrics
+func newCache(name, backend, path string, quota int64, policy cache.MismatchPolicy) (cache.Cacher, error) {
+	cacheLog := log.New(os.Stdout, "cache: ", 0)
+
+	switch backend {
+	case "fs":
+		return cache.NewFS(func(f *cache.FS) {
+			f.Name = name
+			f.Quota = quota
+			f.Basepath = path
+			f.MismatchPolicy = policy
+			f.Log = cacheLog
+		})
+	case "memory":
+		return cache.NewMemory(quota, func(m *cache.Memory) {
+			m.Name = name
+			m.MismatchPolicy = policy
+			m.Log = cacheLog
+		}), nil
+	default:
+		return nil, fmt.Errorf("Unknown backend '%s'", backend)
+	}
 }
 
 func main() {
 	flag.Parse()
 
+	if configFile != "" {
+		c, err := config.Load(configFile)
+		if err != nil {
+			log.Fatalln("Config:", err)
+		}
+		if err := applyConfig(c); err != nil {
+			log.Fatalln("Config:", err)
+		}
+	}
+	if checkConfig {
+		if err := checkSettings(); err != nil {
+			log.Fatalln("Config:", err)
+		}
+		log.Println("Config OK")
+		return
+	}
+
+	// Sockets passed on by systemd, named after their namespaces
+	activated, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalln("Socket activation:", err)
+	}
+
+	// Sockets passed on by the process we're replacing when upgrading
+	inherited, err := inherit()
+	if err != nil {
+		log.Fatalln("Upgrade:", err)
+	}
+	for name, listeners := range inherited {
+		if strings.HasPrefix(name, "systemd:") {
+			ns := strings.TrimPrefix(name, "systemd:")
+			activated[ns] = append(activated[ns], listeners...)
+			delete(inherited, name)
+		}
+	}
+
 	// Set a defalt port if the user doesn't set anything
-	if len(*ports) == 0 {
+	if len(*ports) == 0 && len(*tlsPorts) == 0 && len(*unixSockets) == 0 && len(fileListeners) == 0 && len(activated) == 0 {
 		ports.Set("default:8126")
 	}
 	fsCacheBasepath, _ = filepath.Abs(fsCacheBasepath)
 
 	log.Printf(
-		"Starting quota=%s ports=%s httpAddress=%s fsCacheBasepath=%s\n",
-		quota, ports, HTTPAddress, fsCacheBasepath,
+		"Starting quota=%s ports=%s tlsPorts=%s unixSockets=%s activatedSockets=%d httpAddress=%s fsCacheBasepath=%s\n",
+		quota, ports, tlsPorts, unixSockets, len(activated), HTTPAddress, fsCacheBasepath,
 	)
 
-	// Figure out a cache
-	var c cache.Cacher
-	switch cacheBackend {
-	case "fs":
-		var err error
-		c, err = cache.NewFS(func(f *cache.FS) {
-			f.Quota = quota.Int64()
-			f.Basepath = fsCacheBasepath
-		})
-		if err != nil {
-			panic(err)
-		}
-	case "memory":
-		c = cache.NewMemory(quota.Int64())
-	default:
-		// UNKNOWN BACKEND - BAIL/CRASH/QUIT
-		panic("Unknown backend " + cacheBackend)
+	policy, err := cache.ParseMismatchPolicy(mismatchPolicy)
+	if err != nil {
+		log.Fatalln(err)
 	}
 
+	// Figure out a cache, shared by namespaces without one of their own
+	c, err := newCache("shared", cacheBackend, fsCacheBasepath, quota.Int64(), policy)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Namespaces with backends of their own are routed to them. Backends
+	// are kept when namespaces are restarted, and only replaced when their
+	// type or path changes.
+	router := cache.NewRouter(c)
+	ownBackends := map[string]ownBackend{}
+
 	// Create a server per namespace
-	servers := make([]*ucs.Server, 0, len(*ports))
-	for port, ns := range *ports {
-		server := ucs.NewServer(
-			func(s *ucs.Server) { s.Cache = c },
+	connectionManager := ucs.NewConnectionManager(maxConnections)
+	scheduler := ucs.NewScheduler(putYield)
+	limits, err := rateLimits()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	rateLimiter, err := ucs.NewRateLimiter(limits)
+	if err != nil {
+		log.Fatalln("Invalid rate limits:", err)
+	}
+	newNamespace := func(ns string) (*namespace, error) {
+		settings, err := settingsFor(ns)
+		if err != nil {
+			return nil, err
+		}
+		n := &namespace{}
+
+		if b := backendFor(ns); b != nil {
+			size := customflags.NewSize(0)
+			policy, err := cache.ParseMismatchPolicy(b.MismatchPolicy)
+			if err == nil {
+				err = size.Set(b.Quota)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Backend: %w", err)
+			}
+
+			own, ok := ownBackends[ns]
+			if ok && sameBackend(own.settings, *b) {
+				if own.quota != size.Int64() {
+					own.Cacher.(interface{ SetQuota(int64) }).SetQuota(size.Int64())
+				}
+				own.Cacher.(interface{ SetMismatchPolicy(cache.MismatchPolicy) }).SetMismatchPolicy(policy)
+				own.settings, own.quota = *b, size.Int64()
+			} else {
+				// The namespace using the old backend has been
+				// stopped by now; see namespaceManager.startAfter()
+				if ok {
+					delete(ownBackends, ns)
+					router.Route(ns, nil)
+					closeBackend(ns, own.Cacher)
+				}
+				c, err := newCache(ns, b.Type, b.Path, size.Int64(), policy)
+				if err != nil {
+					return nil, fmt.Errorf("Backend: %w", err)
+				}
+				own = ownBackend{*b, backend{c, size.Int64()}}
+				router.Route(ns, c)
+			}
+			ownBackends[ns] = own
+			n.backend = &own.backend
+			n.backendSettings = own.settings
+		} else if own, ok := ownBackends[ns]; ok {
+			delete(ownBackends, ns)
+			router.Route(ns, nil)
+			closeBackend(ns, own.Cacher)
+		}
+		router.SetNamespaceQuota(ns, cache.NamespaceQuota{Max: settings.quota, Min: settings.minQuota})
+
+		nsCache := cache.Cacher(router)
+		if len(settings.parents) > 0 {
+			nsCache = cache.NewFallback(nsCache, settings.parents, func(f *cache.Fallback) {
+				f.Promote = settings.promote
+			})
+		}
+		if address := upstreams.Get(ns); address != "" {
+			nsCache = cache.NewUpstream(nsCache, address, func(u *cache.Upstream) {
+				u.Timeout = upstreamTimeout
+				u.MaxSize = upstreamMaxSize.Int64()
+			})
+		}
+		if settings.reliability > 1 {
+			nsCache = cache.NewHighReliability(nsCache, settings.reliability)
+		}
+		if addresses := mirrors.Get(ns); addresses != "" {
+			n.mirror = cache.NewMirror(nsCache, strings.Split(addresses, ";"), func(m *cache.Mirror) {
+				m.Namespace = ns
+				m.Backend = router
+				if mirrorSpoolPath != "" {
+					m.SpoolDir = filepath.Join(mirrorSpoolPath, ns)
+				}
+			})
+			nsCache = n.mirror
+		}
+		n.server = ucs.NewServer(
+			func(s *ucs.Server) { s.Cache = nsCache },
+			func(s *ucs.Server) {
+				s.ReadACL = settings.readACL
+				s.WriteACL = settings.writeACL
+				s.ReadOnly = settings.readOnly
+			},
+			func(s *ucs.Server) {
+				s.MaxConnections = settings.maxConnections
+				s.ConnectionManager = connectionManager
+				s.HandshakeTimeout = handshakeTimeout
+				s.IdleTimeout = idleTimeout
+				s.MaxSessionTime = maxSessionTime
+				s.GetWindow = getWindow
+			},
+			func(s *ucs.Server) {
+				s.Scheduler = scheduler
+				s.RateLimiter = rateLimiter
+			},
+			func(s *ucs.Server) {
+				s.MaxPutSize = map[cache.Kind]int64{
+					cache.KIND_ASSET:    maxAssetSize.Int64(),
+					cache.KIND_INFO:     maxInfoSize.Int64(),
+					cache.KIND_RESOURCE: maxResourceSize.Int64(),
+				}
+				s.MaxTransactionSize = maxTxSize.Int64()
+			},
 			func(s *ucs.Server) {
 				if verbose {
 					s.Log = log.New(os.Stdout, "server: ", 0)
@@ -86,13 +468,36 @@ func main() {
 			},
 			func(s *ucs.Server) { s.Namespace = ns },
 		)
-		servers = append(servers, server)
-		go func(port uint) {
-			err := server.Listen(context.Background(), fmt.Sprintf(":%d", port))
+		return n, nil
+	}
+
+	// Everything is bound up front, so we know when we're ready to serve
+	namespaces := newNamespaceManager(backend{c, quota.Int64()}, newNamespace, inherited)
+	for _, spec := range append(flagListeners(), fileListeners...) {
+		if err := namespaces.listen(spec); err != nil {
 			log.Fatalln("Listen:", err)
-		}(port)
+		}
+	}
+	for ns, activatedListeners := range activated {
+		for _, listener := range activatedListeners {
+			if err := namespaces.serveActivated(ns, listener); err != nil {
+				log.Fatalln("Listen:", err)
+			}
+		}
 	}
 
+	// Retire namespaces by the settings of the moment, as reloads change them
+	retire := &retirement{
+		cache:   router,
+		archive: retireArchivePath,
+		started: time.Now(),
+		retireAfter: func(ns string) time.Duration {
+			settings, _ := namespaces.settingsFor(ns)
+			return settings.retireAfter
+		},
+	}
+	go retire.run()
+
 	// Set up web-server mux
 	mux := http.NewServeMux()
 
@@ -104,48 +509,24 @@ func main() {
 	mux.Handle("/debug/pprof/trace", http.HandlerFunc(pprof.Trace))
 
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/api/limits", rateLimiter)
+	mux.Handle("/api/namespaces", namespaces)
+	mux.Handle("/api/namespaces/", namespaces)
+	mux.Handle("/api/retirement", retire)
 	mux.Handle("/", http.FileServer(frontend.FS(false)))
 	mux.HandleFunc("/api/info", func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
 
-		// Figure out our IP
-		var ip net.IP
-		addrs, _ := net.InterfaceAddrs()
-		for _, addr := range addrs {
-			var i net.IP
-			switch v := addr.(type) {
-			case *net.IPNet:
-				i = v.IP
-			case *net.IPAddr:
-				i = v.IP
-			}
-			// Is this the right way to detect the IP?
-			if i.IsGlobalUnicast() {
-				ip = i
-				break
-			}
-		}
-
-		servers := map[string][]string{}
-		for port, ns := range *ports {
-			// Parse address to figure out what port/ip we're bound to
-			tcpAddr := net.TCPAddr{
-				IP:   ip,
-				Port: int(port),
-			}
-			if _, ok := servers[ns]; !ok {
-				servers[ns] = []string{}
-			}
-			servers[ns] = append(servers[ns], tcpAddr.String())
-		}
-
+		servers, tlsServers := namespaces.addresses()
 		data := struct {
 			QuotaBytes   int64
 			Servers      map[string][]string
+			TLSServers   map[string][]string
 			CacheBackend string
 		}{
 			QuotaBytes:   quota.Int64(),
 			Servers:      servers,
+			TLSServers:   tlsServers,
 			CacheBackend: cacheBackend,
 		}
 
@@ -155,26 +536,64 @@ func main() {
 
 	// Create the web-server itself
 	h := &http.Server{Addr: HTTPAddress, Handler: mux}
+	httpListener := inherited.take("http:" + HTTPAddress)
+	if httpListener == nil {
+		httpListener, err = net.Listen("tcp", HTTPAddress)
+		if err != nil {
+			log.Fatalln("ListenAndServe: ", err)
+		}
+	}
+	inherited.closeUnused()
 
 	// Start it
 	go func() {
-		if err := h.ListenAndServe(); err != nil {
+		if err := h.Serve(httpListener); err != http.ErrServerClosed {
 			log.Fatalln("ListenAndServe: ", err)
 		}
 	}()
 
-	// Handle SIGINT and SIGTERM.
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-	log.Println(<-ch)
+	go notifySystemd(namespaces)
+
+	// Handle SIGINT and SIGTERM, reload on SIGHUP and upgrade on SIGUSR2
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	for sig := range ch {
+		log.Println(sig)
+		if sig == syscall.SIGHUP {
+			if configFile == "" {
+				log.Println("Reload: No configuration file given")
+				continue
+			}
+			if err := namespaces.reload(configFile, rateLimiter); err != nil {
+				log.Println("Reload: Keeping the current configuration:", err)
+				continue
+			}
+			log.Println("Reload: Done")
+			continue
+		}
+		if sig != syscall.SIGUSR2 {
+			systemd.Notify("STOPPING=1")
+			break
+		}
+
+		handoff := append(namespaces.handoff(), namedListener{"http:" + HTTPAddress, httpListener})
+		pid, err := upgrade(handoff, upgradeTimeout)
+		if err != nil {
+			log.Println("Upgrade:", err)
+			continue
+		}
+		log.Printf("Upgrade: Handed over to pid=%d, finishing connections", pid)
+		systemd.Notify(fmt.Sprintf("MAINPID=%d", pid))
+		break
+	}
 
 	// Stop web interface gracefully
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	h.Shutdown(ctx)
 
-	// Stop the service gracefully.
-	for _, server := range servers {
-		server.Stop()
-	}
+	// Stop the service gracefully, giving connections a while to finish
+	ctx, cancel = context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	namespaces.shutdown(ctx)
 }
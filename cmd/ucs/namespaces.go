@@ -0,0 +1,787 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/msiebuhr/ucs"
+	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/config"
+	"github.com/msiebuhr/ucs/customflags"
+)
+
+// How to serve a namespace on an address
+type listenerSpec struct {
+	namespace string
+
+	// ex. ":8126", "10.0.0.1:8126" or "unix:/run/ucs/name.sock"
+	address string
+
+	tls bool
+
+	// Proxies sending PROXY protocol headers, separated by ';'
+	trustedProxies string
+}
+
+// A namespace being served
+type namespace struct {
+	server *ucs.Server
+
+	// The namespace's own backend, if it doesn't use the shared one, and
+	// what it was set up from
+	backend         *backend
+	backendSettings config.Backend
+
+	// Mirror to close once the server is stopped, if any
+	mirror *cache.Mirror
+
+	// Closed once stopped
+	stopped chan bool
+}
+
+type managedListener struct {
+	listenerSpec
+	options ucs.ListenOptions
+
+	// The bound socket, and the hold on it of the server currently serving
+	// it; nil while the namespace waits to start
+	socket net.Listener
+	handle *socketHandle
+}
+
+// Stop serving the listener and unbind it
+func (l *managedListener) close() {
+	if l.handle != nil {
+		l.handle.Close()
+	}
+	l.socket.Close()
+}
+
+// How long handing a socket over waits for the old server's accept loop
+const handoverTimeout = time.Second
+
+// A server's hold on a bound socket. Closing it leaves the socket open, so a
+// restarted namespace's new server can take over the socket from the old one
+// without it ever being unbound.
+type socketHandle struct {
+	net.Listener
+
+	lock     sync.Mutex
+	closed   bool
+	detached bool
+	// Closed once closed, and once Accept() has come round after detach()
+	done   chan bool
+	parked chan bool
+}
+
+func newSocketHandle(socket net.Listener) *socketHandle {
+	return &socketHandle{Listener: socket, done: make(chan bool), parked: make(chan bool)}
+}
+
+func (h *socketHandle) Accept() (net.Conn, error) {
+	h.lock.Lock()
+	closed, detached := h.closed, h.detached
+	if detached {
+		select {
+		case <-h.parked:
+		default:
+			close(h.parked)
+		}
+	}
+	h.lock.Unlock()
+
+	// Once detached, wait for the server to close it rather than spin
+	if detached {
+		<-h.done
+		return nil, net.ErrClosed
+	}
+	if closed {
+		return nil, net.ErrClosed
+	}
+	return h.Listener.Accept()
+}
+
+// Let the server go, leaving the socket open
+func (h *socketHandle) Close() error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.closed {
+		h.closed = true
+		close(h.done)
+		h.wake()
+	}
+	return nil
+}
+
+func (h *socketHandle) isClosed() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.closed
+}
+
+// Stop accepting connections for the server. Returns once its accept loop has
+// come round, so connections it accepted before are its to finish.
+func (h *socketHandle) detach() {
+	h.lock.Lock()
+	h.detached = true
+	h.lock.Unlock()
+
+	h.wake()
+	select {
+	case <-h.parked:
+	case <-h.done:
+	case <-time.After(handoverTimeout):
+	}
+}
+
+// Make accepts waiting on the socket return. Accept loops setting deadlines
+// take it as a timeout and come round again.
+func (h *socketHandle) wake() {
+	h.SetDeadline(time.Now())
+}
+
+func (h *socketHandle) SetDeadline(t time.Time) error {
+	if d, ok := h.Listener.(interface{ SetDeadline(time.Time) error }); ok {
+		return d.SetDeadline(t)
+	}
+	return nil
+}
+
+// The namespaces being served and their listeners. Namespaces can be added and
+// removed while running; a namespace is stopped once it has no listeners left.
+type namespaceManager struct {
+	lock sync.Mutex
+
+	shared       backend
+	newNamespace func(ns string) (*namespace, error)
+	namespaces   map[string]*namespace
+	listeners    []*managedListener
+
+	inherited inheritedListeners
+	reloaders map[string]*ucs.CertReloader
+
+	// Namespaces being stopped, all and by name
+	stopping sync.WaitGroup
+	draining map[string]*namespace
+
+	// Namespaces waiting for the one before them to stop, before starting
+	// on their listeners
+	starting map[string]bool
+}
+
+func newNamespaceManager(shared backend, newNamespace func(ns string) (*namespace, error), inherited inheritedListeners) *namespaceManager {
+	return &namespaceManager{
+		shared:       shared,
+		newNamespace: newNamespace,
+		namespaces:   make(map[string]*namespace),
+		inherited:    inherited,
+		reloaders:    make(map[string]*ucs.CertReloader),
+		draining:     make(map[string]*namespace),
+		starting:     make(map[string]bool),
+	}
+}
+
+// Bind an address and serve a namespace on it, starting the namespace if
+// needed
+func (m *namespaceManager) listen(spec listenerSpec) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for _, l := range m.listeners {
+		if l.address != spec.address {
+			continue
+		}
+		if l.namespace == spec.namespace {
+			return nil
+		}
+		return fmt.Errorf("%s is already used by namespace '%s'", spec.address, l.namespace)
+	}
+
+	proxies, err := ucs.ParseACL(spec.trustedProxies)
+	if err != nil {
+		return fmt.Errorf("Invalid trusted proxies for %s: %w", spec.address, err)
+	}
+	options := ucs.ListenOptions{TrustedProxies: proxies}
+	if spec.tls {
+		options.TLS, err = tlsConfigFor(spec.namespace, m.reloaders)
+		if err != nil {
+			return err
+		}
+	}
+
+	listener := m.inherited.take(spec.address)
+	if listener == nil {
+		listener, err = ucs.Bind(spec.address)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.serve(spec, listener, options); err != nil {
+		listener.Close()
+		return err
+	}
+	return nil
+}
+
+// Serve a namespace on a socket passed on by systemd
+func (m *namespaceManager) serveActivated(ns string, listener net.Listener) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.serve(listenerSpec{namespace: ns, address: "systemd:" + ns}, listener, ucs.ListenOptions{})
+}
+
+// Must be called with the lock held
+func (m *namespaceManager) serve(spec listenerSpec, listener net.Listener, options ucs.ListenOptions) error {
+	n := m.namespaces[spec.namespace]
+	if n == nil && !m.starting[spec.namespace] {
+		if old := m.replacedBackend(spec.namespace); old != nil {
+			m.startAfter(spec.namespace, old)
+		} else {
+			var err error
+			if n, err = m.start(spec.namespace); err != nil {
+				return err
+			}
+		}
+	}
+
+	l := &managedListener{listenerSpec: spec, socket: listener, options: options}
+	m.listeners = append(m.listeners, l)
+	if n != nil {
+		m.accept(n, l)
+	}
+	return nil
+}
+
+// Must be called with the lock held
+func (m *namespaceManager) start(ns string) (*namespace, error) {
+	n, err := m.newNamespace(ns)
+	if err != nil {
+		return nil, fmt.Errorf("Namespace '%s': %w", ns, err)
+	}
+	n.stopped = make(chan bool)
+	m.namespaces[ns] = n
+	log.Printf("Starting namespace %s", ns)
+	return n, nil
+}
+
+// Serve connections from a listener with a namespace's server. Must be called
+// with the lock held.
+func (m *namespaceManager) accept(n *namespace, l *managedListener) {
+	h := newSocketHandle(l.socket)
+	l.handle = h
+
+	go func() {
+		err := n.server.ListenerWith(context.Background(), h, l.options)
+		if err != nil && !h.isClosed() {
+			log.Fatalln("Listen:", err)
+		}
+	}()
+}
+
+// Stop serving a namespace on an address. A namespace left without listeners
+// is stopped.
+func (m *namespaceManager) unlisten(ns, address string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i, l := range m.listeners {
+		if l.namespace != ns || l.address != address {
+			continue
+		}
+		l.close()
+		m.listeners = append(m.listeners[:i], m.listeners[i+1:]...)
+
+		for _, other := range m.listeners {
+			if other.namespace == ns {
+				return nil
+			}
+		}
+		if _, ok := m.namespaces[ns]; ok {
+			m.stop(ns)
+		}
+		return nil
+	}
+	return fmt.Errorf("Namespace '%s' isn't served on %s", ns, address)
+}
+
+// Stop serving a namespace altogether
+func (m *namespaceManager) remove(ns string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	_, running := m.namespaces[ns]
+	if !running && !m.starting[ns] {
+		return fmt.Errorf("Unknown namespace '%s'", ns)
+	}
+
+	listeners := m.listeners[:0]
+	for _, l := range m.listeners {
+		if l.namespace == ns {
+			l.close()
+			continue
+		}
+		listeners = append(listeners, l)
+	}
+	m.listeners = listeners
+	if running {
+		m.stop(ns)
+	}
+	return nil
+}
+
+// Let a namespace's connections finish up in the background. Must be called
+// with the lock held.
+func (m *namespaceManager) stop(ns string) {
+	n := m.namespaces[ns]
+	delete(m.namespaces, ns)
+	log.Printf("Stopping namespace %s", ns)
+
+	m.draining[ns] = n
+	m.stopping.Add(1)
+	go func() {
+		defer m.stopping.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := n.server.Shutdown(ctx); err != nil {
+			log.Printf("Stopping namespace %s: %s", ns, err)
+		}
+		if n.mirror != nil {
+			n.mirror.Close()
+		}
+
+		m.lock.Lock()
+		if m.draining[ns] == n {
+			delete(m.draining, ns)
+		}
+		m.lock.Unlock()
+		close(n.stopped)
+	}()
+}
+
+// Whether starting a namespace with the current settings replaces the backend
+// n has of its own. Must be called with the lock held.
+func replacesBackend(ns string, n *namespace) bool {
+	if n.backend == nil {
+		return false
+	}
+	b := backendFor(ns)
+	return b == nil || !sameBackend(n.backendSettings, *b)
+}
+
+// The namespace being stopped whose backend starting it again would replace,
+// if any. Must be called with the lock held.
+func (m *namespaceManager) replacedBackend(ns string) *namespace {
+	if old, ok := m.draining[ns]; ok && replacesBackend(ns, old) {
+		return old
+	}
+	return nil
+}
+
+// Start a namespace on its listeners once old has stopped, so two backends
+// never use the same files at once. Until then, connections wait to be
+// accepted. Must be called with the lock held.
+func (m *namespaceManager) startAfter(ns string, old *namespace) {
+	m.starting[ns] = true
+	log.Printf("Waiting for namespace %s to stop before replacing its backend", ns)
+
+	go func() {
+		<-old.stopped
+
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.starting, ns)
+
+		waiting := []*managedListener{}
+		for _, l := range m.listeners {
+			if l.namespace == ns && l.handle == nil {
+				waiting = append(waiting, l)
+			}
+		}
+		if len(waiting) == 0 {
+			return
+		}
+
+		n, err := m.start(ns)
+		if err != nil {
+			log.Println("Listen:", err)
+			listeners := m.listeners[:0]
+			for _, l := range m.listeners {
+				if l.namespace == ns {
+					l.close()
+					continue
+				}
+				listeners = append(listeners, l)
+			}
+			m.listeners = listeners
+			return
+		}
+		for _, l := range waiting {
+			m.accept(n, l)
+		}
+	}()
+}
+
+// Stop all namespaces, giving connections until ctx expires to finish up
+func (m *namespaceManager) shutdown(ctx context.Context) {
+	m.lock.Lock()
+	namespaces := m.namespaces
+	m.namespaces = make(map[string]*namespace)
+	for _, l := range m.listeners {
+		l.close()
+	}
+	m.listeners = nil
+	m.lock.Unlock()
+
+	stopped := sync.WaitGroup{}
+	for ns, n := range namespaces {
+		stopped.Add(1)
+		go func(ns string, n *namespace) {
+			defer stopped.Done()
+			if err := n.server.Shutdown(ctx); err != nil {
+				log.Printf("Stopping namespace %s: %s", ns, err)
+			}
+		}(ns, n)
+	}
+	stopped.Wait()
+	m.stopping.Wait()
+
+	// Spool whatever mirrors haven't sent yet
+	for _, n := range namespaces {
+		if n.mirror != nil {
+			n.mirror.Close()
+		}
+	}
+}
+
+// The addresses each namespace is served on
+func (m *namespaceManager) list() map[string][]string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	namespaces := map[string][]string{}
+	for ns := range m.namespaces {
+		namespaces[ns] = []string{}
+	}
+	for _, l := range m.listeners {
+		namespaces[l.namespace] = append(namespaces[l.namespace], l.address)
+	}
+	for _, addresses := range namespaces {
+		sort.Strings(addresses)
+	}
+	return namespaces
+}
+
+func (m *namespaceManager) servers() map[string]*ucs.Server {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	servers := make(map[string]*ucs.Server, len(m.namespaces))
+	for ns, n := range m.namespaces {
+		servers[ns] = n.server
+	}
+	return servers
+}
+
+// The shared backend, and those of namespaces having their own
+func (m *namespaceManager) backends() []backend {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	backends := []backend{m.shared}
+	for _, n := range m.namespaces {
+		if n.backend != nil {
+			backends = append(backends, *n.backend)
+		}
+	}
+	return backends
+}
+
+// The addresses namespaces are bound to, ex. "[::]:8126" when listening on
+// all interfaces, without and with TLS
+func (m *namespaceManager) addresses() (map[string][]string, map[string][]string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	plain, secure := map[string][]string{}, map[string][]string{}
+	for _, l := range m.listeners {
+		addresses := plain
+		if l.options.TLS != nil {
+			addresses = secure
+		}
+		addr := l.socket.Addr()
+		address := addr.String()
+		if addr.Network() == "unix" {
+			address = "unix:" + address
+		}
+		addresses[l.namespace] = append(addresses[l.namespace], address)
+	}
+	for _, addresses := range []map[string][]string{plain, secure} {
+		for _, a := range addresses {
+			sort.Strings(a)
+		}
+	}
+	return plain, secure
+}
+
+func (m *namespaceManager) bound() []boundListener {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bound := make([]boundListener, 0, len(m.listeners))
+	for _, l := range m.listeners {
+		if l.handle != nil {
+			bound = append(bound, boundListener{l.handle, m.namespaces[l.namespace].server})
+		}
+	}
+	return bound
+}
+
+// Listeners to hand over when upgrading, named so the new process can find
+// them again
+func (m *namespaceManager) handoff() []namedListener {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	handoff := make([]namedListener, len(m.listeners))
+	for i, l := range m.listeners {
+		handoff[i] = namedListener{l.address, l.socket}
+	}
+	return handoff
+}
+
+// Admin API for namespaces:
+//
+//	GET    /api/namespaces       lists namespaces and their addresses
+//	PUT    /api/namespaces/<ns>  serves a namespace on exactly the listeners
+//	                             given, ex. {"listen": [{"address": ":8130"}]}
+//	DELETE /api/namespaces/<ns>  stops serving a namespace
+func (m *namespaceManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	ns := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/namespaces"), "/")
+	switch {
+	case ns == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+	case ns != "" && r.Method == http.MethodPut:
+		if err := config.ValidNamespace(ns); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var body struct {
+			Listen []config.Listener `json:"listen"`
+		}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(body.Listen) == 0 {
+			http.Error(w, "No listeners given", http.StatusBadRequest)
+			return
+		}
+
+		specs := make([]listenerSpec, len(body.Listen))
+		for i, l := range body.Listen {
+			specs[i] = specFor(ns, l)
+		}
+		if err := m.set(ns, specs); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	case ns != "" && r.Method == http.MethodDelete:
+		if err := m.remove(ns); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.list())
+}
+
+// Settings of a namespace, without racing reloads changing them
+func (m *namespaceManager) settingsFor(ns string) (namespaceSettings, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return settingsFor(ns)
+}
+
+// Serve a namespace on exactly the given listeners, keeping those it already
+// has
+func (m *namespaceManager) set(ns string, specs []listenerSpec) error {
+	wanted := map[string]bool{}
+	for _, spec := range specs {
+		if err := m.listen(spec); err != nil {
+			return err
+		}
+		wanted[spec.address] = true
+	}
+
+	for _, address := range m.list()[ns] {
+		if !wanted[address] {
+			if err := m.unlisten(ns, address); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func specFor(ns string, l config.Listener) listenerSpec {
+	return listenerSpec{
+		namespace:      ns,
+		address:        l.Address,
+		tls:            l.TLS,
+		trustedProxies: strings.Join(l.TrustedProxies, ";"),
+	}
+}
+
+// What a namespace's server is set up from, to tell if a reload changes it.
+// Must be called with the lock held, as reloading changes the flags.
+func (m *namespaceManager) fingerprint(ns string) string {
+	parts := []string{}
+	for _, values := range []*customflags.NamespaceValues{
+		upstreams, mirrors, reliability, parents, promoteFromParents, readAllow, writeAllow, readOnly,
+		tlsCerts, tlsKeys, maxNsConns, nsQuotas, nsMinQuotas,
+	} {
+		parts = append(parts, values.Get(ns))
+	}
+	if b := backendFor(ns); b != nil {
+		parts = append(parts, fmt.Sprintf("%+v", *b))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// Re-read the configuration file. Namespaces and listeners it adds are started,
+// those it removes are stopped, and namespaces whose settings changed are
+// restarted. Rate limits are updated if the file changes them. Listeners that
+// fail to start are logged, while an invalid file is rejected as a whole.
+func (m *namespaceManager) reload(path string, limiter *ucs.RateLimiter) error {
+	c, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+
+	m.lock.Lock()
+	oldConfig, oldListeners := fileConfig, fileListeners
+	oldLimits, _ := rateLimits()
+	before := map[string]string{}
+	for ns := range m.namespaces {
+		before[ns] = m.fingerprint(ns)
+	}
+
+	applyNamespaceConfig(c)
+	if err := checkSettings(); err != nil {
+		applyNamespaceConfig(oldConfig)
+		m.lock.Unlock()
+		return err
+	}
+
+	changed := []string{}
+	for ns, fingerprint := range before {
+		if m.fingerprint(ns) != fingerprint {
+			changed = append(changed, ns)
+		}
+	}
+	newListeners := fileListeners
+	m.lock.Unlock()
+
+	if limits, _ := rateLimits(); !reflect.DeepEqual(limits, oldLimits) {
+		if err := limiter.SetLimits(limits); err != nil {
+			log.Println("Reload: Rate limits:", err)
+		}
+	}
+
+	wanted := map[listenerSpec]bool{}
+	for _, spec := range newListeners {
+		wanted[spec] = true
+	}
+	for _, spec := range oldListeners {
+		if !wanted[spec] {
+			if err := m.unlisten(spec.namespace, spec.address); err != nil {
+				log.Println("Reload:", err)
+			}
+		}
+	}
+
+	sort.Strings(changed)
+	for _, ns := range changed {
+		if err := m.restart(ns); err != nil {
+			log.Printf("Reload: Restarting namespace %s: %s", ns, err)
+		}
+	}
+
+	had := map[listenerSpec]bool{}
+	for _, spec := range oldListeners {
+		had[spec] = true
+	}
+	for _, spec := range newListeners {
+		if !had[spec] {
+			if err := m.listen(spec); err != nil {
+				log.Printf("Reload: Namespace '%s': %s", spec.namespace, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Start a namespace again with the current settings. The new server takes
+// over the listeners before the old one is stopped, so they're never unbound,
+// and the old one keeps serving if the new one can't be started. A namespace
+// whose backend is replaced starts once the old one has stopped.
+func (m *namespaceManager) restart(ns string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	old, ok := m.namespaces[ns]
+	if !ok {
+		return nil
+	}
+
+	var n *namespace
+	if !replacesBackend(ns, old) {
+		var err error
+		if n, err = m.newNamespace(ns); err != nil {
+			return fmt.Errorf("Keeping the old settings: %w", err)
+		}
+		n.stopped = make(chan bool)
+	}
+
+	log.Printf("Restarting namespace %s with new settings", ns)
+	for _, l := range m.listeners {
+		if l.namespace != ns {
+			continue
+		}
+		h := l.handle
+		if n != nil {
+			m.accept(n, l)
+		} else {
+			l.handle = nil
+		}
+		h.detach()
+	}
+	m.stop(ns)
+
+	if n == nil {
+		m.startAfter(ns, old)
+		return nil
+	}
+	m.namespaces[ns] = n
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/msiebuhr/ucs"
+	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/systemd"
+
+	"github.com/docker/go-units"
+)
+
+// A cache backend and its quota
+type backend struct {
+	cache.Cacher
+	quota int64
+}
+
+// Tell systemd (and the process we're replacing, if upgrading) when we're
+// ready to serve, and keep systemd posted on how we're doing. If the
+// watchdog is enabled, it's only pinged while all listeners are accepting
+// connections.
+func notifySystemd(namespaces *namespaceManager) {
+	// Sizes aren't known until the initial scans are done
+	for _, b := range namespaces.backends() {
+		if scanner, ok := b.Cacher.(interface{ WaitForScan() }); ok {
+			systemd.Notify("STATUS=Scanning cache")
+			scanner.WaitForScan()
+		}
+	}
+	upgradeReady()
+
+	sent, err := systemd.Notify("READY=1\n" + status(namespaces.servers(), namespaces.backends()))
+	if err != nil {
+		log.Println("Notifying systemd:", err)
+	}
+	if !sent {
+		return
+	}
+
+	interval := 10 * time.Second
+	watchdog := systemd.WatchdogInterval()
+	if watchdog > 0 && watchdog/2 < interval {
+		interval = watchdog / 2
+	}
+
+	for range time.Tick(interval) {
+		state := status(namespaces.servers(), namespaces.backends())
+		if watchdog > 0 {
+			if err := healthCheck(namespaces.bound(), interval); err != nil {
+				log.Println("Health check failed:", err)
+			} else {
+				state = "WATCHDOG=1\n" + state
+			}
+		}
+		systemd.Notify(state)
+	}
+}
+
+func status(servers map[string]*ucs.Server, backends []backend) string {
+	var connections int64
+	for _, server := range servers {
+		connections += server.Connections()
+	}
+
+	var used, total int64
+	known := true
+	for _, b := range backends {
+		total += b.quota
+		if usage, ok := b.Cacher.(interface{ Usage() int64 }); ok {
+			used += usage.Usage()
+		} else {
+			known = false
+		}
+	}
+	size := "unknown size"
+	if known {
+		size = units.BytesSize(float64(used))
+	}
+
+	return fmt.Sprintf(
+		"STATUS=Serving %d namespaces, cache %s of %s, %d connections",
+		len(servers), size, units.BytesSize(float64(total)), connections,
+	)
+}
+
+// A listener and the server accepting connections on it
+type boundListener struct {
+	net.Listener
+	server *ucs.Server
+}
+
+// Check every listener is having connections accepted. This is done without
+// connecting, so it works when at the connection limits and doesn't show in
+// logs and metrics.
+func healthCheck(listeners []boundListener, within time.Duration) error {
+	for _, listener := range listeners {
+		if !listener.server.Accepting(listener.Listener, within) {
+			return fmt.Errorf("%s: Not accepting connections", listener.Addr())
+		}
+	}
+	return nil
+}
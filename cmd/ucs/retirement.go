@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/customflags"
+)
+
+// How often to look for namespaces to retire
+const retireInterval = time.Hour
+
+// Retires namespaces that haven't been used for their -retire-after, by
+// deleting them or moving them to an archive directory
+type retirement struct {
+	cache   cache.Retirer
+	archive string
+
+	// When we started keeping track of access times
+	started time.Time
+
+	// How long a namespace may go unused, 0 to keep it
+	retireAfter func(ns string) time.Duration
+}
+
+// A namespace, and whether it's due to be retired
+type retirementReport struct {
+	Namespace   string    `json:"namespace"`
+	Size        int64     `json:"size"`
+	LastAccess  time.Time `json:"last_access"`
+	RetireAfter string    `json:"retire_after,omitempty"`
+
+	// "delete" or "archive" if due, empty if not
+	Action string `json:"action,omitempty"`
+}
+
+func (r *retirement) report(now time.Time) []retirementReport {
+	action := "delete"
+	if r.archive != "" {
+		action = "archive"
+	}
+
+	reports := []retirementReport{}
+	for _, u := range r.cache.Namespaces() {
+		report := retirementReport{
+			Namespace:  u.Namespace,
+			Size:       u.Size,
+			LastAccess: u.LastAccess,
+		}
+		if after := r.retireAfter(u.Namespace); after > 0 {
+			report.RetireAfter = after.String()
+
+			// Access times from before we started may be from
+			// the files, which are stale on noatime mounts.
+			// Deleting can't be undone, so it waits for the
+			// namespace to go unused while we're watching.
+			lastAccess := u.LastAccess
+			if action == "delete" && lastAccess.Before(r.started) {
+				lastAccess = r.started
+			}
+			if !u.LastAccess.IsZero() && now.Sub(lastAccess) > after {
+				report.Action = action
+			}
+		}
+		reports = append(reports, report)
+	}
+	return reports
+}
+
+// Retire the namespaces that are due
+func (r *retirement) retire(now time.Time) {
+	for _, report := range r.report(now) {
+		if report.Action == "" {
+			continue
+		}
+		if err := r.cache.RetireNamespace(report.Namespace, r.archive); err != nil {
+			log.Printf("Could not retire namespace %s: %s", report.Namespace, err)
+			continue
+		}
+		log.Printf("Retired namespace %s (%s, last used %s)", report.Namespace, customflags.NewSize(report.Size), report.LastAccess.Format(time.RFC3339))
+	}
+}
+
+func (r *retirement) run() {
+	for range time.Tick(retireInterval) {
+		r.retire(time.Now())
+	}
+}
+
+// Report what would be retired now, without doing so
+func (r *retirement) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	defer req.Body.Close()
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.report(time.Now()))
+}
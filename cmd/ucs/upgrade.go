@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/msiebuhr/ucs/systemd"
+)
+
+// Zero-downtime upgrades: on SIGUSR2 we start whatever binary is now installed
+// in our place, with the same arguments, and hand it our listening sockets.
+// Once it reports that it's ready, we stop accepting and finish the
+// connections we have, while the new process takes over.
+
+const (
+	envUpgradeFds     = "UCS_UPGRADE_FDS"
+	envUpgradeFdNames = "UCS_UPGRADE_FDNAMES"
+	envUpgradeReadyFd = "UCS_UPGRADE_READY_FD"
+
+	// Where ExtraFiles start in the new process
+	upgradeFdsStart = 3
+)
+
+// A listening socket and the name the new process will know it by
+type namedListener struct {
+	name     string
+	listener net.Listener
+}
+
+// Listeners handed over by the process we're replacing, by name. Names may
+// repeat, so each name has a list of listeners.
+type inheritedListeners map[string][]net.Listener
+
+func inherit() (inheritedListeners, error) {
+	fds := os.Getenv(envUpgradeFds)
+	fdNames := os.Getenv(envUpgradeFdNames)
+	os.Unsetenv(envUpgradeFds)
+	os.Unsetenv(envUpgradeFdNames)
+
+	if fds == "" {
+		return inheritedListeners{}, nil
+	}
+
+	count, err := strconv.Atoi(fds)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s '%s': %w", envUpgradeFds, fds, err)
+	}
+	names := []string{}
+	if err := json.Unmarshal([]byte(fdNames), &names); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %w", envUpgradeFdNames, err)
+	}
+
+	listeners, err := systemd.FileListeners(upgradeFdsStart, count, names)
+	if err != nil {
+		return nil, err
+	}
+	return inheritedListeners(listeners), nil
+}
+
+// Take an inherited listener by name, or nil if there is none left
+func (i inheritedListeners) take(name string) net.Listener {
+	listeners := i[name]
+	if len(listeners) == 0 {
+		return nil
+	}
+	i[name] = listeners[1:]
+	return listeners[0]
+}
+
+// Close listeners our configuration no longer uses
+func (i inheritedListeners) closeUnused() {
+	for name, listeners := range i {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		delete(i, name)
+	}
+}
+
+// Tell the process we're replacing that we're ready to take over
+func upgradeReady() {
+	fd := os.Getenv(envUpgradeReadyFd)
+	os.Unsetenv(envUpgradeReadyFd)
+	if fd == "" {
+		return
+	}
+
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return
+	}
+	f := os.NewFile(uintptr(n), "upgrade-ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+// Start a new process with our arguments and listeners, and wait for it to
+// be ready to serve. Returns the pid of the new process.
+func upgrade(listeners []namedListener, timeout time.Duration) (int, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	names := make([]string, 0, len(listeners))
+	files := make([]*os.File, 0, len(listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		filer, ok := l.listener.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("Cannot hand over listener %s", l.name)
+		}
+		f, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("Cannot hand over listener %s: %w", l.name, err)
+		}
+		names = append(names, l.name)
+		files = append(files, f)
+	}
+	encodedNames, err := json.Marshal(names)
+	if err != nil {
+		return 0, err
+	}
+
+	// The new process writes to the pipe when it's ready. If it dies
+	// before that, we read EOF instead.
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer ready.Close()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(
+		os.Environ(),
+		fmt.Sprintf("%s=%d", envUpgradeFds, len(listeners)),
+		fmt.Sprintf("%s=%s", envUpgradeFdNames, encodedNames),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFd, upgradeFdsStart+len(listeners)),
+	)
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	readyWriter.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err = <-result:
+	case <-timer.C:
+		err = fmt.Errorf("Not ready after %s", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("New process pid=%d failed: %w", cmd.Process.Pid, err)
+	}
+
+	// The new process owns unix socket files now
+	for _, l := range listeners {
+		if unix, ok := l.listener.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+	}
+
+	return cmd.Process.Pid, nil
+}
@@ -0,0 +1,379 @@
+// Package config reads the configuration file of ucs. It's a JSON document
+// with the same settings as the command line flags, but grouped and with
+// settings per namespace; see example.json.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+type Config struct {
+	HTTP     HTTP     `json:"http"`
+	Log      Log      `json:"log"`
+	Backend  Backend  `json:"backend"`
+	Upstream Upstream `json:"upstream"`
+	Mirror   Mirror   `json:"mirror"`
+	Limits   Limits   `json:"limits"`
+
+	Retirement Retirement `json:"retirement"`
+
+	// Settings for namespaces that don't set their own
+	NamespaceDefaults Namespace            `json:"namespace_defaults"`
+	Namespaces        map[string]Namespace `json:"namespaces"`
+}
+
+// The metrics and admin interface
+type HTTP struct {
+	Address string `json:"address"`
+}
+
+type Log struct {
+	Verbose bool `json:"verbose"`
+}
+
+type Backend struct {
+	// "fs" or "memory"
+	Type string `json:"type"`
+
+	// Where the fs backend stores data
+	Path string `json:"path"`
+
+	// Storage quota, ex. "150GB"
+	Quota string `json:"quota"`
+
+	// What to do about re-uploads with different content (keep-last,
+	// keep-first or reject)
+	MismatchPolicy string `json:"mismatch_policy"`
+}
+
+// Namespaces unused for their retire_after are deleted, or moved to
+// archive_path if set
+type Retirement struct {
+	ArchivePath string `json:"archive_path"`
+}
+
+type Upstream struct {
+	Timeout string `json:"timeout"`
+	MaxSize string `json:"max_size"`
+}
+
+type Mirror struct {
+	SpoolPath string `json:"spool_path"`
+}
+
+// Limits for all namespaces. Sizes are given like "100MB" and durations like
+// "5m".
+type Limits struct {
+	MaxConnections   int    `json:"max_connections"`
+	HandshakeTimeout string `json:"handshake_timeout"`
+	IdleTimeout      string `json:"idle_timeout"`
+	MaxSessionTime   string `json:"max_session_time"`
+	ShutdownTimeout  string `json:"shutdown_timeout"`
+	UpgradeTimeout   string `json:"upgrade_timeout"`
+	GetWindow        int    `json:"get_window"`
+	PutYield         string `json:"put_yield"`
+
+	MaxAssetSize       string `json:"max_asset_size"`
+	MaxInfoSize        string `json:"max_info_size"`
+	MaxResourceSize    string `json:"max_resource_size"`
+	MaxTransactionSize string `json:"max_transaction_size"`
+
+	MaxBytesPerSecond    string `json:"max_bytes_per_second"`
+	MaxCommandsPerSecond int64  `json:"max_commands_per_second"`
+
+	// Limits for each client, by the network it is in
+	Clients []ClientLimits `json:"clients"`
+}
+
+type ClientLimits struct {
+	// ex. "10.1.0.0/16", or empty for all clients
+	Network              string `json:"network"`
+	MaxBytesPerSecond    string `json:"max_bytes_per_second"`
+	MaxCommandsPerSecond int64  `json:"max_commands_per_second"`
+	UploadRate           string `json:"upload_rate"`
+}
+
+type Listener struct {
+	// ex. ":8126", "10.0.0.1:8126", "[fd00::1]:8126" or
+	// "unix:/run/ucs/default.sock"
+	Address string `json:"address"`
+
+	TLS bool `json:"tls"`
+
+	// Proxies sending PROXY protocol headers
+	TrustedProxies []string `json:"trusted_proxies"`
+}
+
+// Settings for a namespace. Settings left out fall back to namespace_defaults,
+// which is why some are pointers.
+type Namespace struct {
+	Listen []Listener `json:"listen"`
+
+	// Store the namespace in a backend of its own, instead of the shared
+	// one
+	Backend *Backend `json:"backend"`
+
+	// Most the namespace may use of its backend, and what it keeps when
+	// other namespaces need room
+	Quota    string `json:"quota"`
+	MinQuota string `json:"min_quota"`
+
+	Upstream    string   `json:"upstream"`
+	Mirrors     []string `json:"mirrors"`
+	Reliability *int     `json:"reliability"`
+
+	// Namespaces to answer misses from, in order, and whether to copy
+	// entries found there into this one
+	Parents            []string `json:"parents"`
+	PromoteFromParents *bool    `json:"promote_from_parents"`
+
+	ReadAllow  []string `json:"read_allow"`
+	WriteAllow []string `json:"write_allow"`
+	ReadOnly   *bool    `json:"read_only"`
+
+	TLSCert string `json:"tls_cert"`
+	TLSKey  string `json:"tls_key"`
+
+	// Retire the namespace when unused for this long, ex. "2160h"; "0" to
+	// keep it
+	RetireAfter string `json:"retire_after"`
+
+	MaxConnections       *int   `json:"max_connections"`
+	MaxBytesPerSecond    string `json:"max_bytes_per_second"`
+	MaxCommandsPerSecond *int64 `json:"max_commands_per_second"`
+	UploadRate           string `json:"upload_rate"`
+}
+
+// Read and validate a configuration file
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Read and validate a configuration. Unknown settings are errors, so typos
+// don't go unnoticed.
+func Parse(r io.Reader) (*Config, error) {
+	var c Config
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return nil, err
+	}
+	return &c, c.Validate()
+}
+
+// Check settings that would otherwise only fail once used
+func (c *Config) Validate() error {
+	type check struct {
+		name  string
+		value string
+		parse func(string) error
+	}
+	checks := []check{
+		{"upstream.timeout", c.Upstream.Timeout, parseDuration},
+		{"upstream.max_size", c.Upstream.MaxSize, parseSize},
+		{"limits.handshake_timeout", c.Limits.HandshakeTimeout, parseDuration},
+		{"limits.idle_timeout", c.Limits.IdleTimeout, parseDuration},
+		{"limits.max_session_time", c.Limits.MaxSessionTime, parseDuration},
+		{"limits.shutdown_timeout", c.Limits.ShutdownTimeout, parseDuration},
+		{"limits.upgrade_timeout", c.Limits.UpgradeTimeout, parseDuration},
+		{"limits.put_yield", c.Limits.PutYield, parseDuration},
+		{"limits.max_asset_size", c.Limits.MaxAssetSize, parseSize},
+		{"limits.max_info_size", c.Limits.MaxInfoSize, parseSize},
+		{"limits.max_resource_size", c.Limits.MaxResourceSize, parseSize},
+		{"limits.max_transaction_size", c.Limits.MaxTransactionSize, parseSize},
+		{"limits.max_bytes_per_second", c.Limits.MaxBytesPerSecond, parseSize},
+	}
+	for i, client := range c.Limits.Clients {
+		checks = append(checks,
+			check{fmt.Sprintf("limits.clients[%d].max_bytes_per_second", i), client.MaxBytesPerSecond, parseSize},
+			check{fmt.Sprintf("limits.clients[%d].upload_rate", i), client.UploadRate, parseSize})
+	}
+	for _, check := range checks {
+		if check.value == "" {
+			continue
+		}
+		if err := check.parse(check.value); err != nil {
+			return fmt.Errorf("%s: %w", check.name, err)
+		}
+	}
+
+	if err := c.Backend.validate("backend"); err != nil {
+		return err
+	}
+	if len(c.NamespaceDefaults.Listen) > 0 || c.NamespaceDefaults.Backend != nil {
+		return fmt.Errorf("namespace_defaults: listen and backend must be set per namespace")
+	}
+	if err := c.NamespaceDefaults.validate("namespace_defaults"); err != nil {
+		return err
+	}
+
+	// Backends must not share a directory, or their GCs would fight
+	paths := map[string]string{}
+	addresses := map[string]string{}
+	if c.Backend.Type == "" || c.Backend.Type == "fs" {
+		paths[cleanPath(c.Backend.Path)] = "backend"
+	}
+	for name, ns := range c.Namespaces {
+		if err := ValidNamespace(name); err != nil {
+			return err
+		}
+		prefix := "namespaces." + name
+		if err := ns.validate(prefix); err != nil {
+			return err
+		}
+		for i, parent := range ns.Parents {
+			if parent == name {
+				return fmt.Errorf("%s.parents[%d]: A namespace can't be its own parent", prefix, i)
+			}
+		}
+		for i, l := range ns.Listen {
+			if err := validAddress(l.Address); err != nil {
+				return fmt.Errorf("%s.listen[%d]: %w", prefix, i, err)
+			}
+			if other, ok := addresses[l.Address]; ok {
+				return fmt.Errorf("%s.listen[%d]: Address %s is already used by %s", prefix, i, l.Address, other)
+			}
+			addresses[l.Address] = prefix
+		}
+		if ns.Backend != nil {
+			if err := ns.Backend.validate(prefix + ".backend"); err != nil {
+				return err
+			}
+			if backendType(ns.Backend, &c.Backend) == "fs" {
+				if ns.Backend.Path == "" {
+					return fmt.Errorf("%s.backend.path: A namespace's own fs backend needs a path of its own", prefix)
+				}
+				path := cleanPath(ns.Backend.Path)
+				if other, ok := paths[path]; ok {
+					return fmt.Errorf("%s.backend: Path '%s' is already used by %s", prefix, ns.Backend.Path, other)
+				}
+				paths[path] = prefix + ".backend"
+			}
+		}
+	}
+
+	return nil
+}
+
+// Namespace names end up in flags, paths and metrics, so they can't contain
+// the separators those use, or start with a dot like the FS cache's index
+func ValidNamespace(name string) error {
+	if name == "" || strings.ContainsAny(name, ",=:/") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("Invalid namespace name '%s'", name)
+	}
+	return nil
+}
+
+// Listen addresses are a host and port, or a unix socket
+func validAddress(address string) error {
+	if address == "" {
+		return fmt.Errorf("No address given")
+	}
+	if strings.HasPrefix(address, "unix:") {
+		if address == "unix:" {
+			return fmt.Errorf("No socket path given")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("Invalid port in '%s'", address)
+	}
+	return nil
+}
+
+func (b *Backend) validate(prefix string) error {
+	switch b.Type {
+	case "", "fs", "memory":
+	default:
+		return fmt.Errorf("%s.type: Unknown backend '%s'", prefix, b.Type)
+	}
+	if b.Quota != "" {
+		if err := parseSize(b.Quota); err != nil {
+			return fmt.Errorf("%s.quota: %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+func (n *Namespace) validate(prefix string) error {
+	for name, value := range map[string]string{
+		"quota":                n.Quota,
+		"min_quota":            n.MinQuota,
+		"max_bytes_per_second": n.MaxBytesPerSecond,
+		"upload_rate":          n.UploadRate,
+	} {
+		if value == "" {
+			continue
+		}
+		if err := parseSize(value); err != nil {
+			return fmt.Errorf("%s.%s: %w", prefix, name, err)
+		}
+	}
+	if n.RetireAfter != "" {
+		if err := parseDuration(n.RetireAfter); err != nil {
+			return fmt.Errorf("%s.retire_after: %w", prefix, err)
+		}
+	}
+	for i, parent := range n.Parents {
+		if err := ValidNamespace(parent); err != nil {
+			return fmt.Errorf("%s.parents[%d]: %w", prefix, i, err)
+		}
+	}
+	return nil
+}
+
+// The type of a namespace's own backend, which defaults to the shared
+// backend's
+func backendType(own, shared *Backend) string {
+	for _, t := range []string{own.Type, shared.Type} {
+		if t != "" {
+			return t
+		}
+	}
+	return "fs"
+}
+
+func parseSize(s string) error {
+	_, err := units.RAMInBytes(s)
+	return err
+}
+
+func parseDuration(s string) error {
+	_, err := time.ParseDuration(s)
+	return err
+}
+
+// Paths are compared as the default path, as absolute paths
+func cleanPath(path string) string {
+	if path == "" {
+		path = "./unity-cache"
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
@@ -0,0 +1,76 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadExample(t *testing.T) {
+	c, err := Load("example.json")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if c.Backend.Quota != "150GB" || c.Limits.MaxConnections != 500 {
+		t.Errorf("Expected global settings to be read, got %+v", c)
+	}
+	if len(c.Namespaces) != 3 {
+		t.Fatalf("Expected 3 namespaces, got %d", len(c.Namespaces))
+	}
+	if l := c.Namespaces["general"].Listen; len(l) != 3 || !l[1].TLS {
+		t.Errorf("Expected general to have three listeners, one TLS, got %+v", l)
+	}
+	if hot := c.Namespaces["hot"]; hot.Backend == nil || hot.Backend.Type != "memory" {
+		t.Errorf("Expected hot to have a memory backend, got %+v", hot.Backend)
+	}
+
+	// Zero values are kept apart from settings left out
+	if n := c.Namespaces["hot"].MaxConnections; n == nil || *n != 0 {
+		t.Errorf("Expected hot to set max_connections to 0, got %v", n)
+	}
+	if n := c.Namespaces["general"].MaxConnections; n != nil {
+		t.Errorf("Expected general to leave out max_connections, got %v", *n)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{`{"limits": {"max_conections": 5}}`, "unknown field"},
+		{`{"backend": {"type": "tape"}}`, "backend.type"},
+		{`{"backend": {"quota": "lots"}}`, "backend.quota"},
+		{`{"limits": {"idle_timeout": "5"}}`, "limits.idle_timeout"},
+		{`{"limits": {"clients": [{"network": "10.0.0.0/8", "max_bytes_per_second": "fast"}]}}`, "limits.clients[0]"},
+		{`{"namespace_defaults": {"listen": [{"address": ":8126"}]}}`, "namespace_defaults"},
+		{`{"namespaces": {"a,b": {}}}`, "Invalid namespace name"},
+		{`{"namespaces": {".index": {}}}`, "Invalid namespace name"},
+		{`{"namespaces": {"a": {"listen": [{"tls": true}]}}}`, "namespaces.a.listen[0]"},
+		{`{"namespaces": {"a": {"listen": [{"address": "fd00::1:8126"}]}}}`, "namespaces.a.listen[0]"},
+		{`{"namespaces": {"a": {"listen": [{"address": "10.0.0.1:http"}]}}}`, "Invalid port"},
+		{`{"namespaces": {"a": {"listen": [{"address": ":8126"}]}, "b": {"listen": [{"address": ":8126"}]}}}`, "already used by namespaces."},
+		{`{"namespaces": {"a": {"min_quota": "some"}}}`, "namespaces.a.min_quota"},
+		{`{"namespaces": {"a": {"max_bytes_per_second": "x"}}}`, "namespaces.a.max_bytes_per_second"},
+		{`{"namespaces": {"a": {"upload_rate": "x"}}}`, "namespaces.a.upload_rate"},
+		{`{"limits": {"clients": [{"network": "10.0.0.0/8", "upload_rate": "fast"}]}}`, "limits.clients[0].upload_rate"},
+		{`{"namespaces": {"a": {"parents": ["a"]}}}`, "own parent"},
+		{`{"namespace_defaults": {"retire_after": "90d"}}`, "namespace_defaults.retire_after"},
+		{`{"namespaces": {"a": {"parents": ["b:c"]}}}`, "namespaces.a.parents[0]"},
+		{`{"namespaces": {"a": {"backend": {"type": "fs"}}}}`, "needs a path"},
+		{`{"backend": {"path": "/tmp/x"}, "namespaces": {"a": {"backend": {"path": "/tmp/x"}}}}`, "already used by backend"},
+	} {
+		_, err := Parse(strings.NewReader(tc.config))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Expected error containing '%s' for %s, got %v", tc.err, tc.config, err)
+		}
+	}
+}
+
+func TestParseMemoryBackends(t *testing.T) {
+	// Memory backends don't need paths of their own
+	_, err := Parse(strings.NewReader(`{"backend": {"type": "memory"}, "namespaces": {"a": {"backend": {}}, "b": {"backend": {}}}}`))
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,105 @@
+package ucs
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ucs_server_active_connections",
+		Help: "Connections currently being handled",
+	}, []string{"namespace"})
+	rejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_rejected_connections",
+		Help: "Connections turned away, by which limit was hit",
+	}, []string{"namespace", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(activeConnections)
+	prometheus.MustRegister(rejectedConnections)
+}
+
+// ConnectionManager caps the number of connections across all servers sharing
+// it. Set it as Server.ConnectionManager on each of them.
+type ConnectionManager struct {
+	// Connections allowed at once. Zero means no limit.
+	MaxConnections int
+
+	active int64
+}
+
+func NewConnectionManager(maxConnections int) *ConnectionManager {
+	return &ConnectionManager{MaxConnections: maxConnections}
+}
+
+// Number of connections currently being handled
+func (m *ConnectionManager) Active() int64 {
+	return atomic.LoadInt64(&m.active)
+}
+
+func (m *ConnectionManager) acquire() bool {
+	n := atomic.AddInt64(&m.active, 1)
+	if m.MaxConnections > 0 && n > int64(m.MaxConnections) {
+		atomic.AddInt64(&m.active, -1)
+		return false
+	}
+	return true
+}
+
+func (m *ConnectionManager) release() {
+	atomic.AddInt64(&m.active, -1)
+}
+
+// A connection being handled, which can be asked to finish up. Only the
+// wait for the next command is interrupted, so requests already read are
+// answered and open transactions may finish.
+type session struct {
+	conn net.Conn
+
+	lock     sync.Mutex
+	idle     bool
+	draining bool
+}
+
+// Stop reading commands, interrupting the wait for the next one
+func (c *session) drain() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.draining = true
+	if c.idle {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Set up waiting for the next command for at most timeout. Unless
+// interruptible, the wait isn't cut short by draining. Returns false if the
+// session is draining and no more commands should be read.
+func (c *session) nextCommand(timeout time.Duration, interruptible bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if interruptible && c.draining {
+		return false
+	}
+	c.idle = interruptible
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	return true
+}
+
+// Done waiting for a command. Returns false if draining began while waiting,
+// in which case whatever was read should be dropped.
+func (c *session) gotCommand() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	wasIdle := c.idle
+	c.idle = false
+	return !(wasIdle && c.draining)
+}
@@ -0,0 +1,187 @@
+package ucs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/msiebuhr/ucs/cache"
+)
+
+// Serve s on a local port, returning a function to connect and handshake
+func serveLocal(t *testing.T, s *Server) func() net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Listener(context.Background(), listener)
+
+	return func() net.Conn {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("000000fe"))
+		return conn
+	}
+}
+
+func expectHandshake(t *testing.T, conn net.Conn) {
+	version := make([]byte, 8)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		t.Fatalf("Error reading handshake: %s", err)
+	}
+	if string(version) != "000000fe" {
+		t.Fatalf("Expected handshake `000000fe`, got `%s`", version)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options func(*Server)
+	}{
+		{"namespace", func(s *Server) { s.MaxConnections = 1 }},
+		{"global", func(s *Server) { s.ConnectionManager = NewConnectionManager(1) }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewServer(tc.options)
+			defer s.Stop()
+			dial := serveLocal(t, s)
+
+			first := dial()
+			defer first.Close()
+			expectHandshake(t, first)
+
+			second := dial()
+			defer second.Close()
+			if out, _ := ioutil.ReadAll(second); len(out) != 0 {
+				t.Errorf("Expected connection over the limit to be closed, got `%s`", out)
+			}
+
+			// Room for another once the first is gone
+			first.Write([]byte("q"))
+			ioutil.ReadAll(first)
+			for i := 0; i < 100 && s.Connections() > 0; i += 1 {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			third := dial()
+			defer third.Close()
+			expectHandshake(t, third)
+		})
+	}
+}
+
+func TestAccepting(t *testing.T) {
+	s := NewServer(func(s *Server) { s.MaxConnections = 1 })
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	go func() {
+		s.Listener(context.Background(), listener)
+		close(done)
+	}()
+
+	// Idle loops keep coming round, without taking up connections
+	time.Sleep(acceptWakeup + 100*time.Millisecond)
+	if !s.Accepting(listener, acceptWakeup) {
+		t.Errorf("Expected idle listener to be accepting")
+	}
+	if s.Connections() != 0 {
+		t.Errorf("Expected no connections, got %d", s.Connections())
+	}
+
+	s.Stop()
+	<-done
+	if s.Accepting(listener, acceptWakeup) {
+		t.Errorf("Expected stopped listener not to be accepting")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := NewServer(func(s *Server) { s.IdleTimeout = 50 * time.Millisecond })
+	defer s.Stop()
+	conn := serveLocal(t, s)()
+	defer conn.Close()
+	expectHandshake(t, conn)
+
+	start := time.Now()
+	ioutil.ReadAll(conn)
+	if time.Now().Sub(start) > 2*time.Second {
+		t.Errorf("Expected idle connection to be closed")
+	}
+}
+
+func TestShutdownDrainsIdleConnections(t *testing.T) {
+	s := NewServer()
+	conn := serveLocal(t, s)()
+	defer conn.Close()
+	expectHandshake(t, conn)
+
+	// A get read before shutting down is still answered
+	fmt.Fprintf(conn, "ga%s", bytes.Repeat([]byte{'x'}, 32))
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected shutdown without error, got %s", err)
+	}
+
+	out, _ := ioutil.ReadAll(conn)
+	if !bytes.HasPrefix(out, []byte("-a")) {
+		t.Errorf("Expected queued get to be answered, got `%s`", out)
+	}
+}
+
+func TestShutdownFinishesTransaction(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	s := NewServer(func(s *Server) { s.Cache = c })
+	conn := serveLocal(t, s)()
+	defer conn.Close()
+	expectHandshake(t, conn)
+
+	uuidAndHash := bytes.Repeat([]byte{'y'}, 32)
+	fmt.Fprintf(conn, "ts%s", uuidAndHash)
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	time.Sleep(50 * time.Millisecond)
+
+	fmt.Fprintf(conn, "pa%016x%s", 4, "data")
+	fmt.Fprintf(conn, "te")
+
+	if err := <-done; err != nil {
+		t.Errorf("Expected shutdown without error, got %s", err)
+	}
+	if size, _, _ := c.Get("", cache.KIND_ASSET, uuidAndHash); size != 4 {
+		t.Errorf("Expected transaction to be committed, got size %d", size)
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s := NewServer()
+	conn := serveLocal(t, s)()
+	defer conn.Close()
+	expectHandshake(t, conn)
+
+	// Never finished
+	fmt.Fprintf(conn, "ts%s", bytes.Repeat([]byte{'z'}, 32))
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected %s, got %v", context.DeadlineExceeded, err)
+	}
+}
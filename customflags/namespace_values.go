@@ -0,0 +1,59 @@
+package customflags
+
+// Namespace Values is a custom flag type mapping namespaces to string values,
+// with an optional default for namespaces that aren't mentioned explicitly.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type NamespaceValues map[string]string
+
+// Pretty-prints the namespace/value pairs.
+func (f *NamespaceValues) String() string {
+	if len(*f) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(*f))
+	for ns, value := range *f {
+		if ns == "" {
+			pairs = append(pairs, value)
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%s", ns, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Sets a value for a namespace, e.g. "alpha=/etc/alpha.pem", or the default
+// value used by all other namespaces, e.g. "/etc/default.pem". Multiple sets
+// may be given as a comma-separated list.
+func (f NamespaceValues) Set(s string) error {
+	for _, part := range strings.Split(s, ",") {
+		ns := ""
+		value := part
+		if strings.Contains(part, "=") {
+			nsAndValue := strings.SplitN(part, "=", 2)
+			ns = nsAndValue[0]
+			value = nsAndValue[1]
+		}
+
+		if value == "" {
+			return fmt.Errorf("Empty value given for namespace '%s'", ns)
+		}
+
+		f[ns] = value
+	}
+	return nil
+}
+
+// Get the value for the given namespace, falling back to the default.
+func (f NamespaceValues) Get(ns string) string {
+	if value, ok := f[ns]; ok {
+		return value
+	}
+	return f[""]
+}
@@ -0,0 +1,41 @@
+package customflags
+
+import (
+	"testing"
+)
+
+func TestNamespaceValues(t *testing.T) {
+	f := NamespaceValues{}
+
+	f.Set("/etc/default.pem")
+	f.Set("alpha=/etc/alpha.pem,beta=/etc/beta.pem")
+
+	tests := map[string]string{
+		"alpha": "/etc/alpha.pem",
+		"beta":  "/etc/beta.pem",
+		"gamma": "/etc/default.pem",
+	}
+	for ns, expected := range tests {
+		if val := f.Get(ns); val != expected {
+			t.Errorf("Expected %s => %s, got %s", ns, expected, val)
+		}
+	}
+
+	expected := "/etc/default.pem,alpha=/etc/alpha.pem,beta=/etc/beta.pem"
+	if f.String() != expected {
+		t.Errorf("Expected Stringer to return %s, got %s", expected, f.String())
+	}
+}
+
+func TestNamespaceValuesNoDefault(t *testing.T) {
+	f := NamespaceValues{}
+	f.Set("alpha=1")
+
+	if val := f.Get("beta"); val != "" {
+		t.Errorf("Expected unset namespace to return empty string, got %s", val)
+	}
+
+	if err := f.Set("alpha="); err == nil {
+		t.Errorf("Expected error when setting empty value")
+	}
+}
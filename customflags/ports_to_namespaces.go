@@ -6,12 +6,15 @@ package customflags
 
 import (
 	"fmt"
+	"net"
 	"sort"
 	"strconv"
 	"strings"
 )
 
-type Namespaces map[uint]string
+// Namespaces by the address they listen on, ex. ":5000" for a port on all
+// interfaces, "10.0.0.1:5000" or "[fd00::1]:5000".
+type Namespaces map[string]string
 
 // Pretty-prints namespace/port sets.
 func (f *Namespaces) String() string {
@@ -19,16 +22,17 @@ func (f *Namespaces) String() string {
 		return ""
 	}
 	pairs := make([]string, 0, len(*f))
-	for port, ns := range *f {
-		pairs = append(pairs, fmt.Sprintf("%s:%d", ns, port))
+	for address, ns := range *f {
+		pairs = append(pairs, fmt.Sprintf("%s:%s", ns, strings.TrimPrefix(address, ":")))
 	}
 	sort.Strings(pairs)
 	return strings.Join(pairs, " ")
 }
 
 // Sets a namespace/port combination from either just a number, e.g. "5000",
-// a namespace:port set, e.g. "alpha:5000", and finally, a set of these,
-// e.g. "alpha:5000,beta:5001,5002"
+// a namespace:port set, e.g. "alpha:5000", a namespace:address:port set, e.g.
+// "alpha:10.0.0.1:5000" or "alpha:[fd00::1]:5000", and finally, a set of
+// these, e.g. "alpha:5000,alpha:[::1]:5000,beta:5001,5002"
 func (f Namespaces) Set(s string) error {
 	parts := strings.Split(s, ",")
 	for _, part := range parts {
@@ -41,24 +45,43 @@ func (f Namespaces) Set(s string) error {
 }
 
 func (f Namespaces) setSingle(s string) error {
-	portStr := s
-	name := s
-	if strings.Contains(s, ":") {
-		nsAndPort := strings.SplitN(s, ":", 2)
-		portStr = nsAndPort[1]
-		name = nsAndPort[0]
+	name := ""
+	address := s
+	if !strings.HasPrefix(s, "[") && strings.Contains(s, ":") {
+		nsAndAddress := strings.SplitN(s, ":", 2)
+		name = nsAndAddress[0]
+		address = nsAndAddress[1]
+	}
+
+	// "10.0.0.1:5000" is an address without a namespace, not namespace
+	// "10.0.0.1" on port 5000
+	if net.ParseIP(name) != nil {
+		return fmt.Errorf("Missing namespace for address %s; use namespace:%s", s, s)
+	}
+
+	host, portStr := "", address
+	if strings.Contains(address, ":") {
+		var err error
+		host, portStr, err = net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
 	}
 
 	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
 		return err
 	}
+	if name == "" {
+		name = strconv.FormatUint(port, 10)
+	}
+	address = net.JoinHostPort(host, strconv.FormatUint(port, 10))
 
-	// Fail if port is already set
-	if ns, ok := f[uint(port)]; ok {
-		return fmt.Errorf("Port %d is already used for namespace '%s'", port, ns)
+	// Fail if address is already set
+	if ns, ok := f[address]; ok {
+		return fmt.Errorf("Address %s is already used for namespace '%s'", address, ns)
 	}
 
-	f[uint(port)] = name
+	f[address] = name
 	return nil
 }
@@ -9,12 +9,12 @@ func TestNamespaces(t *testing.T) {
 	f := Namespaces{}
 
 	f.Set("5000")
-	if val, ok := f[5000]; !ok || val != "5000" {
+	if val, ok := f[":5000"]; !ok || val != "5000" {
 		t.Errorf("Expected 5000 => 5000, got 5000 => %s", val)
 	}
 
 	f.Set("name:6000")
-	if val, ok := f[6000]; !ok || val != "name" {
+	if val, ok := f[":6000"]; !ok || val != "name" {
 		t.Errorf("Expected 6000 => name, got 6000 => %s", val)
 	}
 }
@@ -23,13 +23,13 @@ func TestFlagNSMulti(t *testing.T) {
 	f := Namespaces{}
 
 	f.Set("foo:42,bar:43,baz:44")
-	if val, ok := f[42]; !ok || val != "foo" {
+	if val, ok := f[":42"]; !ok || val != "foo" {
 		t.Errorf("Expected 42 => foo, got 42 => %s", val)
 	}
-	if val, ok := f[43]; !ok || val != "bar" {
+	if val, ok := f[":43"]; !ok || val != "bar" {
 		t.Errorf("Expected 43 => bar, got 43 => %s", val)
 	}
-	if val, ok := f[44]; !ok || val != "baz" {
+	if val, ok := f[":44"]; !ok || val != "baz" {
 		t.Errorf("Expected 44 => baz, got 44 => %s", val)
 	}
 
@@ -63,3 +63,35 @@ func TestNamespaceFailsOnPortOverride(t *testing.T) {
 		t.Errorf("Expected error when setting same port multiple times")
 	}
 }
+
+func TestNamespaceAddresses(t *testing.T) {
+	f := Namespaces{}
+
+	if err := f.Set("foo:10.0.0.1:42,foo:[fd00::1]:42,[::1]:43"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"10.0.0.1:42":  "foo",
+		"[fd00::1]:42": "foo",
+		"[::1]:43":     "43",
+	}
+	for address, ns := range expected {
+		if f[address] != ns {
+			t.Errorf("Expected %s => %s, got %s => %s", address, ns, address, f[address])
+		}
+	}
+
+	str := "43:[::1]:43 foo:10.0.0.1:42 foo:[fd00::1]:42"
+	if f.String() != str {
+		t.Errorf("Expected Stringer to return %s, got %s", str, f.String())
+	}
+}
+
+func TestNamespaceInvalidAddresses(t *testing.T) {
+	for _, s := range []string{"foo:", "foo:bar", "foo:::1:42", "foo:10.0.0.1:70000", "[::1]", "10.0.0.1:42", "foo:42,10.0.0.1:43"} {
+		f := Namespaces{}
+		if err := f.Set(s); err == nil {
+			t.Errorf("Expected error setting '%s', got %v", s, f)
+		}
+	}
+}
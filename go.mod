@@ -1,17 +1,20 @@
 module github.com/msiebuhr/ucs
 
-go 1.12
+go 1.18
 
 require (
-	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
 	github.com/docker/go-units v0.3.3
-	github.com/gogo/protobuf v1.1.1 // indirect
-	github.com/golang/protobuf v1.2.0 // indirect
-	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/namsral/flag v1.7.4-pre
 	github.com/pinterest/bender v0.0.0-20180910184031-e8ff9e5c0e0f
 	github.com/prometheus/client_golang v0.0.0-20180912130400-b5bfa0eb2c8d
-	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910 // indirect
+	github.com/prometheus/client_model v0.0.0-20180712105110-5c3871d89910
+)
+
+require (
+	github.com/beorn7/perks v0.0.0-20180321164747-3a771d992973 // indirect
+	github.com/gogo/protobuf v1.1.1 // indirect
+	github.com/golang/protobuf v1.2.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/common v0.0.0-20180801064454-c7de2306084e // indirect
 	github.com/prometheus/procfs v0.0.0-20180725123919-05ee40e3a273 // indirect
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
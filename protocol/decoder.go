@@ -0,0 +1,184 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+// Decoder reads commands from a stream
+type Decoder struct {
+	r *bufio.Reader
+
+	// What's left of the payload of the last command
+	payload io.LimitedReader
+}
+
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{r: br}
+}
+
+// Read the version a server replies with; always eight hex digits
+func (d *Decoder) DecodeVersion() (Version, error) {
+	return d.decodeVersion(8)
+}
+
+// Read the version sent by a client. As described in protocol.md, this is
+// whatever is in the first packet, between two and eight hex digits.
+func (d *Decoder) DecodeClientVersion() (Version, error) {
+	// Wait for some data, so we don't get zero buffer sizes all the time
+	d.r.Peek(2)
+
+	n := d.r.Buffered()
+	if n > 8 {
+		n = 8
+	}
+	if n < 2 {
+		n = 2
+	}
+	return d.decodeVersion(n)
+}
+
+func (d *Decoder) decodeVersion(n int) (Version, error) {
+	digits := make([]byte, n)
+	if _, err := io.ReadFull(d.r, digits); err != nil {
+		return Version{}, err
+	}
+	number, err := strconv.ParseUint(string(digits), 16, 32)
+	if err != nil {
+		return Version{}, invalidCommand("version '%s'", digits)
+	}
+	return Version{Number: uint32(number)}, nil
+}
+
+// Payload of the last Put or GetResponse. Whatever isn't read is skipped by
+// the next call to Decode().
+func (d *Decoder) Payload() *io.LimitedReader {
+	return &d.payload
+}
+
+// Read the next command. A clean end of stream between commands returns
+// io.EOF; anywhere else it's io.ErrUnexpectedEOF. Invalid commands return
+// errors wrapping ErrInvalidCommand.
+func (d *Decoder) Decode() (Command, error) {
+	if d.payload.N > 0 {
+		if _, err := io.Copy(ioutil.Discard, &d.payload); err != nil {
+			return nil, err
+		}
+		if d.payload.N > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+
+	cmd, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if cmd == 'q' {
+		return Quit{}, nil
+	}
+
+	arg, err := d.r.ReadByte()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+
+	switch cmd {
+	case 'g':
+		// Gets of unknown kinds are passed on, to be answered as misses
+		uuidAndHash, err := d.readUuidAndHash()
+		if err != nil {
+			return nil, err
+		}
+		return Get{Kind: Kind(arg), UuidAndHash: uuidAndHash}, nil
+
+	case 't':
+		switch arg {
+		case 's':
+			uuidAndHash, err := d.readUuidAndHash()
+			if err != nil {
+				return nil, err
+			}
+			return TxStart{UuidAndHash: uuidAndHash}, nil
+		case 'e':
+			return TxEnd{}, nil
+		}
+
+	case 'p':
+		if !Kind(arg).Valid() {
+			return nil, invalidCommand("put of kind '%c'", arg)
+		}
+		size, err := d.readSize()
+		if err != nil {
+			return nil, err
+		}
+		d.setPayload(size)
+		return Put{Kind: Kind(arg), Size: size}, nil
+
+	case '+':
+		if !Kind(arg).Valid() {
+			return nil, invalidCommand("response of kind '%c'", arg)
+		}
+		size, err := d.readSize()
+		if err != nil {
+			return nil, err
+		}
+		uuidAndHash, err := d.readUuidAndHash()
+		if err != nil {
+			return nil, err
+		}
+		d.setPayload(size)
+		return GetResponse{Kind: Kind(arg), UuidAndHash: uuidAndHash, Hit: true, Size: size}, nil
+
+	case '-':
+		if !Kind(arg).Valid() {
+			return nil, invalidCommand("response of kind '%c'", arg)
+		}
+		uuidAndHash, err := d.readUuidAndHash()
+		if err != nil {
+			return nil, err
+		}
+		return GetResponse{Kind: Kind(arg), UuidAndHash: uuidAndHash}, nil
+	}
+
+	return nil, invalidCommand("'%c%c'", cmd, arg)
+}
+
+func (d *Decoder) setPayload(size int64) {
+	d.payload = io.LimitedReader{R: d.r, N: size}
+}
+
+func (d *Decoder) readUuidAndHash() ([]byte, error) {
+	uuidAndHash := make([]byte, UuidAndHashSize)
+	if _, err := io.ReadFull(d.r, uuidAndHash); err != nil {
+		return nil, unexpected(err)
+	}
+	return uuidAndHash, nil
+}
+
+// Sizes are sixteen hex digits
+func (d *Decoder) readSize() (int64, error) {
+	digits := make([]byte, 16)
+	if _, err := io.ReadFull(d.r, digits); err != nil {
+		return 0, unexpected(err)
+	}
+	size, err := strconv.ParseUint(string(digits), 16, 64)
+	if err != nil || size > math.MaxInt64 {
+		return 0, invalidCommand("size '%s'", digits)
+	}
+	return int64(size), nil
+}
+
+// The stream ending inside a command is never a clean end
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
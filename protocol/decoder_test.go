@@ -0,0 +1,120 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testUuidAndHash = []byte(fmt.Sprintf("%016s%016s", "dead", "beef"))
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected []Command
+		payloads []string
+		err      error
+	}{
+		{"quit", "q", []Command{Quit{}}, nil, io.EOF},
+		{"get", "ga" + string(testUuidAndHash), []Command{Get{KIND_ASSET, testUuidAndHash}}, nil, io.EOF},
+		{"tx", "ts" + string(testUuidAndHash) + "te", []Command{TxStart{testUuidAndHash}, TxEnd{}}, nil, io.EOF},
+		{"put", "pi0000000000000004dataq", []Command{Put{KIND_INFO, 4}, Quit{}}, []string{"data", ""}, io.EOF},
+		{"uppercase size", "pi000000000000000Axxxxxxxxxx", []Command{Put{KIND_INFO, 10}}, []string{"xxxxxxxxxx"}, io.EOF},
+		{"hit", "+r0000000000000002" + string(testUuidAndHash) + "hi", []Command{GetResponse{KIND_RESOURCE, testUuidAndHash, true, 2}}, []string{"hi"}, io.EOF},
+		{"miss", "-a" + string(testUuidAndHash), []Command{GetResponse{KIND_ASSET, testUuidAndHash, false, 0}}, nil, io.EOF},
+		{"unread payload is skipped", "pa0000000000000003abcq", []Command{Put{KIND_ASSET, 3}, Quit{}}, nil, io.EOF},
+		{"empty", "", nil, nil, io.EOF},
+		{"unknown command", "xx", nil, nil, ErrInvalidCommand},
+		{"unknown transaction command", "tx", nil, nil, ErrInvalidCommand},
+		{"unknown kind", "pX0000000000000001x", nil, nil, ErrInvalidCommand},
+		{"get of unknown kind", "gX" + string(testUuidAndHash), []Command{Get{Kind('X'), testUuidAndHash}}, nil, io.EOF},
+		{"bad size", "pazzzzzzzzzzzzzzzz", nil, nil, ErrInvalidCommand},
+		{"signed size", "pa+000000000000001x", nil, nil, ErrInvalidCommand},
+		{"huge size", "paffffffffffffffff", nil, nil, ErrInvalidCommand},
+		{"short command", "g", nil, nil, io.ErrUnexpectedEOF},
+		{"short uuid", "gadead", nil, nil, io.ErrUnexpectedEOF},
+		{"short size", "pa00", nil, nil, io.ErrUnexpectedEOF},
+		{"short payload", "pa0000000000000010abc", []Command{Put{KIND_ASSET, 16}}, nil, io.ErrUnexpectedEOF},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := NewDecoder(strings.NewReader(tc.input))
+			commands := []Command{}
+			var err error
+			for {
+				var cmd Command
+				cmd, err = d.Decode()
+				if err != nil {
+					break
+				}
+				if len(commands) < len(tc.payloads) {
+					payload, _ := ioutil.ReadAll(d.Payload())
+					if string(payload) != tc.payloads[len(commands)] {
+						t.Errorf("Expected payload `%s`, got `%s`", tc.payloads[len(commands)], payload)
+					}
+				}
+				commands = append(commands, cmd)
+			}
+
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Expected error %v, got %v", tc.err, err)
+			}
+			if len(commands) != len(tc.expected) {
+				t.Fatalf("Expected %d commands, got %#v", len(tc.expected), commands)
+			}
+			for i := range commands {
+				if !reflect.DeepEqual(commands[i], tc.expected[i]) {
+					t.Errorf("Expected %#v, got %#v", tc.expected[i], commands[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeClientVersion(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected uint32
+		err      error
+	}{
+		{"000000fe", 0xfe, nil},
+		{"fe", 0xfe, nil},
+		{"000000feq", 0xfe, nil},
+		{"000000ff", 0xff, nil},
+		{"zz", 0, ErrInvalidCommand},
+		{"f", 0, io.ErrUnexpectedEOF},
+	}
+
+	for _, tc := range tests {
+		version, err := NewDecoder(strings.NewReader(tc.input)).DecodeClientVersion()
+		if !errors.Is(err, tc.err) {
+			t.Errorf("Expected error %v decoding `%s`, got %v", tc.err, tc.input, err)
+		}
+		if version.Number != tc.expected {
+			t.Errorf("Expected version %x decoding `%s`, got %x", tc.expected, tc.input, version.Number)
+		}
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	d := NewDecoder(bytes.NewReader([]byte("000000fe-a" + string(testUuidAndHash))))
+	version, err := d.DecodeVersion()
+	if err != nil || version.Number != CurrentVersion {
+		t.Errorf("Expected version %x, got %x, %v", CurrentVersion, version.Number, err)
+	}
+
+	cmd, err := d.Decode()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if _, ok := cmd.(GetResponse); !ok {
+		t.Errorf("Expected a GetResponse after the version, got %#v", cmd)
+	}
+}
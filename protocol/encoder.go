@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+)
+
+// Encoder writes commands to a stream. Each command is written with a single
+// call to Write, so unbuffered connections don't send them in pieces.
+type Encoder struct {
+	w io.Writer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Write a command. Payloads of Puts and GetResponse hits are written by the
+// caller afterwards.
+func (e *Encoder) Encode(cmd Command) error {
+	var buf []byte
+
+	switch c := cmd.(type) {
+	case Version:
+		buf = []byte(fmt.Sprintf("%08x", c.Number))
+	case Get:
+		if err := checkUuidAndHash(c.UuidAndHash); err != nil {
+			return err
+		}
+		buf = append([]byte{'g', byte(c.Kind)}, c.UuidAndHash...)
+	case GetResponse:
+		if err := checkUuidAndHash(c.UuidAndHash); err != nil {
+			return err
+		}
+		if c.Hit {
+			buf = []byte(fmt.Sprintf("+%c%016x", c.Kind, c.Size))
+		} else {
+			buf = []byte{'-', byte(c.Kind)}
+		}
+		buf = append(buf, c.UuidAndHash...)
+	case TxStart:
+		if err := checkUuidAndHash(c.UuidAndHash); err != nil {
+			return err
+		}
+		buf = append([]byte("ts"), c.UuidAndHash...)
+	case Put:
+		buf = []byte(fmt.Sprintf("p%c%016x", c.Kind, c.Size))
+	case TxEnd:
+		buf = []byte("te")
+	case Quit:
+		buf = []byte("q")
+	default:
+		return fmt.Errorf("Cannot encode %T", cmd)
+	}
+
+	_, err := e.w.Write(buf)
+	return err
+}
+
+func checkUuidAndHash(uuidAndHash []byte) error {
+	if len(uuidAndHash) != UuidAndHashSize {
+		return fmt.Errorf("UUID and hash must be %d bytes, got %d", UuidAndHashSize, len(uuidAndHash))
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      Command
+		expected string
+	}{
+		{"version", Version{CurrentVersion}, "000000fe"},
+		{"get", Get{KIND_INFO, testUuidAndHash}, "gi" + string(testUuidAndHash)},
+		{"hit", GetResponse{KIND_ASSET, testUuidAndHash, true, 255}, "+a00000000000000ff" + string(testUuidAndHash)},
+		{"miss", GetResponse{KIND_RESOURCE, testUuidAndHash, false, 0}, "-r" + string(testUuidAndHash)},
+		{"tx start", TxStart{testUuidAndHash}, "ts" + string(testUuidAndHash)},
+		{"put", Put{KIND_ASSET, 16}, "pa0000000000000010"},
+		{"tx end", TxEnd{}, "te"},
+		{"quit", Quit{}, "q"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(tc.cmd); err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+			if buf.String() != tc.expected {
+				t.Errorf("Expected `%s`, got `%s`", tc.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestEncodeRejectsBadUuidAndHash(t *testing.T) {
+	for _, cmd := range []Command{
+		Get{KIND_ASSET, []byte("short")},
+		GetResponse{KIND_ASSET, nil, false, 0},
+		TxStart{make([]byte, 33)},
+	} {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(cmd); err == nil {
+			t.Errorf("Expected error encoding %#v", cmd)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Expected nothing written for %#v, got `%s`", cmd, buf.Bytes())
+		}
+	}
+}
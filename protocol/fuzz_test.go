@@ -0,0 +1,77 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Seed with a few command streams and the server's fuzzing corpus
+func addFuzzCorpus(f *testing.F) {
+	for _, data := range []string{
+		"",
+		"q",
+		"ts" + string(testUuidAndHash) + "pa0000000000000004datate",
+		"ga" + string(testUuidAndHash) + "gi" + string(testUuidAndHash) + "q",
+		"+r0000000000000002" + string(testUuidAndHash) + "hi-a" + string(testUuidAndHash),
+	} {
+		f.Add([]byte(data))
+	}
+
+	paths, err := filepath.Glob("../fuzz/corpus/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+}
+
+// Decode a stream of commands, checking that each one encodes to as many
+// bytes as it was read from, and decodes back to the same command.
+func FuzzDecode(f *testing.F) {
+	addFuzzCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		d := NewDecoder(r)
+
+		for {
+			start := len(data) - r.Len() - d.r.Buffered()
+			cmd, err := d.Decode()
+			if err != nil {
+				return
+			}
+			end := len(data) - r.Len() - d.r.Buffered()
+
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(cmd); err != nil {
+				t.Fatalf("Unexpected error encoding %#v: %s", cmd, err)
+			}
+			if buf.Len() != end-start {
+				t.Fatalf("%#v encoded as %q, decoded from %q", cmd, buf.Bytes(), data[start:end])
+			}
+
+			again, err := NewDecoder(&buf).Decode()
+			if err != nil || !reflect.DeepEqual(cmd, again) {
+				t.Fatalf("%#v decoded again as %#v, %v", cmd, again, err)
+			}
+
+			io.Copy(ioutil.Discard, d.Payload())
+		}
+	})
+}
+
+// Read a client's version handshake
+func FuzzDecodeClientVersion(f *testing.F) {
+	addFuzzCorpus(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		NewDecoder(bytes.NewReader(data)).DecodeClientVersion()
+	})
+}
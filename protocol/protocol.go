@@ -0,0 +1,94 @@
+// Package protocol reads and writes the Unity cache server protocol, as
+// described in protocol.md.
+//
+// Commands are decoded and encoded without their payloads. A Put or a
+// GetResponse that is a hit is followed by Size bytes of data, which are read
+// through Decoder.Payload() and written directly after encoding the command.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The protocol version we speak
+const CurrentVersion uint32 = 0xfe
+
+// Length of the GUID and hash identifying an entry
+const UuidAndHashSize = 32
+
+// Denotes which kind of data goes in the cache
+type Kind byte
+
+const (
+	KIND_ASSET    Kind = 'a'
+	KIND_INFO     Kind = 'i'
+	KIND_RESOURCE Kind = 'r'
+)
+
+func (k Kind) String() string {
+	return string(k)
+}
+
+// Returns true for the kinds of data Unity sends
+func (k Kind) Valid() bool {
+	return k == KIND_ASSET || k == KIND_INFO || k == KIND_RESOURCE
+}
+
+var ErrInvalidCommand = errors.New("Invalid command")
+
+// A command sent by either client or server
+type Command interface {
+	command()
+}
+
+// Version handshake, sent first by the client and echoed by the server if
+// supported. Servers reply 0 to versions they don't support.
+type Version struct {
+	Number uint32
+}
+
+// Request an entry of the given kind. The kind may not be Valid(), and such
+// gets are answered as misses.
+type Get struct {
+	Kind        Kind
+	UuidAndHash []byte
+}
+
+// Response to a Get. Hits are followed by Size bytes of data.
+type GetResponse struct {
+	Kind        Kind
+	UuidAndHash []byte
+	Hit         bool
+	Size        int64
+}
+
+// Start uploading an entry
+type TxStart struct {
+	UuidAndHash []byte
+}
+
+// Upload a kind of the entry in the current transaction, followed by Size
+// bytes of data.
+type Put struct {
+	Kind Kind
+	Size int64
+}
+
+// Commit the current transaction
+type TxEnd struct{}
+
+// Close the connection
+type Quit struct{}
+
+func (Version) command()     {}
+func (Get) command()         {}
+func (GetResponse) command() {}
+func (TxStart) command()     {}
+func (Put) command()         {}
+func (TxEnd) command()       {}
+func (Quit) command()        {}
+
+func invalidCommand(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidCommand, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,144 @@
+package ucs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Parsing of HAProxy's PROXY protocol, which load balancers use to pass on
+// the real client address. See
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errNotProxyHeader = errors.New("Not a PROXY protocol header")
+
+// Read a v1 or v2 PROXY header, returning the source address of the original
+// connection. A nil address means the proxy didn't know (v1 UNKNOWN) or made
+// the connection itself (v2 LOCAL), so the connection's own address should be
+// used.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(5)
+	if err != nil {
+		return nil, err
+	}
+	if string(peek) == "PROXY" {
+		return readProxyHeaderV1(r)
+	}
+
+	peek, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+
+	return nil, errNotProxyHeader
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// The line is at most 107 bytes, CRLF included
+	line := make([]byte, 0, 107)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) == cap(line) {
+			return nil, fmt.Errorf("PROXY v1 header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("PROXY v1 header not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Invalid PROXY v1 header '%s'", line[:len(line)-2])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid PROXY v1 source address '%s'", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid PROXY v1 source port '%s'", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY v2 version %d", header[12]>>4)
+	}
+	command := header[12] & 0x0f
+	family := header[13] >> 4
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL; health checks from the proxy itself
+	if command == 0 {
+		return nil, nil
+	}
+	if command != 1 {
+		return nil, fmt.Errorf("Unsupported PROXY v2 command %d", command)
+	}
+
+	switch family {
+	case 1: // AF_INET
+		if len(body) < 12 {
+			return nil, fmt.Errorf("PROXY v2 IPv4 addresses truncated")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}, nil
+	case 2: // AF_INET6
+		if len(body) < 36 {
+			return nil, fmt.Errorf("PROXY v2 IPv6 addresses truncated")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}, nil
+	default:
+		// AF_UNSPEC or AF_UNIX; nothing we can use
+		return nil, nil
+	}
+}
+
+// A connection with some of its data already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,124 @@
+package ucs
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/msiebuhr/ucs/cache"
+)
+
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1)
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addresses)))
+	header = append(header, length...)
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{10, 1, 2, 3, 192, 168, 0, 1, 0x30, 0x39, 0x1f, 0xbe}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("fd00::1"))
+	copy(v6[16:], net.ParseIP("fd00::2"))
+	binary.BigEndian.PutUint16(v6[32:], 12345)
+
+	tests := []struct {
+		name     string
+		header   []byte
+		expected string
+		err      bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 10.1.2.3 192.168.0.1 12345 8126\r\n"), "10.1.2.3:12345", false},
+		{"v1 tcp6", []byte("PROXY TCP6 fd00::1 fd00::2 12345 8126\r\n"), "[fd00::1]:12345", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 no crlf", []byte("PROXY TCP4 10.1.2.3 192.168.0.1 12345 8126\n"), "", true},
+		{"v1 bad ip", []byte("PROXY TCP4 10.1.2 192.168.0.1 12345 8126\r\n"), "", true},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("x", 200) + "\r\n"), "", true},
+		{"v2 ipv4", proxyV2Header(1, 1, v4), "10.1.2.3:12345", false},
+		{"v2 ipv6", proxyV2Header(1, 2, v6), "[fd00::1]:12345", false},
+		{"v2 local", proxyV2Header(0, 0, []byte{}), "", false},
+		{"v2 truncated", proxyV2Header(1, 1, v4[:4]), "", true},
+		{"not proxy", []byte("000000fe"), "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(append(test.header, "000000fe"...)))
+			addr, err := readProxyHeader(r)
+			if test.err {
+				if err == nil {
+					t.Errorf("Expected error, got address %s", addr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != test.expected {
+				t.Errorf("Expected address '%s', got '%s'", test.expected, got)
+			}
+
+			// The rest of the stream is left alone
+			rest, _ := ioutil.ReadAll(r)
+			if string(rest) != "000000fe" {
+				t.Errorf("Expected rest of stream to be '000000fe', got '%s'", rest)
+			}
+		})
+	}
+}
+
+func TestProxiedClientAddress(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	tx := c.PutTransaction("", []byte(fmt.Sprintf("%016s%016s", "dead", "beef")))
+	tx.Put(4, cache.KIND_INFO, bytes.NewReader([]byte("info")))
+	tx.Commit()
+
+	// Only the proxied address may read
+	acl, _ := ParseACL("10.1.2.3")
+	s := NewServer(func(s *Server) {
+		s.Cache = c
+		s.ReadACL = acl
+	})
+	defer s.Stop()
+
+	laddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxies, _ := ParseACL("127.0.0.1")
+	go s.ListenerWith(context.Background(), listener, ListenOptions{TrustedProxies: proxies})
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(conn, "PROXY TCP4 10.1.2.3 127.0.0.1 12345 8126\r\n")
+	fmt.Fprintf(conn, "%08x", 0xfe)
+	fmt.Fprintf(conn, "gi%016s%016s", "dead", "beef")
+	fmt.Fprintf(conn, "q")
+
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x+i%016x%016s%016sinfo", 0xfe, 4, "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+}
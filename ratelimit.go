@@ -0,0 +1,434 @@
+package ucs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	throttled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_throttled",
+		Help: "Times traffic was held back by rate limits, by limit and the scope it was set for",
+	}, []string{"namespace", "limit", "scope"})
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_throttled_seconds",
+		Help: "Time traffic was held back by rate limits, by limit and the scope it was set for",
+	}, []string{"namespace", "limit", "scope"})
+)
+
+func init() {
+	prometheus.MustRegister(throttled)
+	prometheus.MustRegister(throttledSeconds)
+}
+
+// A token bucket refilled at rate tokens per second, holding up to a second's
+// worth. Takers may go into debt, and are told how long to wait for it to be
+// paid off. A nil bucket or a rate of zero doesn't limit anything.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// Take n tokens, returning how long to wait before using them
+func (b *tokenBucket) take(n int64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > float64(b.rate) {
+		b.tokens = float64(b.rate)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.rate) * float64(time.Second))
+}
+
+// Change the rate, keeping what's saved up within the new limit
+func (b *tokenBucket) setRate(rate int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.rate <= 0 {
+		b.tokens = float64(rate)
+		b.last = time.Now()
+	}
+	b.rate = rate
+	if b.tokens > float64(rate) {
+		b.tokens = float64(rate)
+	}
+}
+
+func (b *tokenBucket) limited() bool {
+	if b == nil {
+		return false
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.rate > 0
+}
+
+// Rates allowed for some traffic. Zero means no limit.
+type Rate struct {
+	// Bytes per second, in each direction
+	Bytes int64 `json:"bytes"`
+
+	// Commands per second read from clients
+	Commands int64 `json:"commands"`
+
+	// Bytes per second of uploads read from clients, on top of Bytes
+	Uploads int64 `json:"uploads"`
+}
+
+// Rate for each client in a network, ex. "10.1.0.0/16" or a single address
+type ClientRate struct {
+	Network string `json:"network"`
+	Rate
+}
+
+// RateLimits sets how fast traffic may flow. Each connection is held to the
+// global rate shared by all connections, its namespace's and its client's.
+type RateLimits struct {
+	Global Rate `json:"global"`
+
+	// Shared by all connections to a namespace. Namespace applies to
+	// those not listed in Namespaces.
+	Namespace  Rate            `json:"namespace"`
+	Namespaces map[string]Rate `json:"namespaces,omitempty"`
+
+	// Shared by all connections from a client address, using the most
+	// specific network it is in
+	Clients []ClientRate `json:"clients,omitempty"`
+}
+
+func (l RateLimits) namespace(ns string) Rate {
+	if rate, ok := l.Namespaces[ns]; ok {
+		return rate
+	}
+	return l.Namespace
+}
+
+// Kinds of limits, indexing rateBuckets
+const (
+	limitBytesIn = iota
+	limitBytesOut
+	limitCommands
+	limitUploads
+)
+
+var limitNames = [...]string{"bytes_in", "bytes_out", "commands", "uploads"}
+
+// Scopes of limits, indexing connLimits.scopes
+var scopeNames = [...]string{"global", "namespace", "client"}
+
+type rateBuckets [4]*tokenBucket
+
+func newRateBuckets(r Rate) *rateBuckets {
+	return &rateBuckets{newTokenBucket(r.Bytes), newTokenBucket(r.Bytes), newTokenBucket(r.Commands), newTokenBucket(r.Uploads)}
+}
+
+func (b *rateBuckets) set(r Rate) {
+	b[limitBytesIn].setRate(r.Bytes)
+	b[limitBytesOut].setRate(r.Bytes)
+	b[limitCommands].setRate(r.Commands)
+	b[limitUploads].setRate(r.Uploads)
+}
+
+type sharedRateBuckets struct {
+	*rateBuckets
+	users int
+}
+
+// RateLimiter holds connections to RateLimits, which may be changed at any
+// time. Set it as Server.RateLimiter on each server sharing the limits.
+//
+// It is also an HTTP handler, serving the limits as JSON on GET and replacing
+// them on PUT.
+type RateLimiter struct {
+	lock sync.Mutex
+
+	limits RateLimits
+	// Parsed limits.Clients networks
+	networks ACL
+
+	// Buckets for the global limit, and the namespaces and clients
+	// currently connected
+	global     *rateBuckets
+	namespaces map[string]*sharedRateBuckets
+	clients    map[string]*sharedRateBuckets
+}
+
+func NewRateLimiter(limits RateLimits) (*RateLimiter, error) {
+	l := &RateLimiter{
+		global:     newRateBuckets(Rate{}),
+		namespaces: make(map[string]*sharedRateBuckets),
+		clients:    make(map[string]*sharedRateBuckets),
+	}
+	return l, l.SetLimits(limits)
+}
+
+// Current limits
+func (l *RateLimiter) Limits() RateLimits {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limits
+}
+
+// Replace the limits, which applies to open connections right away
+func (l *RateLimiter) SetLimits(limits RateLimits) error {
+	rates := []Rate{limits.Global, limits.Namespace}
+	for _, rate := range limits.Namespaces {
+		rates = append(rates, rate)
+	}
+	networks := make(ACL, len(limits.Clients))
+	for i, client := range limits.Clients {
+		acl, err := ParseACL(client.Network)
+		if err != nil {
+			return err
+		}
+		if len(acl) != 1 {
+			return fmt.Errorf("Expected a single network, got '%s'", client.Network)
+		}
+		networks[i] = acl[0]
+		rates = append(rates, client.Rate)
+	}
+	for _, rate := range rates {
+		if rate.Bytes < 0 || rate.Commands < 0 || rate.Uploads < 0 {
+			return fmt.Errorf("Rates can't be negative")
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits = limits
+	l.networks = networks
+	l.global.set(limits.Global)
+	for ns, buckets := range l.namespaces {
+		buckets.set(limits.namespace(ns))
+	}
+	for client, buckets := range l.clients {
+		buckets.set(l.clientRate(client))
+	}
+	return nil
+}
+
+// The rate for a client, from the most specific network it is in. Must be
+// called with the lock held.
+func (l *RateLimiter) clientRate(host string) Rate {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Rate{}
+	}
+
+	best, bestBits := -1, -1
+	for i, network := range l.networks {
+		if !network.Contains(ip) {
+			continue
+		}
+		if bits, _ := network.Mask.Size(); bits > bestBits {
+			best, bestBits = i, bits
+		}
+	}
+	if best < 0 {
+		return Rate{}
+	}
+	return l.limits.Clients[best].Rate
+}
+
+func (l *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut:
+		var limits RateLimits
+		if err := json.NewDecoder(r.Body).Decode(&limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := l.SetLimits(limits); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(l.Limits())
+}
+
+// Get the limits for a new connection, which must be given back with close()
+func (l *RateLimiter) connect(ns, addr string) *connLimits {
+	if l == nil {
+		return nil
+	}
+	client := clientHost(addr)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	n, ok := l.namespaces[ns]
+	if !ok {
+		n = &sharedRateBuckets{rateBuckets: newRateBuckets(l.limits.namespace(ns))}
+		l.namespaces[ns] = n
+	}
+	n.users += 1
+
+	c, ok := l.clients[client]
+	if !ok {
+		c = &sharedRateBuckets{rateBuckets: newRateBuckets(l.clientRate(client))}
+		l.clients[client] = c
+	}
+	c.users += 1
+
+	return &connLimits{
+		limiter:   l,
+		namespace: ns,
+		client:    client,
+		scopes:    [3]*rateBuckets{l.global, n.rateBuckets, c.rateBuckets},
+	}
+}
+
+func releaseRateBuckets(buckets map[string]*sharedRateBuckets, key string) {
+	if b, ok := buckets[key]; ok {
+		b.users -= 1
+		if b.users <= 0 {
+			delete(buckets, key)
+		}
+	}
+}
+
+// The limits a connection is held to. A nil *connLimits doesn't limit
+// anything.
+type connLimits struct {
+	limiter   *RateLimiter
+	namespace string
+	client    string
+	scopes    [3]*rateBuckets
+}
+
+func (c *connLimits) close() {
+	if c == nil {
+		return
+	}
+
+	c.limiter.lock.Lock()
+	defer c.limiter.lock.Unlock()
+
+	releaseRateBuckets(c.limiter.namespaces, c.namespace)
+	releaseRateBuckets(c.limiter.clients, c.client)
+}
+
+// Count n of some kind of traffic, waiting if it goes over any limit
+func (c *connLimits) wait(limit int, n int64) {
+	if c == nil || n <= 0 {
+		return
+	}
+
+	var wait time.Duration
+	scope := 0
+	for i, buckets := range c.scopes {
+		if d := buckets[limit].take(n); d > wait {
+			wait, scope = d, i
+		}
+	}
+	if wait <= 0 {
+		return
+	}
+
+	throttled.WithLabelValues(c.namespace, limitNames[limit], scopeNames[scope]).Inc()
+	throttledSeconds.WithLabelValues(c.namespace, limitNames[limit], scopeNames[scope]).Add(wait.Seconds())
+	time.Sleep(wait)
+}
+
+// Is some kind of traffic limited at all?
+func (c *connLimits) limited(limit int) bool {
+	if c == nil {
+		return false
+	}
+	for _, buckets := range c.scopes {
+		if buckets[limit].limited() {
+			return true
+		}
+	}
+	return false
+}
+
+// Largest chunk written at a time when throttling
+const throttleChunkSize = 32 * 1024
+
+// Counts data read from a client against its limits
+type throttledReader struct {
+	r      io.Reader
+	limits *connLimits
+}
+
+func (t *throttledReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	t.limits.wait(limitBytesIn, int64(n))
+	return n, err
+}
+
+// Counts data written to a client against its limits
+type throttledWriter struct {
+	w      io.Writer
+	limits *connLimits
+}
+
+func (t *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		t.limits.wait(limitBytesOut, int64(len(chunk)))
+
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unless limited, let the connection copy by itself, which may avoid copying
+// files through userspace
+func (t *throttledWriter) ReadFrom(r io.Reader) (int64, error) {
+	if rf, ok := t.w.(io.ReaderFrom); ok && !t.limits.limited(limitBytesOut) {
+		return rf.ReadFrom(r)
+	}
+	return io.CopyBuffer(struct{ io.Writer }{t}, r, make([]byte, throttleChunkSize))
+}
@@ -0,0 +1,262 @@
+package ucs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/msiebuhr/ucs/cache"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(1000)
+	if wait := b.take(1000); wait != 0 {
+		t.Errorf("Expected a full bucket to not wait, got %s", wait)
+	}
+	if wait := b.take(500); wait < 400*time.Millisecond || wait > 500*time.Millisecond {
+		t.Errorf("Expected to wait ~500ms going 500 tokens into debt, got %s", wait)
+	}
+
+	var unlimited *tokenBucket
+	if wait := unlimited.take(1e9); wait != 0 {
+		t.Errorf("Expected nil bucket to not wait, got %s", wait)
+	}
+}
+
+func TestRateLimiterClientRates(t *testing.T) {
+	l, err := NewRateLimiter(RateLimits{Clients: []ClientRate{
+		{"10.0.0.0/8", Rate{Bytes: 100}},
+		{"10.1.0.0/16", Rate{Bytes: 10}},
+		{"::/0", Rate{Commands: 5}},
+	}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	for host, expected := range map[string]Rate{
+		"10.2.0.1":  {Bytes: 100},
+		"10.1.0.1":  {Bytes: 10},
+		"127.0.0.1": {},
+		"::1":       {Commands: 5},
+		"":          {},
+	} {
+		if rate := l.clientRate(host); rate != expected {
+			t.Errorf("Expected %s to get %+v, got %+v", host, expected, rate)
+		}
+	}
+}
+
+func TestRateLimiterRejectsBadLimits(t *testing.T) {
+	for _, limits := range []RateLimits{
+		{Global: Rate{Bytes: -1}},
+		{Namespaces: map[string]Rate{"zz": {Commands: -1}}},
+		{Clients: []ClientRate{{Network: "10.0.0.0/33"}}},
+		{Clients: []ClientRate{{Network: "10.0.0.1,10.0.0.2"}}},
+	} {
+		if _, err := NewRateLimiter(limits); err == nil {
+			t.Errorf("Expected error for %+v", limits)
+		}
+	}
+}
+
+func TestRateLimiterChangesOpenConnections(t *testing.T) {
+	l, _ := NewRateLimiter(RateLimits{})
+	c := l.connect("zz", "10.0.0.1:1234")
+	if c.limited(limitBytesOut) {
+		t.Errorf("Expected no limits")
+	}
+
+	l.SetLimits(RateLimits{Namespaces: map[string]Rate{"zz": {Bytes: 1000}}})
+	if !c.limited(limitBytesOut) || c.limited(limitCommands) {
+		t.Errorf("Expected bytes to be limited after changing limits")
+	}
+
+	l.SetLimits(RateLimits{Clients: []ClientRate{{"10.0.0.1", Rate{Commands: 10}}}})
+	if c.limited(limitBytesOut) || !c.limited(limitCommands) {
+		t.Errorf("Expected only commands to be limited after changing limits")
+	}
+
+	c.close()
+	if len(l.namespaces) != 0 || len(l.clients) != 0 {
+		t.Errorf("Expected buckets to be dropped after closing, got %d/%d", len(l.namespaces), len(l.clients))
+	}
+}
+
+func TestRateLimiterHTTP(t *testing.T) {
+	l, _ := NewRateLimiter(RateLimits{Global: Rate{Bytes: 1000}})
+	server := httptest.NewServer(l)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"global":{"commands":50},"clients":[{"network":"10.0.0.0/8","bytes":100}]}`))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 OK, got %s", res.Status)
+	}
+	limits := l.Limits()
+	if limits.Global != (Rate{Commands: 50}) || len(limits.Clients) != 1 || limits.Clients[0].Bytes != 100 {
+		t.Errorf("Expected limits to be replaced, got %+v", limits)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL, strings.NewReader(`{"global":{"bytes":-5}}`))
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 Bad Request, got %s", res.Status)
+	}
+
+	res, err = http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if !bytes.Contains(body, []byte(`"network":"10.0.0.0/8","bytes":100`)) {
+		t.Errorf("Expected current limits, got %s", body)
+	}
+}
+
+func TestRateLimitedGets(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	data := make([]byte, 96*1024)
+	tx := c.PutTransaction("", []byte(fmt.Sprintf("%016s%016s", "dead", "beef")))
+	tx.Put(int64(len(data)), cache.KIND_ASSET, bytes.NewReader(data))
+	tx.Commit()
+
+	for _, tc := range []struct {
+		name   string
+		limits RateLimits
+	}{
+		{"bytes", RateLimits{Global: Rate{Bytes: 64 * 1024}}},
+		{"commands", RateLimits{Clients: []ClientRate{{"10.0.0.0/8", Rate{Commands: 1}}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter, _ := NewRateLimiter(tc.limits)
+			client, server := net.Pipe()
+			s := NewServer(func(s *Server) {
+				s.Cache = c
+				s.RateLimiter = limiter
+			})
+			defer s.Stop()
+			go s.handleRequest(context.WithValue(context.Background(), "addr", "10.0.0.1:1234"), server)
+
+			// Either the response goes 32k over the bytes limit, or
+			// the quit command goes one over the command limit
+			start := time.Now()
+			go func() {
+				fmt.Fprintf(client, "%08x", 0xfe)
+				fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+				client.Write([]byte("q"))
+			}()
+
+			out, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Errorf("Error reading response: %s", err)
+			}
+			if elapsed := time.Now().Sub(start); elapsed < 400*time.Millisecond {
+				t.Errorf("Expected to be throttled, took %s", elapsed)
+			}
+			expected := fmt.Sprintf("%08x+a%016x%016s%016s", 0xfe, len(data), "dead", "beef")
+			if !bytes.HasPrefix(out, []byte(expected)) || len(out) != len(expected)+len(data) {
+				t.Errorf("Expected a hit, got `%.80s`", out)
+			}
+		})
+	}
+}
+
+func TestRateLimitedUploads(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		limits RateLimits
+	}{
+		{"namespace", RateLimits{Namespace: Rate{Bytes: 64 * 1024}}},
+		{"client", RateLimits{Clients: []ClientRate{{"10.0.0.0/8", Rate{Bytes: 64 * 1024}}}}},
+		{"uploads", RateLimits{Clients: []ClientRate{{"10.0.0.0/8", Rate{Uploads: 64 * 1024}}}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			limiter, _ := NewRateLimiter(tc.limits)
+			client, server := net.Pipe()
+			s := NewServer(func(s *Server) {
+				s.Cache = cache.NewMemory(1e6)
+				s.RateLimiter = limiter
+			})
+			defer s.Stop()
+			go s.handleRequest(context.WithValue(context.Background(), "addr", "10.0.0.1:1234"), server)
+
+			// A full bucket lets the first 64k through, so the
+			// next 32k have to wait ~500ms
+			data := make([]byte, 96*1024)
+			start := time.Now()
+			go func() {
+				fmt.Fprintf(client, "%08x", 0xfe)
+				fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+				fmt.Fprintf(client, "pa%016x", len(data))
+				client.Write(data)
+				fmt.Fprintf(client, "te")
+				fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+				client.Write([]byte("q"))
+			}()
+
+			out, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Errorf("Error reading response: %s", err)
+			}
+			if elapsed := time.Now().Sub(start); elapsed < 400*time.Millisecond {
+				t.Errorf("Expected upload to be throttled, took %s", elapsed)
+			}
+			expected := fmt.Sprintf("%08x+a%016x%016s%016s", 0xfe, len(data), "dead", "beef")
+			if !bytes.HasPrefix(out, []byte(expected)) || len(out) != len(expected)+len(data) {
+				t.Errorf("Expected upload to be stored, got `%.80s`", out)
+			}
+		})
+	}
+}
+
+func TestUploadLimitsLeaveGets(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	data := make([]byte, 256*1024)
+	tx := c.PutTransaction("", []byte(fmt.Sprintf("%016s%016s", "dead", "beef")))
+	tx.Put(int64(len(data)), cache.KIND_ASSET, bytes.NewReader(data))
+	tx.Commit()
+
+	limiter, _ := NewRateLimiter(RateLimits{Namespace: Rate{Uploads: 64 * 1024}})
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) {
+		s.Cache = c
+		s.RateLimiter = limiter
+	})
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	start := time.Now()
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	if elapsed := time.Now().Sub(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected get not to be throttled, took %s", elapsed)
+	}
+	expected := fmt.Sprintf("%08x+a%016x%016s%016s", 0xfe, len(data), "dead", "beef")
+	if !bytes.HasPrefix(out, []byte(expected)) || len(out) != len(expected)+len(data) {
+		t.Errorf("Expected a hit, got `%.80s`", out)
+	}
+}
@@ -0,0 +1,146 @@
+package ucs
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	putDelay = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "ucs_server_put_delay_seconds",
+		Help: "Time uploads were held back, by reason (priority)",
+	}, []string{"namespace", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(putDelay)
+}
+
+// Scheduler gives gets priority over uploads across all servers sharing it,
+// as they compete for the same disk. Uploads are read in chunks, each of which
+// waits while gets are waiting on the cache. Gets being sent to clients don't
+// hold uploads up. Set it as Server.Scheduler on each server.
+type Scheduler struct {
+	// Longest each chunk of an upload waits, so uploads still make
+	// progress on busy servers. Zero doesn't prioritize gets.
+	MaxPutDelay time.Duration
+
+	lock sync.Mutex
+	gets int
+
+	// Closed once no gets are active
+	idle chan bool
+}
+
+func NewScheduler(maxPutDelay time.Duration) *Scheduler {
+	return &Scheduler{MaxPutDelay: maxPutDelay}
+}
+
+// Number of gets currently waiting on the cache
+func (s *Scheduler) ActiveGets() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.gets
+}
+
+func (s *Scheduler) beginGet() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.gets == 0 {
+		s.idle = make(chan bool)
+	}
+	s.gets += 1
+}
+
+func (s *Scheduler) endGet() {
+	if s == nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.gets -= 1
+	if s.gets == 0 {
+		close(s.idle)
+	}
+}
+
+// Wait for active gets to finish, for at most MaxPutDelay. Returns how long
+// we waited.
+func (s *Scheduler) yield() time.Duration {
+	if s == nil || s.MaxPutDelay <= 0 {
+		return 0
+	}
+
+	s.lock.Lock()
+	if s.gets == 0 {
+		s.lock.Unlock()
+		return 0
+	}
+	idle := s.idle
+	s.lock.Unlock()
+
+	start := time.Now()
+	timer := time.NewTimer(s.MaxPutDelay)
+	defer timer.Stop()
+	select {
+	case <-idle:
+	case <-timer.C:
+	}
+	return time.Now().Sub(start)
+}
+
+// Largest chunk of an upload read at a time
+const uploadChunkSize = 32 * 1024
+
+// Reads the payload of an upload, yielding to gets and holding it to the
+// upload rate limits. As uploads held back by either can take a while, the
+// read deadline is extended for each chunk.
+type uploadReader struct {
+	r         io.Reader
+	namespace string
+	scheduler *Scheduler
+	limits    *connLimits
+
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Read an upload's payload from a connection
+func (s *Server) uploadReader(r io.Reader, conn net.Conn, limits *connLimits) *uploadReader {
+	return &uploadReader{
+		r:         r,
+		namespace: s.Namespace,
+		scheduler: s.Scheduler,
+		limits:    limits,
+		conn:      conn,
+		timeout:   s.IdleTimeout,
+	}
+}
+
+func (u *uploadReader) Read(b []byte) (int, error) {
+	if len(b) > uploadChunkSize {
+		b = b[:uploadChunkSize]
+	}
+
+	if waited := u.scheduler.yield(); waited > 0 {
+		putDelay.WithLabelValues(u.namespace, "priority").Observe(waited.Seconds())
+	}
+
+	if u.conn != nil && u.timeout > 0 {
+		u.conn.SetReadDeadline(time.Now().Add(u.timeout))
+	}
+	n, err := u.r.Read(b)
+	u.limits.wait(limitUploads, int64(n))
+	return n, err
+}
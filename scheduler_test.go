@@ -0,0 +1,82 @@
+package ucs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/msiebuhr/ucs/cache"
+)
+
+func TestSchedulerYieldsToGets(t *testing.T) {
+	s := NewScheduler(time.Second)
+	if waited := s.yield(); waited != 0 {
+		t.Errorf("Expected no wait without gets, got %s", waited)
+	}
+
+	s.beginGet()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.endGet()
+	}()
+	if waited := s.yield(); waited < 40*time.Millisecond || waited > 500*time.Millisecond {
+		t.Errorf("Expected to wait for the get to end, waited %s", waited)
+	}
+
+	// Uploads aren't starved by gets that keep going
+	s.MaxPutDelay = 50 * time.Millisecond
+	s.beginGet()
+	defer s.endGet()
+	if waited := s.yield(); waited < 40*time.Millisecond || waited > 500*time.Millisecond {
+		t.Errorf("Expected to wait at most MaxPutDelay, waited %s", waited)
+	}
+
+	var none *Scheduler
+	if waited := none.yield(); waited != 0 {
+		t.Errorf("Expected nil scheduler to not wait, got %s", waited)
+	}
+}
+
+func TestUploadsDontWaitForGetsBeingSent(t *testing.T) {
+	c := cache.NewMemory(1e6)
+	scheduler := NewScheduler(time.Second)
+	s := NewServer(func(s *Server) { s.Cache = c; s.Scheduler = scheduler })
+	defer s.Stop()
+
+	tx := c.PutTransaction("", []byte(fmt.Sprintf("%016s%016s", "dead", "beef")))
+	tx.Put(4, cache.KIND_ASSET, bytes.NewReader([]byte("data")))
+	tx.Commit()
+
+	// A client that asks for an entry, but doesn't read the response
+	slow, server := net.Pipe()
+	defer slow.Close()
+	go s.handleRequest(context.Background(), server)
+	fmt.Fprintf(slow, "%08x", 0xfe)
+	io.ReadFull(slow, make([]byte, 8))
+	fmt.Fprintf(slow, "ga%016s%016s", "dead", "beef")
+	time.Sleep(50 * time.Millisecond)
+
+	client, server := net.Pipe()
+	go s.handleRequest(context.Background(), server)
+
+	data := make([]byte, 96*1024)
+	start := time.Now()
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "0000", "0001")
+		fmt.Fprintf(client, "pa%016x", len(data))
+		client.Write(data)
+		fmt.Fprintf(client, "te")
+		client.Write([]byte("q"))
+	}()
+	ioutil.ReadAll(client)
+
+	if elapsed := time.Now().Sub(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected upload not to wait for the get being sent, took %s", elapsed)
+	}
+}
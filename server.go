@@ -3,16 +3,21 @@ package ucs
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"strconv"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/msiebuhr/ucs/cache"
+	"github.com/msiebuhr/ucs/protocol"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -43,6 +48,26 @@ var (
 		Name: "ucs_server_put_duration_seconds",
 		Help: "Time spent receiving data",
 	}, []string{"namespace", "type"})
+	denied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_denied",
+		Help: "Operations denied by access control",
+	}, []string{"namespace", "op"})
+	putFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_put_failures",
+		Help: "Uploads that could not be stored, by reason",
+	}, []string{"namespace", "reason"})
+	getQueueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ucs_server_get_queue_depth",
+		Help: "Get requests read but not yet answered",
+	}, []string{"namespace"})
+	getBackendWait = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+		Name: "ucs_server_get_backend_wait_seconds",
+		Help: "Time spent waiting on the cache before a get response could be sent",
+	}, []string{"namespace"})
+	oversizedPuts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ucs_server_oversized_puts",
+		Help: "Uploads discarded for exceeding size limits",
+	}, []string{"namespace", "type"})
 )
 
 func init() {
@@ -52,10 +77,15 @@ func init() {
 	prometheus.MustRegister(putBytes)
 	prometheus.MustRegister(getDurations)
 	prometheus.MustRegister(putDurations)
+	prometheus.MustRegister(denied)
+	prometheus.MustRegister(oversizedPuts)
+	prometheus.MustRegister(putFailures)
+	prometheus.MustRegister(getQueueDepth)
+	prometheus.MustRegister(getBackendWait)
 }
 
 func PrettyUuidAndHash(d []byte) string {
-	return fmt.Sprintf("%x/%x", d[:16], d[17:])
+	return fmt.Sprintf("%x/%x", d[:16], d[16:])
 }
 
 type Server struct {
@@ -63,8 +93,59 @@ type Server struct {
 	Log       *log.Logger
 	Namespace string
 
+	// Who may get and put things. Nil allows everyone.
+	ReadACL  ACL
+	WriteACL ACL
+
+	// Discard all uploads
+	ReadOnly bool
+
+	// Largest upload allowed per kind, and for all kinds in a transaction.
+	// Transactions going over are discarded. Zero means no limit.
+	MaxPutSize         map[cache.Kind]int64
+	MaxTransactionSize int64
+
+	// Get requests to look up in the cache at once on each connection.
+	// Responses are still sent in order.
+	GetWindow int
+
+	// Connections allowed at once to this server. Zero means no limit.
+	MaxConnections int
+
+	// Shared limit on connections across servers. Nil means no limit.
+	ConnectionManager *ConnectionManager
+
+	// Time allowed for PROXY headers, TLS and version handshakes
+	HandshakeTimeout time.Duration
+
+	// Time allowed between commands, and between chunks of an upload
+	IdleTimeout time.Duration
+
+	// Connections are asked to finish up after this long. Zero means no
+	// limit.
+	MaxSessionTime time.Duration
+
+	// Gives gets priority over uploads, shared across servers. Nil
+	// doesn't prioritize.
+	Scheduler *Scheduler
+
+	// Limits on bytes and commands per second, shared across servers. Nil
+	// means no limits.
+	RateLimiter *RateLimiter
+
 	closer    chan bool
 	waitGroup *sync.WaitGroup
+
+	// Guards closing closer, adding to waitGroup, sessions and accepting
+	lock     sync.Mutex
+	stopping bool
+	sessions map[*session]bool
+
+	// When the accept loop for each listener last came round
+	accepting map[net.Listener]time.Time
+
+	// Number of connections currently being handled
+	connections int64
 }
 
 // Set up a new server
@@ -73,8 +154,15 @@ func NewServer(options ...func(*Server)) *Server {
 		Cache:     cache.NewNOP(),
 		Log:       log.New(ioutil.Discard, "", 0),
 		Namespace: "",
+
+		HandshakeTimeout: 30 * time.Second,
+		IdleTimeout:      5 * time.Minute,
+		GetWindow:        8,
+
 		closer:    make(chan bool, 1),
 		waitGroup: &sync.WaitGroup{},
+		sessions:  make(map[*session]bool),
+		accepting: make(map[net.Listener]time.Time),
 	}
 
 	for _, f := range options {
@@ -84,24 +172,72 @@ func NewServer(options ...func(*Server)) *Server {
 	return s
 }
 
+// Settings for a single listener
+type ListenOptions struct {
+	// Wrap connections in TLS using this config. Nil serves plain
+	// connections.
+	TLS *tls.Config
+
+	// Read PROXY protocol headers on connections from these addresses, and
+	// treat the address given there as the client's. Empty disables PROXY
+	// protocol.
+	TrustedProxies ACL
+}
+
 func (s *Server) Listen(ctx context.Context, address string) error {
-	laddr, err := net.ResolveTCPAddr("tcp", address)
-	if nil != err {
-		s.log(ctx, "Error resolving address:", err.Error())
-		return err
+	return s.ListenWith(ctx, address, ListenOptions{})
+}
+
+// Listen for TLS-encrypted connections on the given address. A server can
+// listen on any number of plain and TLS addresses at the same time.
+func (s *Server) ListenTLS(ctx context.Context, address string, config *tls.Config) error {
+	return s.ListenWith(ctx, address, ListenOptions{TLS: config})
+}
+
+// Open a listener on the given address, which is either a TCP address (ex.
+// ":8126") or a path to a unix socket prefixed with "unix:" (ex.
+// "unix:/run/ucs/default.sock").
+func Bind(address string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "unix:") {
+		network = "unix"
+		address = strings.TrimPrefix(address, "unix:")
+
+		// Remove stale sockets left behind by earlier runs
+		if stat, err := os.Stat(address); err == nil && stat.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
 	}
-	listener, err := net.ListenTCP("tcp", laddr)
+
+	return net.Listen(network, address)
+}
+
+// Listen on the given address; see Bind() for the format.
+func (s *Server) ListenWith(ctx context.Context, address string, options ListenOptions) error {
+	listener, err := Bind(address)
 	if err != nil {
 		s.log(ctx, "Error listening:", err.Error())
 		return err
 	}
 	defer listener.Close()
-	s.logf(ctx, "Listening on %s", listener.Addr())
+	s.logf(ctx, "Listening on %s tls=%t proxies=%s", listener.Addr(), options.TLS != nil, options.TrustedProxies)
+
+	return s.ListenerWith(ctx, listener, options)
+}
+
+func (s *Server) Listener(ctx context.Context, listener net.Listener) error {
+	return s.ListenerWith(ctx, listener, ListenOptions{})
+}
 
-	return s.Listener(ctx, listener)
+// Serve connections from the given listener, wrapping them in TLS using the
+// given config. A nil config serves plain connections.
+func (s *Server) ListenerTLS(ctx context.Context, listener net.Listener, config *tls.Config) error {
+	return s.ListenerWith(ctx, listener, ListenOptions{TLS: config})
 }
 
-func (s *Server) Listener(ctx context.Context, listener *net.TCPListener) error {
+// Serve connections from any kind of listener, ex. TCP, unix sockets or ones
+// handed over by systemd. The listener is closed when the server is stopped.
+func (s *Server) ListenerWith(ctx context.Context, listener net.Listener, options ListenOptions) error {
 	// Enrich context with current namespace
 	if s.Namespace != "" {
 		ctx = context.WithValue(ctx, "namespace", s.Namespace)
@@ -120,43 +256,232 @@ func (s *Server) Listener(ctx context.Context, listener *net.TCPListener) error
 		putDurations.WithLabelValues(s.Namespace, (kind))
 	}
 
-	for {
+	// Close the listener when stopping, which makes Accept() return
+	done := make(chan bool)
+	defer close(done)
+	go func() {
 		select {
 		case <-s.closer:
 			s.log(ctx, "Stopping listening")
 			listener.Close()
-			return nil
-		default:
+		case <-done:
 		}
-		listener.SetDeadline(time.Now().Add(1 * time.Second))
-		conn, err := listener.AcceptTCP()
+	}()
+
+	// Wake up now and then, so it can be told the loop is still alive
+	waker, canWake := listener.(interface{ SetDeadline(time.Time) error })
+	s.lock.Lock()
+	s.accepting[listener] = time.Time{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.accepting, listener)
+		s.lock.Unlock()
+	}()
+
+	for {
+		if canWake {
+			s.lock.Lock()
+			s.accepting[listener] = time.Now()
+			s.lock.Unlock()
+			waker.SetDeadline(time.Now().Add(acceptWakeup))
+		}
+
+		conn, err := listener.Accept()
 		if nil != err {
-			// Ignore timeout errors -- we have those so we'll also take a peek at the closer-channel.
-			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			select {
+			case <-s.closer:
+				return nil
+			default:
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && canWake {
 				continue
 			}
 
-			// Genuine error - log and try again
+			// Genuine error - log and try again, unless the listener is
+			// broken for good
 			s.log(ctx, "Error accepting: ", err.Error())
-			continue
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return err
 		}
-		//s.waitGroup.Add(1)
 		connCtx := context.WithValue(ctx, "addr", conn.RemoteAddr().String())
+
+		if reason := s.acquire(); reason != "" {
+			rejectedConnections.WithLabelValues(s.Namespace, reason).Inc()
+			s.log(connCtx, "Rejecting connection:", reason)
+			conn.Close()
+			continue
+		}
+		if !s.track() {
+			s.release()
+			conn.Close()
+			return nil
+		}
+
 		s.log(connCtx, "Connected")
-		go s.handleRequest(connCtx, conn)
+		go func() {
+			defer s.waitGroup.Done()
+			defer s.release()
+			s.serveConn(connCtx, conn, options)
+		}()
 	}
 }
 
+// How often accept loops come round when there are no connections
+const acceptWakeup = time.Second
+
+// Whether connections on the listener are being accepted, with the accept
+// loop having come round within the given time. Listeners that can't time out
+// accepts only come round upon connections, so for those it's only checked
+// that the loop is running.
+func (s *Server) Accepting(listener net.Listener, within time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	last, ok := s.accepting[listener]
+	return ok && (last.IsZero() || time.Now().Sub(last) < within)
+}
+
+// Count a new connection against the limits. Returns why it was rejected, or
+// an empty string if it may be handled.
+func (s *Server) acquire() string {
+	n := atomic.AddInt64(&s.connections, 1)
+	if s.MaxConnections > 0 && n > int64(s.MaxConnections) {
+		atomic.AddInt64(&s.connections, -1)
+		return "namespace_limit"
+	}
+	if s.ConnectionManager != nil && !s.ConnectionManager.acquire() {
+		atomic.AddInt64(&s.connections, -1)
+		return "global_limit"
+	}
+	activeConnections.WithLabelValues(s.Namespace).Inc()
+	return ""
+}
+
+func (s *Server) release() {
+	atomic.AddInt64(&s.connections, -1)
+	if s.ConnectionManager != nil {
+		s.ConnectionManager.release()
+	}
+	activeConnections.WithLabelValues(s.Namespace).Dec()
+}
+
+// Add a connection to what Shutdown waits for. Returns false if we're already
+// shutting down.
+func (s *Server) track() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopping {
+		return false
+	}
+	s.waitGroup.Add(1)
+	return true
+}
+
+// Unwrap PROXY protocol and TLS from a new connection and handle it
+func (s *Server) serveConn(ctx context.Context, conn net.Conn, options ListenOptions) {
+	if len(options.TrustedProxies) > 0 && options.TrustedProxies.Allows(conn.RemoteAddr().String()) {
+		conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
+		r := bufio.NewReader(conn)
+		addr, err := readProxyHeader(r)
+		if err != nil {
+			s.log(ctx, "Error reading PROXY header:", err)
+			conn.Close()
+			return
+		}
+		if addr != nil {
+			ctx = context.WithValue(ctx, "proxy", conn.RemoteAddr().String())
+			ctx = context.WithValue(ctx, "addr", addr.String())
+			s.log(ctx, "Proxied connection")
+		}
+		conn = &bufferedConn{Conn: conn, r: r}
+	}
+
+	if options.TLS != nil {
+		// The handshake happens upon the first read, so it's covered
+		// by the deadline handleRequest sets for the version check.
+		conn = tls.Server(conn, options.TLS)
+	}
+
+	s.handleRequest(ctx, conn)
+}
+
+// Number of connections currently being handled
+func (s *Server) Connections() int64 {
+	return atomic.LoadInt64(&s.connections)
+}
+
+// Stop the server, waiting for connections to finish up
 func (s *Server) Stop() {
-	close(s.closer)
-	s.waitGroup.Wait()
+	s.Shutdown(context.Background())
+}
+
+// Shutdown stops accepting connections and asks the open ones to finish up:
+// They stop reading new commands once any open transaction is done, and
+// close after sending the responses to gets they have already read. If the
+// context expires first, the remaining connections are closed and its error
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	if !s.stopping {
+		s.stopping = true
+		close(s.closer)
+	}
+	for sess := range s.sessions {
+		sess.drain()
+	}
+	s.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		s.waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for sess := range s.sessions {
+			sess.conn.Close()
+		}
+		s.lock.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Register a connection so Shutdown can drain it
+func (s *Server) startSession(conn net.Conn) *session {
+	sess := &session{conn: conn}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sessions[sess] = true
+	if s.stopping {
+		sess.drain()
+	}
+	return sess
+}
+
+func (s *Server) endSession(sess *session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.sessions, sess)
 }
 
 func (s *Server) log(ctx context.Context, rest ...interface{}) {
 	// Extract and sort values from ctx
 	values := make([]interface{}, 0)
 
-	keys := []string{"namespace", "addr"}
+	keys := []string{"namespace", "addr", "proxy"}
 	for _, key := range keys {
 		value := ctx.Value(key)
 		if value != nil {
@@ -173,135 +498,196 @@ func (s *Server) logf(ctx context.Context, format string, rest ...interface{}) {
 	s.log(ctx, fmt.Sprintf(format, rest...))
 }
 
-func readVersionNumber(rw *bufio.ReadWriter) (uint32, error) {
-	// Peek at some data so we force it to wait for some data so we don't get
-	// zero buffer sizes all the time...
-	rw.Reader.Peek(2)
-
-	// See how much data is waiting for us.
-	bytesToRead := rw.Reader.Buffered()
-	// We want to read at most eight hex decimals
-	if bytesToRead > 8 {
-		bytesToRead = 8
-	}
-	// And at least two.
-	if bytesToRead < 2 {
-		bytesToRead = 2
+// The host part of a client's address, so all its connections are limited
+// together
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
+	return addr
+}
 
-	bytes := make([]byte, bytesToRead)
-	_, err := io.ReadFull(rw, bytes)
-	if err != nil {
-		return 0, err
-	}
+// Reads a put's payload from the client, remembering if the client failed us
+type putReader struct {
+	r   *io.LimitedReader
+	err error
+}
 
-	// Convert number from hex to a real one
-	n, err := strconv.ParseUint(string(bytes), 16, 32)
-	return uint32(n), err
+func (p *putReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	return n, err
 }
 
 type serverGetRequest struct {
 	kind        cache.Kind
 	uuidAndHash []byte
+
+	// Denied by access control; always answered with a miss
+	denied bool
+
+	// Result of looking up the request in the cache
+	result chan serverGetResult
 }
 
-// Responds to Get requests queued up in the reqs-channel.
+type serverGetResult struct {
+	size   int64
+	reader io.ReadCloser
+	err    error
+}
+
+// Look up a request in the cache, unless it was denied
+func (s *Server) lookup(req *serverGetRequest) {
+	if req.denied || !req.kind.Valid() {
+		req.result <- serverGetResult{}
+		return
+	}
+	s.Scheduler.beginGet()
+	size, reader, err := s.Cache.Get(s.Namespace, req.kind, req.uuidAndHash)
+	s.Scheduler.endGet()
+	req.result <- serverGetResult{size, reader, err}
+}
+
+// Responds to Get requests queued up in the reqs-channel. Up to GetWindow
+// requests are looked up in the cache at once, but responses are written in
+// the order the requests came in.
 func (s *Server) respondToGetRequests(ctx context.Context, w io.Writer, reqs chan *serverGetRequest) error {
-	var start time.Time
+	window := s.GetWindow
+	if window < 1 {
+		window = 1
+	}
 
-	for req := range reqs {
-		start = time.Now()
-		size, reader, err := s.Cache.Get(s.Namespace, req.kind, req.uuidAndHash)
-		/*
-			s.logf(
-				ctx,
-				"Get kind=%c uuidAndHash=%s size=%d err=%v hit=%t",
-				req.kind, PrettyUuidAndHash(req.uuidAndHash), size, err, size > 0 && err == nil,
-			)
-		*/
-
-		// Treat internal errors as MISS
-		if err != nil {
-			s.log(ctx, "Error getting from cache:", err)
+	// Requests being looked up, in order. Slots are taken before starting
+	// a lookup and given back once its response is written.
+	pending := make(chan *serverGetRequest, window)
+	slots := make(chan bool, window)
+	go func() {
+		defer close(pending)
+		for req := range reqs {
+			slots <- true
+			req.result = make(chan serverGetResult, 1)
+			go s.lookup(req)
+			pending <- req
 		}
+	}()
 
-		if err != nil || size == 0 {
-			getCacheHit.WithLabelValues(s.Namespace, string(req.kind), "miss").Inc()
-			_, err = fmt.Fprintf(w, "-%c%s", req.kind, req.uuidAndHash)
-			if err != nil {
-				return err
-			}
-			if reader != nil {
-				reader.Close()
-			}
-			continue
+	var sendError error
+	for req := range pending {
+		waitStart := time.Now()
+		result := <-req.result
+		getBackendWait.WithLabelValues(s.Namespace).Observe(time.Now().Sub(waitStart).Seconds())
+
+		// Once the client is gone, just clean up after the lookups
+		if sendError == nil {
+			sendError = s.respondToGetRequest(ctx, w, req, result)
+		} else if result.reader != nil {
+			result.reader.Close()
 		}
+		getQueueDepth.WithLabelValues(s.Namespace).Dec()
+		<-slots
+	}
+	return sendError
+}
 
-		// Everything's A-OK
-		_, err = fmt.Fprintf(w, "+%c%016x%s", req.kind, size, req.uuidAndHash)
-		if err != nil {
-			return err
-		}
-		_, err = io.Copy(w, reader)
-		if err != nil {
-			return err
-		}
-		reader.Close()
-		getCacheHit.WithLabelValues(s.Namespace, string(req.kind), "hit").Inc()
-		getBytes.WithLabelValues(s.Namespace, string(req.kind)).Observe(float64(size))
-		getDurations.WithLabelValues(s.Namespace, string(req.kind)).Observe(time.Now().Sub(start).Seconds())
+func (s *Server) respondToGetRequest(ctx context.Context, w io.Writer, req *serverGetRequest, result serverGetResult) error {
+	enc := protocol.NewEncoder(w)
+	start := time.Now()
+	size, reader, err := result.size, result.reader, result.err
+	if reader != nil {
+		defer reader.Close()
+	}
+
+	if req.denied {
+		return enc.Encode(protocol.GetResponse{Kind: req.kind, UuidAndHash: req.uuidAndHash})
+	}
+
+	// Treat internal errors as MISS
+	if err != nil {
+		s.log(ctx, "Error getting from cache:", err)
+	}
+
+	if err != nil || size == 0 {
+		getCacheHit.WithLabelValues(s.Namespace, string(req.kind), "miss").Inc()
+		return enc.Encode(protocol.GetResponse{Kind: req.kind, UuidAndHash: req.uuidAndHash})
+	}
+
+	// Everything's A-OK
+	err = enc.Encode(protocol.GetResponse{Kind: req.kind, UuidAndHash: req.uuidAndHash, Hit: true, Size: size})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(w, reader, size)
+	if err != nil {
+		return err
 	}
+	getCacheHit.WithLabelValues(s.Namespace, string(req.kind), "hit").Inc()
+	getBytes.WithLabelValues(s.Namespace, string(req.kind)).Observe(float64(size))
+	getDurations.WithLabelValues(s.Namespace, string(req.kind)).Observe(time.Now().Sub(start).Seconds())
 	return nil
 }
 
 // Handles incoming requests.
 func (s *Server) handleRequest(ctx context.Context, conn net.Conn) {
-	s.waitGroup.Add(1)
 	start := time.Now()
 	readerAndWriterDone := sync.WaitGroup{}
 	getRequests := make(chan *serverGetRequest, 100000)
 
+	sess := s.startSession(conn)
+	defer s.endSession(sess)
+	if s.MaxSessionTime > 0 {
+		timer := time.AfterFunc(s.MaxSessionTime, sess.drain)
+		defer timer.Stop()
+	}
+
 	defer func() {
 		s.log(ctx, "Closing connection")
 		close(getRequests)
 		readerAndWriterDone.Wait()
 		conn.Close()
-		s.waitGroup.Done()
 	}()
-	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-	defer rw.Flush()
+	// Traffic both ways counts against the rate limits
+	addr, _ := ctx.Value("addr").(string)
+	limits := s.RateLimiter.connect(s.Namespace, addr)
+	defer limits.close()
+	dec := protocol.NewDecoder(&throttledReader{r: conn, limits: limits})
+	out := &throttledWriter{w: conn, limits: limits}
 
-	// Set 30s deadline for getting handshake done
-	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	// Deadline for getting handshake done
+	conn.SetDeadline(time.Now().Add(s.HandshakeTimeout))
 
 	var trx cache.Transaction
+	var trxSize int64
 	defer func() {
 		if trx != nil {
 			trx.Abort()
 		}
 	}()
 
+	mayRead := s.ReadACL.Allows(addr)
+	mayWrite := !s.ReadOnly && s.WriteACL.Allows(addr)
+
 	// First, read uint32 version number
-	version, err := readVersionNumber(rw)
+	version, err := dec.DecodeClientVersion()
 	if err != nil {
 		s.logf(ctx, "Could not read client version: %s", err)
 		return
 	}
-	ctx = context.WithValue(ctx, "version", version)
+	ctx = context.WithValue(ctx, "version", version.Number)
 
 	// Bail on unknown versions
-	if version != 0xfe {
-		s.logf(ctx, "Got invalid client version %d", version)
-		fmt.Fprintf(rw, "%08x", 0)
+	enc := protocol.NewEncoder(conn)
+	if version.Number != protocol.CurrentVersion {
+		s.logf(ctx, "Got invalid client version %d", version.Number)
+		enc.Encode(protocol.Version{Number: 0})
 		return
 	}
 
-	// Protocol says to echo version if everything is ok
-	s.logf(ctx, "Got client version %d", version)
-	fmt.Fprintf(rw, "%08x", version)
-
-	// Flush version, so client will begin sending data
-	rw.Flush()
+	// Protocol says to echo version if everything is ok, after which the
+	// client will begin sending data
+	s.logf(ctx, "Got client version %d", version.Number)
+	enc.Encode(version)
 
 	// Now that we've done a handshake (and sent it), we begin doing async
 	// reading/writing, as the Unity editor wants to send *all* its
@@ -310,63 +696,62 @@ func (s *Server) handleRequest(ctx context.Context, conn net.Conn) {
 	go func(reqs chan *serverGetRequest) {
 		defer readerAndWriterDone.Done()
 
-		sendError := s.respondToGetRequests(ctx, conn, reqs)
+		sendError := s.respondToGetRequests(ctx, out, reqs)
 		s.logf(ctx, "Done sending data err=%s", sendError)
 	}(getRequests)
 
 	for {
-		// Extend Read-dealine by five minutes for each command we process
-		conn.SetDeadline(time.Now().Add(5 * time.Minute))
+		// Extend deadline for each command we process. Unless a
+		// transaction is open, shutting down stops us here.
+		if !sess.nextCommand(s.IdleTimeout, trx == nil) {
+			s.log(ctx, "Shutting down; Quitting")
+			return
+		}
 
-		cmd, err := rw.ReadByte()
+		command, err := dec.Decode()
+		if !sess.gotCommand() {
+			s.log(ctx, "Shutting down; Quitting")
+			return
+		}
 		if err == io.EOF {
 			s.log(ctx, "Client hangup; Quitting")
 			return
+		} else if errors.Is(err, protocol.ErrInvalidCommand) {
+			ops.WithLabelValues(s.Namespace, "invalid").Inc()
+			s.log(ctx, err)
+			return
 		} else if err != nil {
 			s.log(ctx, "Error reading command:", err)
 			return
 		}
+		limits.wait(limitCommands, 1)
 
-		// Quit command
-		if cmd == 'q' {
-			ops.WithLabelValues(s.Namespace, "q").Inc()
-			s.logf(ctx, "Got command '%c'; Quitting", cmd)
-			return
-		}
+		start = time.Now()
 
-		// Get type
-		cmdType, err := rw.ReadByte()
-		if err != nil {
-			s.log(ctx, "Error reading command type:", err)
+		switch cmd := command.(type) {
+		case protocol.Quit:
+			ops.WithLabelValues(s.Namespace, "q").Inc()
+			s.log(ctx, "Got command 'q'; Quitting")
 			return
-		}
-		s.logf(ctx, "Got command op=%c kind=%c", cmd, cmdType)
-
-		start = time.Now()
 
-		// GET
-		if cmd == 'g' {
+		case protocol.Get:
 			ops.WithLabelValues(s.Namespace, "g").Inc()
+			s.logf(ctx, "Got command op=g kind=%c", cmd.Kind)
 
-			// Read uuidAndHash
-			uuidAndHash := make([]byte, 32)
-			_, err := io.ReadFull(rw, uuidAndHash)
-			if err != nil {
-				s.logf(ctx, "Error reading: %s", err)
+			if !mayRead {
+				denied.WithLabelValues(s.Namespace, "g").Inc()
 			}
 
-			//s.logf(ctx, "Get request parsed kind=%c uuidAndHash=%s", cmdType, PrettyUuidAndHash(uuidAndHash))
+			getQueueDepth.WithLabelValues(s.Namespace).Inc()
 			getRequests <- &serverGetRequest{
-				kind:        cache.Kind(cmdType),
-				uuidAndHash: uuidAndHash,
+				kind:        cmd.Kind,
+				uuidAndHash: cmd.UuidAndHash,
+				denied:      !mayRead,
 			}
 
-			continue
-		}
-
-		// Transaction start
-		if cmd == 't' && cmdType == 's' {
+		case protocol.TxStart:
 			ops.WithLabelValues(s.Namespace, "ts").Inc()
+			s.log(ctx, "Got command op=ts")
 
 			// Bail if we're already in a command
 			if trx != nil {
@@ -374,23 +759,25 @@ func (s *Server) handleRequest(ctx context.Context, conn net.Conn) {
 				return
 			}
 
-			// Read uuidAndHash
-			uuidAndHash := make([]byte, 32)
-			_, err := io.ReadFull(rw, uuidAndHash)
-			if err != nil {
-				s.log(ctx, "Error reading uuid+hash:", err)
-				return
-			}
+			trxSize = 0
 
-			//s.logf(ctx, "Transaction start uuidAndHash=%s", PrettyUuidAndHash(uuidAndHash))
+			// Uploads that aren't allowed are read and thrown away, so we
+			// stay in sync with the client
+			if !mayWrite {
+				denied.WithLabelValues(s.Namespace, "ts").Inc()
+				s.log(ctx, "Transaction start denied; discarding upload")
+				trx = cache.NOPTransaction{}
+				continue
+			}
 
-			trx = s.Cache.PutTransaction(s.Namespace, uuidAndHash)
-			continue
-		}
+			trx = s.Cache.PutTransaction(s.Namespace, cmd.UuidAndHash)
+			if c, ok := trx.(cache.ClientSetter); ok {
+				c.SetClient(addr)
+			}
 
-		// Transaction end
-		if cmd == 't' && cmdType == 'e' {
+		case protocol.TxEnd:
 			ops.WithLabelValues(s.Namespace, "te").Inc()
+			s.log(ctx, "Got command op=te")
 
 			if trx == nil {
 				s.log(ctx, "Transaction end error: None started")
@@ -399,57 +786,74 @@ func (s *Server) handleRequest(ctx context.Context, conn net.Conn) {
 
 			err := trx.Commit()
 			if err != nil {
+				putFailures.WithLabelValues(s.Namespace, "commit").Inc()
 				s.log(ctx, "Transaction end error: Commit failed:", err)
+				trx.Abort()
+				trx = nil
 				continue
 			}
 
 			s.log(ctx, "Transaction end")
 
 			trx = nil
-			continue
-		}
 
-		// Put
-		if cmd == 'p' {
+		case protocol.Put:
 			ops.WithLabelValues(s.Namespace, "p").Inc()
-
-			// Bail on wrong CMD-types
-			if cmdType != 'a' && cmdType != 'i' && cmdType != 'r' {
-				s.logf(ctx, "Put error: invalid type '%s'", []byte{cmdType})
-				return
-			}
+			s.logf(ctx, "Put kind=%c size=%d", cmd.Kind, cmd.Size)
 
 			if trx == nil {
 				s.logf(ctx, "Put error: Not inside transaction")
 				return
 			}
 
-			// Read size
-			sizeBytes := make([]byte, 16)
-			_, err := io.ReadFull(rw, sizeBytes)
-			if err != nil {
-				s.log(ctx, "Put error: cannot read size:", err)
+			// Read oversized uploads to stay in sync with the client,
+			// and throw away the rest of the transaction. Transactions
+			// already thrown away are only counted once.
+			maxSize := s.MaxPutSize[cmd.Kind]
+			trxSize += cmd.Size
+			_, discarding := trx.(cache.NOPTransaction)
+			if !discarding && ((maxSize > 0 && cmd.Size > maxSize) || (s.MaxTransactionSize > 0 && trxSize > s.MaxTransactionSize)) {
+				oversizedPuts.WithLabelValues(s.Namespace, string(cmd.Kind)).Inc()
+				s.logf(ctx, "Put kind=%c size=%d over size limit; discarding transaction", cmd.Kind, cmd.Size)
+				if _, err := io.Copy(ioutil.Discard, s.uploadReader(dec.Payload(), conn, limits)); err != nil || dec.Payload().N > 0 {
+					s.log(ctx, "Put error: cannot read data:", err)
+					return
+				}
+				trx.Abort()
+				trx = cache.NOPTransaction{}
+				continue
+			}
+
+			body := &putReader{r: dec.Payload()}
+			err = trx.Put(cmd.Size, cmd.Kind, s.uploadReader(body, conn, limits))
+
+			// Skip whatever the backend didn't read, so the rest of the
+			// payload isn't taken for commands
+			io.Copy(ioutil.Discard, s.uploadReader(body, conn, limits))
+			if body.err != nil || body.r.N > 0 {
+				putFailures.WithLabelValues(s.Namespace, "short_read").Inc()
+				s.logf(ctx, "Put error: client sent %d of %d bytes: %v", cmd.Size-body.r.N, cmd.Size, body.err)
 				return
 			}
 
-			// Parse size
-			size, err := strconv.ParseUint(string(sizeBytes), 16, 64)
+			// Throw away the rest of the transaction, so te doesn't
+			// commit a partial entry
 			if err != nil {
-				s.logf(ctx, "Put error: cannot parse size '%x': %s", sizeBytes, err)
-				return
+				putFailures.WithLabelValues(s.Namespace, "backend").Inc()
+				s.log(ctx, "Put error: discarding transaction:", err)
+				trx.Abort()
+				trx = cache.NOPTransaction{}
+				continue
 			}
-			s.logf(ctx, "Put kind=%c size=%d", cmdType, size)
 
-			trx.Put(int64(size), cache.Kind(cmdType), io.LimitReader(rw, int64(size)))
+			putBytes.WithLabelValues(s.Namespace, string(cmd.Kind)).Observe(float64(cmd.Size))
+			putDurations.WithLabelValues(s.Namespace, string(cmd.Kind)).Observe(time.Now().Sub(start).Seconds())
 
-			putBytes.WithLabelValues(s.Namespace, string(cmdType)).Observe(float64(size))
-			putDurations.WithLabelValues(s.Namespace, string(cmdType)).Observe(time.Now().Sub(start).Seconds())
-			continue
+		default:
+			// Responses and such have no business coming from clients
+			ops.WithLabelValues(s.Namespace, "invalid").Inc()
+			s.logf(ctx, "Invalid command: %#v", cmd)
+			return
 		}
-
-		// Invalid command
-		ops.WithLabelValues(s.Namespace, "invalid").Inc()
-		s.logf(ctx, "Invalid command: %c%c", cmd, cmdType)
-		return
 	}
 }
@@ -9,9 +9,14 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/msiebuhr/ucs/cache"
+
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestHandshakes(t *testing.T) {
@@ -92,6 +97,24 @@ func TestGACacheMiss(t *testing.T) {
 	}
 }
 
+func TestGetOfUnknownKindIsAMiss(t *testing.T) {
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) { s.Cache = cache.NewMemory(1e6) })
+	go s.handleRequest(context.Background(), server)
+
+	request := fmt.Sprintf("%08xgX%016s%016sga%016s%016sq", 0xfe, "dead", "beef", "dead", "beef")
+	client.Write([]byte(request))
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x-X%016s%016s-a%016s%016s", 0xfe, "dead", "beef", "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply for request `%s` to be\n `%s`, got\n `%s`", request, expected, string(out))
+	}
+}
+
 func TestGACachePutAndGet(t *testing.T) {
 	client, server := net.Pipe()
 	s := NewServer(func(s *Server) { s.Cache = cache.NewMemory(1e6) })
@@ -219,11 +242,9 @@ func TestGACachePutAndGetKeyWithUTF8(t *testing.T) {
 func BenchmarkServers(b *testing.B) {
 	fs, _ := cache.NewFS(
 		func(s *cache.FS) { s.Quota = 1024 * 1024 * 1024 },
-		func(s *cache.FS) { s.Basepath = "./testdata/bench" },
+		func(s *cache.FS) { s.Basepath = b.TempDir() },
 	)
-	defer func() {
-		os.RemoveAll(fs.Basepath)
-	}()
+	defer fs.Close()
 
 	backends := map[string]cache.Cacher{
 		"NOP":    &cache.NOP{},
@@ -279,3 +300,333 @@ func HelpBenchmarkServerGets(b *testing.B, s *Server, size int64) {
 
 	client.Write([]byte("q"))
 }
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucs-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ucs.sock")
+
+	s := NewServer()
+	go s.Listen(context.Background(), "unix:"+path)
+	defer s.Stop()
+
+	// Wait for the socket to show up
+	var conn net.Conn
+	for i := 0; i < 100; i += 1 {
+		conn, err = net.Dial("unix", path)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Could not connect to unix socket: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("000000feq"))
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	if !bytes.Equal(out, []byte("000000fe")) {
+		t.Errorf("Expected reply for version `000000fe` to be `000000fe`, got `%s`", out)
+	}
+}
+
+func TestOversizedPutsAreDiscarded(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		options func(*Server)
+	}{
+		{"kind", func(s *Server) { s.MaxPutSize = map[cache.Kind]int64{cache.KIND_ASSET: 10} }},
+		{"transaction", func(s *Server) { s.MaxTransactionSize = 60 }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			s := NewServer(func(s *Server) { s.Cache = cache.NewMemory(1e6) }, tc.options)
+			defer s.Stop()
+			go s.handleRequest(context.Background(), server)
+
+			data := []byte("Here is some very lovely test information for ya'")
+
+			go func() {
+				fmt.Fprintf(client, "%08x", 0xfe)
+				fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+				fmt.Fprintf(client, "pi%016x", len(data))
+				client.Write(data)
+				fmt.Fprintf(client, "pa%016x", len(data))
+				client.Write(data)
+				fmt.Fprintf(client, "te")
+				fmt.Fprintf(client, "gi%016s%016s", "dead", "beef")
+				fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+				client.Write([]byte("q"))
+			}()
+
+			out, err := ioutil.ReadAll(client)
+			if err != nil {
+				t.Errorf("Error reading response: %s", err)
+			}
+			expected := fmt.Sprintf("%08x-i%016s%016s-a%016s%016s", 0xfe, "dead", "beef", "dead", "beef")
+			if !bytes.Equal(out, []byte(expected)) {
+				t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+			}
+		})
+	}
+}
+
+func TestSlowOversizedPutKeepsConnection(t *testing.T) {
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) {
+		s.Cache = cache.NewMemory(1e6)
+		s.Namespace = "slow-oversized"
+		s.MaxPutSize = map[cache.Kind]int64{cache.KIND_ASSET: 10}
+		s.IdleTimeout = 100 * time.Millisecond
+	})
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+
+		// Taking longer than the idle timeout in all, but not between reads
+		fmt.Fprintf(client, "pa%016x", 20)
+		for i := 0; i < 20; i += 1 {
+			time.Sleep(20 * time.Millisecond)
+			client.Write([]byte("x"))
+		}
+		fmt.Fprintf(client, "pa%016x", 20)
+		client.Write(make([]byte, 20))
+		fmt.Fprintf(client, "te")
+		fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x-a%016s%016s", 0xfe, "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+
+	// Only the first put over the limit is counted
+	m := &dto.Metric{}
+	oversizedPuts.WithLabelValues("slow-oversized", "a").Write(m)
+	if m.GetCounter().GetValue() != 1 {
+		t.Errorf("Expected 1 oversized put, got %v", m.GetCounter().GetValue())
+	}
+}
+
+// Fails every put after reading a few bytes of it
+type failingPutCache struct {
+	cache.Cacher
+}
+
+func (c failingPutCache) PutTransaction(ns string, uuidAndHash []byte) cache.Transaction {
+	return failingPutTx{c.Cacher.PutTransaction(ns, uuidAndHash)}
+}
+
+type failingPutTx struct {
+	cache.Transaction
+}
+
+func (t failingPutTx) Put(size int64, kind cache.Kind, r io.Reader) error {
+	io.CopyN(ioutil.Discard, r, 3)
+	return fmt.Errorf("Disk full")
+}
+
+func TestFailedPutKeepsStreamInSync(t *testing.T) {
+	client, server := net.Pipe()
+	c := cache.NewMemory(1e6)
+	s := NewServer(func(s *Server) { s.Cache = failingPutCache{c} })
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	data := []byte("Here is some very lovely test information for ya'")
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+		fmt.Fprintf(client, "pi%016x", len(data))
+		client.Write(data)
+		fmt.Fprintf(client, "pa%016x", len(data))
+		client.Write(data)
+		fmt.Fprintf(client, "te")
+		fmt.Fprintf(client, "gi%016s%016s", "dead", "beef")
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x-i%016s%016s", 0xfe, "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+}
+
+func TestSlowFailedPutKeepsConnection(t *testing.T) {
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) {
+		s.Cache = failingPutCache{cache.NewMemory(1e6)}
+		s.IdleTimeout = 100 * time.Millisecond
+	})
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+
+		// The rest of the payload takes longer than the idle timeout
+		fmt.Fprintf(client, "pa%016x", 20)
+		for i := 0; i < 20; i += 1 {
+			time.Sleep(20 * time.Millisecond)
+			client.Write([]byte("x"))
+		}
+		fmt.Fprintf(client, "te")
+		fmt.Fprintf(client, "ga%016s%016s", "dead", "beef")
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x-a%016s%016s", 0xfe, "dead", "beef")
+	if !bytes.Equal(out, []byte(expected)) {
+		t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+}
+
+func TestShortPutIsNotCommitted(t *testing.T) {
+	client, server := net.Pipe()
+	c := cache.NewMemory(1e6)
+	s := NewServer(func(s *Server) { s.Cache = c })
+	defer s.Stop()
+
+	done := make(chan bool)
+	go func() {
+		s.handleRequest(context.Background(), server)
+		close(done)
+	}()
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		fmt.Fprintf(client, "ts%016s%016s", "dead", "beef")
+		fmt.Fprintf(client, "pa%016x", 100)
+		client.Write([]byte("only a bit"))
+		client.Close()
+	}()
+	ioutil.ReadAll(client)
+	<-done
+
+	uuidAndHash := []byte(fmt.Sprintf("%016s%016s", "dead", "beef"))
+	if size, _, _ := c.Get("", cache.KIND_ASSET, uuidAndHash); size != 0 {
+		t.Errorf("Expected truncated upload not to be stored, got size %d", size)
+	}
+}
+
+// Answers every get with a miss after a while, tracking concurrent lookups
+type slowGetCache struct {
+	cache.Cacher
+	lock        sync.Mutex
+	active      int
+	maxActive   int
+	delayByHash map[byte]time.Duration
+}
+
+func (c *slowGetCache) Get(ns string, kind cache.Kind, uuidAndHash []byte) (int64, io.ReadCloser, error) {
+	c.lock.Lock()
+	c.active += 1
+	if c.active > c.maxActive {
+		c.maxActive = c.active
+	}
+	delay := c.delayByHash[uuidAndHash[31]]
+	c.lock.Unlock()
+
+	time.Sleep(delay)
+
+	c.lock.Lock()
+	c.active -= 1
+	c.lock.Unlock()
+	return 0, nil, nil
+}
+
+func TestParallelGetsAnswerInOrder(t *testing.T) {
+	c := &slowGetCache{Cacher: cache.NewNOP(), delayByHash: map[byte]time.Duration{}}
+	client, server := net.Pipe()
+	s := NewServer(func(s *Server) {
+		s.Cache = c
+		s.GetWindow = 4
+	})
+	defer s.Stop()
+	go s.handleRequest(context.Background(), server)
+
+	// Later requests finish first
+	hashes := []byte("abcdefghij")
+	for i, hash := range hashes {
+		c.delayByHash[hash] = time.Duration(len(hashes)-i) * 5 * time.Millisecond
+	}
+
+	go func() {
+		fmt.Fprintf(client, "%08x", 0xfe)
+		for _, hash := range hashes {
+			fmt.Fprintf(client, "ga%031s%c", "", hash)
+		}
+		client.Write([]byte("q"))
+	}()
+
+	out, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Errorf("Error reading response: %s", err)
+	}
+	expected := fmt.Sprintf("%08x", 0xfe)
+	for _, hash := range hashes {
+		expected += fmt.Sprintf("-a%031s%c", "", hash)
+	}
+	if string(out) != expected {
+		t.Errorf("Expected reply for request to be\n `%s`, got\n `%s`", expected, string(out))
+	}
+
+	if c.maxActive < 2 || c.maxActive > 4 {
+		t.Errorf("Expected 2-4 concurrent lookups, got %d", c.maxActive)
+	}
+}
+
+// Send each line of data as a packet of its own, ignoring the responses
+func FuzzServer(f *testing.F) {
+	paths, err := filepath.Glob("fuzz/corpus/*")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		s := NewServer()
+
+		go func() {
+			for _, d := range bytes.Split(data, []byte("\n")) {
+				client.Write(d)
+			}
+			client.Close()
+		}()
+		go io.Copy(ioutil.Discard, client)
+
+		s.handleRequest(context.Background(), server)
+	})
+}
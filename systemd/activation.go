@@ -0,0 +1,73 @@
+// Package systemd implements the bits of systemd's socket activation and
+// notification protocols that ucs needs, without pulling in libsystemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// First file descriptor passed by systemd
+const listenFdsStart = 3
+
+// Listeners returns the sockets passed by systemd through LISTEN_FDS, grouped
+// by their names from LISTEN_FDNAMES (set with FileDescriptorName= in the
+// socket unit). Sockets without a name are grouped under "unknown", as
+// systemd does.
+//
+// The environment variables are unset, so child processes don't try to use
+// the same sockets.
+func Listeners() (map[string][]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return map[string][]net.Listener{}, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count == 0 {
+		return map[string][]net.Listener{}, nil
+	}
+
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	return FileListeners(listenFdsStart, count, names)
+}
+
+// FileListeners turns count inherited file descriptors, starting at start,
+// into listeners grouped by the given names.
+func FileListeners(start, count int, names []string) (map[string][]net.Listener, error) {
+	listeners := map[string][]net.Listener{}
+
+	for i := 0; i < count; i += 1 {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor, so we're done with the original
+		f.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("Socket %d (%s) is not a listener: %w", fd, name, err)
+		}
+
+		listeners[name] = append(listeners[name], l)
+	}
+
+	return listeners, nil
+}
@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenersWithoutSystemd(t *testing.T) {
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "2")
+
+	l, err := Listeners()
+	if err != nil || len(l) != 0 {
+		t.Errorf("Expected no listeners for another process, got %v, %s", l, err)
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Errorf("Expected environment to be cleaned up")
+	}
+}
+
+func TestListenersFromFds(t *testing.T) {
+	// Make two listeners and pass on duplicates of their descriptors, as
+	// systemd would
+	fds := []int{}
+	for i := 0; i < 2; i += 1 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		f, err := l.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+
+	// Need consecutive descriptors; duplicate both right after each other
+	first, err := syscall.Dup(fds[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := syscall.Dup(fds[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second != first+1 {
+		syscall.Close(first)
+		syscall.Close(second)
+		t.Skip("Could not get consecutive file descriptors, got " + strconv.Itoa(first) + " and " + strconv.Itoa(second))
+	}
+
+	listeners, err := FileListeners(first, 2, []string{"alpha"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+
+	if len(listeners["alpha"]) != 1 {
+		t.Errorf("Expected one listener named alpha, got %d", len(listeners["alpha"]))
+	}
+	if len(listeners["unknown"]) != 1 {
+		t.Errorf("Expected one unnamed listener, got %d", len(listeners["unknown"]))
+	}
+	for _, ls := range listeners {
+		for _, l := range ls {
+			l.Close()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucs-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	sent, err := Notify("READY=1")
+	if !sent || err != nil {
+		t.Fatalf("Expected notification to be sent, got %t, %s", sent, err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUnix(buf)
+	if err != nil {
+		t.Fatalf("Error reading notification: %s", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Expected 'READY=1', got '%s'", buf[:n])
+	}
+}
+
+func TestNotifyWithoutSystemd(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify("READY=1")
+	if sent || err != nil {
+		t.Errorf("Expected nothing to be sent, got %t, %s", sent, err)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv("WATCHDOG_USEC")
+	defer os.Unsetenv("WATCHDOG_PID")
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := WatchdogInterval(); interval != 30*time.Second {
+		t.Errorf("Expected 30s watchdog interval, got %s", interval)
+	}
+
+	os.Setenv("WATCHDOG_PID", "1")
+	if interval := WatchdogInterval(); interval != 0 {
+		t.Errorf("Expected no watchdog for another process, got %s", interval)
+	}
+
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	if interval := WatchdogInterval(); interval != 0 {
+		t.Errorf("Expected no watchdog when unset, got %s", interval)
+	}
+}
@@ -0,0 +1,90 @@
+package ucs
+
+import (
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloader serves a certificate/key pair from disk and re-reads it
+// whenever either file changes, so certificates can be rotated without
+// restarting the server.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// Load a certificate/key pair, failing if it can't be used.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload the certificate/key pair from disk.
+func (r *CertReloader) Reload() error {
+	certTime, keyTime, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cert = &cert
+	r.certTime = certTime
+	r.keyTime = keyTime
+	return nil
+}
+
+func (r *CertReloader) modTimes() (time.Time, time.Time, error) {
+	certStat, err := os.Stat(r.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	keyStat, err := os.Stat(r.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return certStat.ModTime(), keyStat.ModTime(), nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate. If the files on disk
+// have changed since they were last loaded, they are re-read. Should that
+// fail (ex. because only one of the two files has been replaced yet), the
+// previous certificate is kept.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certTime, keyTime, err := r.modTimes()
+
+	r.lock.Lock()
+	changed := err == nil && (!certTime.Equal(r.certTime) || !keyTime.Equal(r.keyTime))
+	r.lock.Unlock()
+
+	if changed {
+		r.Reload()
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.cert, nil
+}
+
+// TLSConfig returns a server config using the reloading certificate.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: r.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+}
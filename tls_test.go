@@ -0,0 +1,141 @@
+package ucs
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate and key to the given files
+func writeTestCertificate(t *testing.T, certFile, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %s", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("Could not write certificate: %s", err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatalf("Could not write key: %s", err)
+	}
+}
+
+func TestTLSHandshake(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	reloader, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error loading certificate: %s", err)
+	}
+
+	laddr, _ := net.ResolveTCPAddr("tcp", "127.0.0.1:0")
+	listener, err := net.ListenTCP("tcp", laddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer()
+	defer s.Stop()
+	go s.ListenerTLS(context.Background(), listener, reloader.TLSConfig())
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Unexpected error dialing: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("000000feq"))
+	out, err := ioutil.ReadAll(conn)
+	if err != nil && err != io.EOF {
+		t.Errorf("Error reading response: %s", err)
+	}
+	if !bytes.Equal(out, []byte("000000fe")) {
+		t.Errorf("Expected reply for version `000000fe` to be `000000fe`, got `%s`", out)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucs-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	r, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("Unexpected error loading certificate: %s", err)
+	}
+
+	first, _ := r.GetCertificate(nil)
+
+	// Rotate the certificate and make sure the change is visible
+	writeTestCertificate(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+	os.Chtimes(keyFile, future, future)
+
+	second, _ := r.GetCertificate(nil)
+	if bytes.Equal(first.Certificate[0], second.Certificate[0]) {
+		t.Errorf("Expected certificate to be reloaded after rotation")
+	}
+
+	// Broken files keep the old certificate around
+	ioutil.WriteFile(keyFile, []byte("garbage"), 0600)
+	future = future.Add(time.Minute)
+	os.Chtimes(keyFile, future, future)
+
+	third, _ := r.GetCertificate(nil)
+	if third == nil || !bytes.Equal(second.Certificate[0], third.Certificate[0]) {
+		t.Errorf("Expected previous certificate to be kept when reload fails")
+	}
+}
+
+func TestCertReloaderMissingFiles(t *testing.T) {
+	_, err := NewCertReloader("/does/not/exist.pem", "/does/not/exist-key.pem")
+	if err == nil {
+		t.Errorf("Expected error loading missing certificate")
+	}
+}